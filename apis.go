@@ -2,9 +2,12 @@ package apis
 
 import (
 	"github.com/ales6164/apis/kind"
+	"github.com/ales6164/apis/storage"
 	"github.com/gorilla/mux"
 	"google.golang.org/appengine/datastore"
 	"net/http"
+	"strings"
+	"time"
 )
 
 type Apis struct {
@@ -20,6 +23,24 @@ type Apis struct {
 type Options struct {
 	Auth  *Auth
 	Rules Rules
+	// Storage backend for all requests. Defaults to App Engine datastore.
+	Store storage.Store
+	// Defaults to App Engine memcache.
+	Cache storage.Cache
+	// Defaults to App Engine search.
+	Index storage.Index
+	// Roles that can read the audit log at GET /_audit, like {"admin": {FullControl}}.
+	AuditPermissions Permissions
+	// Roles that can manage webhooks at /_webhooks. Deliveries are only sent by
+	// POST /_webhooks/_dispatch, which has to be scheduled in cron.yaml.
+	WebhookPermissions Permissions
+	// Lets webhooks deliver to loopback, link-local and private addresses, like in tests.
+	AllowPrivateWebhooks bool
+	// Delivers changes to event streams. Defaults to MemoryBroker.
+	Broker Broker
+	// Stored events are pruned after this time; streams can't resume from older ones.
+	// Defaults to DefaultEventRetention.
+	EventRetention time.Duration
 }
 
 type Match map[kind.Kind]Rules
@@ -28,6 +49,9 @@ type Roles []string
 type Rules struct {
 	Permissions Permissions
 	Match       Match `json:"-"`
+	// CacheControl is sent with GET responses, for example "public, max-age=300".
+	// Defaults to PublicCacheControl when AllUsers can read, PrivateCacheControl otherwise.
+	CacheControl string `json:"-"`
 }
 
 type Permissions map[string]Roles
@@ -43,6 +67,10 @@ func New(options *Options) *Apis {
 		kinds: map[string]kind.Kind{},
 	}
 
+	if a.Broker == nil {
+		a.Broker = NewMemoryBroker()
+	}
+
 	a.router = mux.NewRouter()
 
 	if a.Auth != nil {
@@ -55,19 +83,19 @@ func New(options *Options) *Apis {
 
 			err := ctx.ExtendSession(a.Auth.TokenExpiresIn)
 			if err != nil {
-				ctx.PrintError(err.Error(), http.StatusInternalServerError)
+				ctx.PrintProblem(err, http.StatusInternalServerError)
 				return
 			}
 
 			user, err := a.Auth.User(ctx, ctx.Member())
 			if err != nil {
-				ctx.PrintError(err.Error(), http.StatusInternalServerError)
+				ctx.PrintProblem(err, http.StatusInternalServerError)
 				return
 			}
 
 			signedToken, err := a.Auth.SignedToken(ctx.session)
 			if err != nil {
-				ctx.PrintError(err.Error(), http.StatusInternalServerError)
+				ctx.PrintProblem(err, http.StatusInternalServerError)
 				return
 			}
 
@@ -85,7 +113,12 @@ func New(options *Options) *Apis {
 		}
 	}
 
-	a.router.Handle(`/{path:[a-zA-Z0-9=\-\/]+}`, Middleware(a))
+	a.router.Handle("/_batch", Middleware(http.HandlerFunc(a.serveBatch))).Methods(http.MethodOptions, http.MethodPost)
+	a.router.Handle("/_audit", Middleware(http.HandlerFunc(a.serveAudit))).Methods(http.MethodOptions, http.MethodGet, http.MethodHead)
+	a.router.Handle("/_webhooks", Middleware(http.HandlerFunc(a.serveWebhooks)))
+	a.router.Handle(`/_webhooks/{path:[a-zA-Z0-9=\-\/_]+}`, Middleware(http.HandlerFunc(a.serveWebhooks)))
+
+	a.router.Handle(`/{path:[a-zA-Z0-9=\-\/_]+}`, Middleware(a))
 
 	return a
 }
@@ -94,16 +127,34 @@ func Middleware(h http.Handler) http.Handler {
 	return http.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if origin := r.Header.Get("Origin"); origin != "" {
 			w.Header().Set("Access-Control-Allow-Origin", origin)
-			w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE")
+			w.Header().Set("Access-Control-Allow-Methods", "POST, GET, HEAD, OPTIONS, PUT, PATCH, DELETE")
 			w.Header().Set("Access-Control-Allow-Headers",
 				"Accept, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization, Cache-Control, "+
-					"X-Requested-With, X-Include-Meta")
+					"X-Requested-With, X-Include-Meta, If-Match")
+			w.Header().Set("Access-Control-Expose-Headers", "ETag")
 		}
 
 		if r.Method == http.MethodOptions {
 			return
 		}
 
+		if r.Method == http.MethodHead {
+			get := *r
+			get.Method = http.MethodGet
+			r, w = &get, headWriter{w}
+		}
+
+		if _, ok := negotiate(r.Header.Get("Accept")); !ok {
+			id := requestID(r)
+			w.Header().Set(RequestIDHeader, id)
+			writeProblem(w, Problem{
+				Status:    http.StatusNotAcceptable,
+				Detail:    "supported media types are " + strings.Join(supportedMediaTypes, ", "),
+				RequestID: id,
+			})
+			return
+		}
+
 		h.ServeHTTP(w, r)
 	}))
 }
@@ -132,7 +183,14 @@ func Middleware(h http.Handler) http.Handler {
 	}
 }*/
 
+// HandleKind serves documents of k. It panics if k has valid tags with unknown validators,
+// which have to be registered before.
 func (a *Apis) HandleKind(k kind.Kind) {
+	if c, ok := k.(interface{ CheckRules() error }); ok {
+		if err := c.CheckRules(); err != nil {
+			panic(err)
+		}
+	}
 	a.kinds[k.Name()] = k
 	a.handleKind(k.Name(), k)
 }
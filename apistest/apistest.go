@@ -0,0 +1,230 @@
+// Package apistest runs Apis applications in plain go test. Datastore, memcache
+// and search are replaced with in-memory fakes and a Client can register, log in
+// and send authenticated requests.
+package apistest
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/ales6164/apis"
+	"github.com/ales6164/apis/kind"
+	"github.com/ales6164/apis/providers/emailpassword"
+	"github.com/ales6164/apis/storage"
+	"github.com/dgrijalva/jwt-go"
+	"golang.org/x/crypto/bcrypt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// SigningKey signs tokens when options don't provide Auth.
+var SigningKey = []byte("apistest")
+
+type Server struct {
+	*apis.Apis
+	Store   *storage.Memory
+	Cache   *storage.MemoryCache
+	Index   *storage.MemoryIndex
+	handler http.Handler
+}
+
+// New builds Apis from options and exposes kinds. Unless set, Store, Cache and
+// Index are in-memory fakes and Auth issues HS256 tokens signed with SigningKey.
+// The emailpassword provider is registered if Auth doesn't have it yet.
+func New(options *apis.Options, kinds ...kind.Kind) *Server {
+	if options == nil {
+		options = &apis.Options{}
+	}
+	s := &Server{
+		Store: storage.NewMemory(),
+		Cache: storage.NewMemoryCache(),
+		Index: storage.NewMemoryIndex(),
+	}
+	if options.Store == nil {
+		options.Store = s.Store
+	}
+	if options.Cache == nil {
+		options.Cache = s.Cache
+	}
+	if options.Index == nil {
+		options.Index = s.Index
+	}
+	if options.Auth == nil {
+		options.Auth = apis.NewAuth(&apis.AuthOptions{
+			SigningKey:          SigningKey,
+			Extractors:          []apis.TokenExtractor{apis.FromAuthHeader},
+			CredentialsOptional: true,
+			SigningMethod:       jwt.SigningMethodHS256,
+			HashingCost:         bcrypt.MinCost,
+		})
+	}
+	if options.Auth.GetProvider("emailpassword") == nil {
+		options.Auth.RegisterProvider(emailpassword.New(nil))
+	}
+
+	s.Apis = apis.New(options)
+	for _, k := range kinds {
+		s.HandleKind(k)
+	}
+	s.handler = s.Handler()
+	return s
+}
+
+// Reset clears all fakes so the next test starts with empty storage.
+func (s *Server) Reset() {
+	s.Store.Reset()
+	s.Cache.Reset()
+	s.Index.Reset()
+}
+
+// Client returns an anonymous client.
+func (s *Server) Client() *Client {
+	return &Client{s: s, Header: http.Header{}}
+}
+
+// Register creates a user through emailpassword and returns its client.
+func (s *Server) Register(email, password string) (*Client, error) {
+	return s.Client().auth("register", email, password)
+}
+
+// Login signs in through emailpassword and returns the user's client.
+func (s *Server) Login(email, password string) (*Client, error) {
+	return s.Client().auth("login", email, password)
+}
+
+type Client struct {
+	s      *Server
+	Token  string
+	User   *apis.User
+	Header http.Header // sent with every request
+}
+
+func (c *Client) auth(path, email, password string) (*Client, error) {
+	res := c.Do(http.MethodPost, "/auth/emailpassword/"+path, map[string]string{
+		"email":    email,
+		"password": password,
+	})
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s failed with %d: %s", path, res.StatusCode, strings.TrimSpace(res.String()))
+	}
+	var ar apis.AuthResponse
+	if err := res.JSON(&ar); err != nil {
+		return nil, err
+	}
+	if len(ar.Token.Id) == 0 {
+		return nil, errors.New("missing token")
+	}
+	c.Token = ar.Token.Id
+	c.User = ar.User
+	return c, nil
+}
+
+// Do sends a request. Body can be nil, []byte, string, io.Reader or a value
+// that is encoded as JSON. Header pairs are added after the client's headers.
+func (c *Client) Do(method, path string, body interface{}, headerPair ...string) *Response {
+	var r io.Reader
+	switch b := body.(type) {
+	case nil:
+	case []byte:
+		r = bytes.NewReader(b)
+	case string:
+		r = strings.NewReader(b)
+	case io.Reader:
+		r = b
+	default:
+		data, err := json.Marshal(b)
+		if err != nil {
+			panic(err)
+		}
+		r = bytes.NewReader(data)
+	}
+
+	req := httptest.NewRequest(method, path, r)
+	for k, v := range c.Header {
+		req.Header[k] = v
+	}
+	if len(c.Token) > 0 {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+	for i := 0; i+1 < len(headerPair); i += 2 {
+		req.Header.Set(headerPair[i], headerPair[i+1])
+	}
+
+	w := httptest.NewRecorder()
+	c.s.handler.ServeHTTP(w, req)
+	return &Response{
+		StatusCode: w.Code,
+		Header:     w.Header(),
+		Body:       w.Body.Bytes(),
+	}
+}
+
+func (c *Client) Get(path string, headerPair ...string) *Response {
+	return c.Do(http.MethodGet, path, nil, headerPair...)
+}
+
+func (c *Client) Post(path string, body interface{}, headerPair ...string) *Response {
+	return c.Do(http.MethodPost, path, body, headerPair...)
+}
+
+func (c *Client) Put(path string, body interface{}, headerPair ...string) *Response {
+	return c.Do(http.MethodPut, path, body, headerPair...)
+}
+
+func (c *Client) Patch(path string, body interface{}, headerPair ...string) *Response {
+	return c.Do(http.MethodPatch, path, body, headerPair...)
+}
+
+func (c *Client) Delete(path string, headerPair ...string) *Response {
+	return c.Do(http.MethodDelete, path, nil, headerPair...)
+}
+
+type Response struct {
+	StatusCode int
+	Header     http.Header
+	Body       []byte
+}
+
+func (r *Response) String() string {
+	return string(r.Body)
+}
+
+// JSON decodes response body into v.
+func (r *Response) JSON(v interface{}) error {
+	return json.Unmarshal(r.Body, v)
+}
+
+// Expect fails the test when status code doesn't match.
+func (r *Response) Expect(t testing.TB, statusCode int) *Response {
+	t.Helper()
+	if r.StatusCode != statusCode {
+		t.Errorf("expected status %d, got %d: %s", statusCode, r.StatusCode, strings.TrimSpace(r.String()))
+	}
+	return r
+}
+
+// Case is a single request in a table-driven test.
+type Case struct {
+	Name   string
+	Client *Client
+	Method string
+	Path   string
+	Body   interface{}
+	Header []string
+	Status int
+}
+
+// Run runs each case as a subtest and checks its status code.
+func Run(t *testing.T, cases []Case) {
+	t.Helper()
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.Name, func(t *testing.T) {
+			tc.Client.Do(tc.Method, tc.Path, tc.Body, tc.Header...).Expect(t, tc.Status)
+		})
+	}
+}
@@ -0,0 +1,77 @@
+package apistest_test
+
+import (
+	"github.com/ales6164/apis"
+	"github.com/ales6164/apis/apistest"
+	"github.com/ales6164/apis/collection"
+	"net/http"
+	"testing"
+)
+
+type Object struct {
+	Id   string `datastore:"-" auto:"id" json:"id,omitempty"`
+	Name string `json:"name"`
+}
+
+var objects = collection.New("objects", Object{})
+
+func newServer(permissions apis.Permissions) *apistest.Server {
+	return apistest.New(&apis.Options{
+		Rules: apis.Rules{Match: apis.Match{objects: apis.Rules{Permissions: permissions}}},
+	}, objects)
+}
+
+func TestRegisterAndLogin(t *testing.T) {
+	s := newServer(nil)
+	if _, err := s.Register("a@example.com", "secret1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Login("a@example.com", "wrong-password"); err == nil {
+		t.Fatal("login with wrong password succeeded")
+	}
+	c, err := s.Login("a@example.com", "secret1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Token) == 0 || c.User == nil {
+		t.Fatalf("login returned token %q and user %v", c.Token, c.User)
+	}
+}
+
+func TestReset(t *testing.T) {
+	s := newServer(apis.Permissions{apis.AllAuthenticatedUsers: {apis.FullControl}})
+	c, err := s.Register("a@example.com", "secret1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Post("/objects", Object{Name: "a"}).Expect(t, http.StatusOK)
+	s.Reset()
+	if _, err := s.Login("a@example.com", "secret1"); err == nil {
+		t.Fatal("user exists after reset")
+	}
+}
+
+func TestAccess(t *testing.T) {
+	s := newServer(apis.Permissions{
+		apis.AllUsers:              {apis.ReadOnly},
+		apis.AllAuthenticatedUsers: {apis.FullControl},
+	})
+	user, err := s.Register("a@example.com", "secret1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var o Object
+	if err := user.Post("/objects", Object{Name: "a"}).Expect(t, http.StatusOK).JSON(&o); err != nil {
+		t.Fatal(err)
+	}
+	anonymous := s.Client()
+
+	apistest.Run(t, []apistest.Case{
+		{Name: "user reads", Client: user, Method: http.MethodGet, Path: "/objects/" + o.Id, Status: http.StatusOK},
+		{Name: "user lists", Client: user, Method: http.MethodGet, Path: "/objects", Status: http.StatusOK},
+		{Name: "user updates", Client: user, Method: http.MethodPut, Path: "/objects/" + o.Id, Body: Object{Name: "b"}, Status: http.StatusOK},
+		{Name: "anonymous without token", Client: anonymous, Method: http.MethodGet, Path: "/objects/" + o.Id, Status: http.StatusUnauthorized},
+		{Name: "anonymous creates", Client: anonymous, Method: http.MethodPost, Path: "/objects", Body: Object{Name: "c"}, Status: http.StatusUnauthorized},
+		{Name: "unknown collection", Client: user, Method: http.MethodGet, Path: "/unknown", Status: http.StatusNotFound},
+	})
+}
@@ -0,0 +1,225 @@
+package apis
+
+import (
+	"github.com/ales6164/apis/kind"
+	"github.com/ales6164/apis/storage"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const AuditKind = "_audit"
+
+// Audit outcomes.
+const (
+	AuditSuccess = "success"
+	AuditDenied  = "denied"
+	AuditFailure = "failure"
+)
+
+// AuditEntry records a change or a denied request. Entries are stored in the default namespace.
+type AuditEntry struct {
+	Time      time.Time      `json:"time"`
+	Member    *datastore.Key `json:"member,omitempty"`
+	Session   *datastore.Key `json:"session,omitempty"`
+	Device    Device         `json:"device"`
+	Kind      string         `json:"kind,omitempty"`
+	Key       *datastore.Key `json:"key,omitempty"`
+	Operation string         `json:"operation"`       // create, update, delete, grant, read or action, like import
+	Roles     []string       `json:"roles,omitempty"` // granted roles
+	Method    string         `json:"method"`
+	Path      string         `json:"path"`
+	Status    int            `json:"status"`
+	Outcome   string         `json:"outcome"`
+}
+
+// Records status of the response for the audit log.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+/*
+Appends entry for the served request if it changed something or was denied. Reads that
+succeed aren't recorded. Operation is the action, like import, or comes from the method.
+*/
+func (ctx Context) auditRequest(status int, document kind.Doc, action string) {
+	denied := status == http.StatusUnauthorized || status == http.StatusForbidden
+	read := ctx.r.Method == http.MethodGet || ctx.r.Method == http.MethodHead
+	if read && !denied {
+		return
+	}
+	e := ctx.auditEntry(document)
+	e.Status = status
+	switch {
+	case denied:
+		e.Outcome = AuditDenied
+	case status >= http.StatusBadRequest:
+		e.Outcome = AuditFailure
+	default:
+		e.Outcome = AuditSuccess
+	}
+	switch {
+	case len(action) > 0:
+		e.Operation = strings.Replace(strings.TrimPrefix(action, "_"), "/_", ".", -1)
+	case read:
+		e.Operation = "read"
+	case ctx.r.Method == http.MethodPost:
+		e.Operation = "create"
+	case ctx.r.Method == http.MethodDelete:
+		e.Operation = "delete"
+	default:
+		e.Operation = "update"
+	}
+	ctx.audit(e)
+}
+
+// AuditGrant records roles given to member on document with key. Called by kind.Doc.SetRole().
+func (ctx Context) AuditGrant(key *datastore.Key, member *datastore.Key, roles []string) {
+	e := ctx.auditEntry(nil)
+	e.Key = key
+	if key != nil {
+		e.Kind = key.Kind()
+	}
+	e.Operation = "grant"
+	e.Roles = roles
+	e.Status = http.StatusOK
+	e.Outcome = AuditSuccess
+	ctx.audit(e)
+}
+
+func (ctx Context) auditEntry(document kind.Doc) *AuditEntry {
+	e := &AuditEntry{
+		Time:   time.Now(),
+		Device: GetDevice(ctx.r),
+		Method: ctx.r.Method,
+		Path:   ctx.r.URL.Path,
+	}
+	if ctx.session != nil {
+		e.Member = ctx.session.Member
+		e.Session = ctx.session.Key
+	}
+	if document != nil {
+		e.Kind = document.Kind().Name()
+		if key := document.Key(); key != nil && !key.Incomplete() {
+			e.Key = key
+		}
+	}
+	return e
+}
+
+// Stores entry. Inside batches it's stored after the commit; failing to store it doesn't fail
+// the request.
+func (ctx Context) audit(e *AuditEntry) {
+	err := storage.AfterCommit(ctx, func(c context.Context) error {
+		if _, err := storage.Put(c, datastore.NewIncompleteKey(c, AuditKind, nil), e); err != nil {
+			ctx.logf("audit error: %v", err)
+		}
+		return nil
+	})
+	if err != nil {
+		ctx.logf("audit error: %v", err)
+	}
+}
+
+/*
+GET /_audit lists audit entries, most recent first. Only members with a role that has a scope
+in Options.AuditPermissions can read it. Filters:
+
+	member  encoded member key
+	kind    collection name
+	from    RFC 3339 time, inclusive
+	to      RFC 3339 time, exclusive
+
+Pages are limit long and linked with cursor. On App Engine filters need composite indexes on
+_audit with Time descending.
+*/
+func (a *Apis) serveAudit(w http.ResponseWriter, r *http.Request) {
+	ctx := a.NewContext(w, r)
+	if ok := ctx.HasAccess(Rules{Permissions: a.AuditPermissions}, ReadOnly, ReadWrite, FullControl); !ok {
+		ctx.PrintForbidden()
+		return
+	}
+
+	params := r.URL.Query()
+	q := storage.NewQuery(AuditKind)
+	if v := params.Get("member"); len(v) > 0 {
+		member, err := datastore.DecodeKey(v)
+		if err != nil {
+			ctx.PrintError("invalid member", http.StatusBadRequest)
+			return
+		}
+		q = q.Filter("Member =", member)
+	}
+	if v := params.Get("kind"); len(v) > 0 {
+		q = q.Filter("Kind =", v)
+	}
+	for param, filter := range map[string]string{"from": "Time >=", "to": "Time <"} {
+		if v := params.Get(param); len(v) > 0 {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				ctx.PrintError("invalid "+param+" time", http.StatusBadRequest)
+				return
+			}
+			q = q.Filter(filter, t)
+		}
+	}
+	limit, ok := pageLimit(ctx)
+	if !ok {
+		return
+	}
+	q = q.Order("-Time").Limit(limit + 1)
+	if v := params.Get("cursor"); len(v) > 0 {
+		q = q.Start(v)
+	}
+
+	var entries = []AuditEntry{}
+	var next string
+	t := q.Run(ctx)
+	for {
+		var e AuditEntry
+		if len(entries) == limit {
+			// next page starts after the last returned entry, if there's one more
+			cursor, err := t.Cursor()
+			if err != nil {
+				ctx.PrintProblem(err, http.StatusInternalServerError)
+				return
+			}
+			if _, err = t.Next(&e); err == nil {
+				next = cursor
+			}
+			break
+		}
+		if _, err := t.Next(&e); err == datastore.Done {
+			break
+		} else if err != nil {
+			ctx.PrintProblem(err, http.StatusBadRequest)
+			return
+		}
+		entries = append(entries, e)
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	ctx.PrintJSON(entries, http.StatusOK, "Link", nextLink(r, next))
+}
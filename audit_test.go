@@ -0,0 +1,109 @@
+package apis_test
+
+import (
+	"github.com/ales6164/apis"
+	"github.com/ales6164/apis/collection"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestAudit(t *testing.T) {
+	secrets := collection.New("secrets", Object{})
+	s, c := newServer(t, &apis.Options{
+		AuditPermissions: apis.Permissions{apis.AllAuthenticatedUsers: {apis.ReadOnly}},
+		Rules: apis.Rules{Match: apis.Match{
+			secrets: {Permissions: apis.Permissions{"admin": {apis.FullControl}}},
+		}},
+	})
+	s.HandleKind(secrets)
+	other, err := s.Register("other@example.com", "secret2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	audit := func(query string) []apis.AuditEntry {
+		t.Helper()
+		var entries []apis.AuditEntry
+		if err := c.Get("/_audit"+query).Expect(t, http.StatusOK).JSON(&entries); err != nil {
+			t.Fatal(err)
+		}
+		return entries
+	}
+	before := len(audit(""))
+
+	o := create(t, c, "/objects", Object{Name: "a"})
+	c.Get("/objects/"+o.Id).Expect(t, http.StatusOK)
+	c.Get("/objects").Expect(t, http.StatusOK)
+	c.Post("/secrets", Object{Name: "s"}).Expect(t, http.StatusForbidden)
+	time.Sleep(time.Millisecond)
+	middle := time.Now()
+	time.Sleep(time.Millisecond)
+	create(t, other, "/objects", Object{Name: "b"})
+	s.Client().Get("/objects").Expect(t, http.StatusUnauthorized)
+
+	entries := audit("")
+	if len(entries)-before != 6 {
+		t.Fatalf("%d entries were added: %+v", len(entries)-before, entries)
+	}
+	// most recent first; successful reads aren't recorded, creates grant roles
+	anonymous, otherCreate, otherGrant, denied, create, grant := entries[0], entries[1], entries[2], entries[3], entries[4], entries[5]
+	if anonymous.Outcome != apis.AuditDenied || anonymous.Member != nil || anonymous.Operation != "read" {
+		t.Errorf("anonymous listing is %+v", anonymous)
+	}
+	if denied.Outcome != apis.AuditDenied || denied.Kind != "secrets" || denied.Operation != "create" || denied.Status != http.StatusForbidden {
+		t.Errorf("denied create is %+v", denied)
+	}
+	if create.Outcome != apis.AuditSuccess || create.Operation != "create" || create.Member == nil || create.Key == nil {
+		t.Errorf("create is %+v", create)
+	}
+	if grant.Operation != "grant" || !grant.Key.Equal(create.Key) || len(grant.Roles) != 1 || grant.Roles[0] != apis.FullControl {
+		t.Errorf("grant is %+v", grant)
+	}
+	if otherCreate.Member == nil || otherCreate.Member.Equal(create.Member) {
+		t.Errorf("create of the other member is %+v", otherCreate)
+	}
+
+	byMember := audit("?member=" + otherCreate.Member.Encode())
+	if len(byMember) != 2 || !byMember[0].Key.Equal(otherCreate.Key) || byMember[1].Operation != otherGrant.Operation {
+		t.Errorf("entries of member are %+v", byMember)
+	}
+	byKind := audit("?kind=secrets")
+	if len(byKind) != 1 || byKind[0].Outcome != apis.AuditDenied {
+		t.Errorf("entries of secrets are %+v", byKind)
+	}
+	from := audit("?from=" + url.QueryEscape(middle.Format(time.RFC3339Nano)))
+	to := audit("?to=" + url.QueryEscape(middle.Format(time.RFC3339Nano)))
+	if len(from) != 3 || len(to) != len(entries)-3 {
+		t.Errorf("%d entries are from and %d to %s, of %d", len(from), len(to), middle, len(entries))
+	}
+	c.Get("/_audit?from=yesterday").Expect(t, http.StatusBadRequest)
+	c.Get("/_audit?member=nobody").Expect(t, http.StatusBadRequest)
+
+	// pages follow each other without gaps
+	var paged []apis.AuditEntry
+	path := "/_audit?limit=2"
+	for len(path) > 0 {
+		res := c.Get(path).Expect(t, http.StatusOK)
+		var page []apis.AuditEntry
+		if err := res.JSON(&page); err != nil {
+			t.Fatal(err)
+		}
+		if len(page) > 2 {
+			t.Fatalf("page has %d entries", len(page))
+		}
+		paged = append(paged, page...)
+		path = links(t, res.Header.Get("Link"), "http://example.com")["next"]
+	}
+	if len(paged) != len(entries) {
+		t.Fatalf("pages have %d entries, listing %d", len(paged), len(entries))
+	}
+	for i := range paged {
+		if !paged[i].Time.Equal(entries[i].Time) {
+			t.Fatalf("entry %d of pages is %+v, listing has %+v", i, paged[i], entries[i])
+		}
+	}
+
+	// only roles in AuditPermissions read the log
+	s.Client().Get("/_audit").Expect(t, http.StatusUnauthorized)
+}
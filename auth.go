@@ -2,6 +2,7 @@ package apis
 
 import (
 	"errors"
+	"github.com/ales6164/apis/storage"
 	"github.com/dgrijalva/jwt-go"
 	"golang.org/x/net/context"
 	"google.golang.org/appengine/datastore"
@@ -90,7 +91,7 @@ func (a *Auth) User(ctx context.Context, member *datastore.Key) (*User, error) {
 		return nil, errors.New("member key not of user")
 	}
 	var user = new(User)
-	err := datastore.Get(ctx, member, user)
+	err := storage.Get(ctx, member, user)
 	return user, err
 }
 
@@ -1,9 +1,9 @@
 package apis
 
 import (
-	"errors"
 	"github.com/ales6164/apis/collection"
 	"github.com/ales6164/apis/kind"
+	"github.com/ales6164/apis/storage"
 	"golang.org/x/crypto/bcrypt"
 	"golang.org/x/net/context"
 	"google.golang.org/appengine/datastore"
@@ -17,7 +17,7 @@ type Identity struct {
 	IdentityKey *datastore.Key `datastore:"-" json:"-"`
 	UserKey     *datastore.Key `json:"-"`
 	CreatedAt   time.Time      `json:"createdAt"`
-	UpdatedAt   time.Time      `json:"createdAt"`
+	UpdatedAt   time.Time      `json:"updatedAt"`
 	Provider    string         `json:"provider"`
 	Secret      []byte         `datastore:",noindex" json:"-"`
 	isOk        bool           `datastore:"-"` // this should always be true
@@ -43,14 +43,14 @@ func (a *Auth) CreateUser(ctx context.Context, provider Provider, userEmail stri
 	var user = new(User)
 	var identity = new(Identity)
 
-	err := datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+	err := storage.RunInTransaction(ctx, func(ctx context.Context) error {
 		var err error
 		userDocument, err = UserCollection.Doc(ctx, userKey, nil)
 		if err != nil {
 			return err
 		}
 
-		err = datastore.Get(ctx, identityKey, identity)
+		err = storage.Get(ctx, identityKey, identity)
 		if err != nil {
 			if err == datastore.ErrNoSuchEntity {
 				// ok
@@ -129,7 +129,7 @@ func (a *Auth) CreateUser(ctx context.Context, provider Provider, userEmail stri
 				}
 
 				// save identity
-				_, err = datastore.Put(ctx, identityKey, identity)
+				_, err = storage.Put(ctx, identityKey, identity)
 			}
 			return err
 		}
@@ -148,14 +148,14 @@ func (a *Auth) GetIdentity(ctx context.Context, provider Provider, userEmail str
 		return nil, err
 	}
 	if !userDocument.Exists() {
-		return nil, errors.New("user doesn't exist")
+		return nil, ErrUserNotFound
 	}
 
 	identityKey := datastore.NewKey(ctx, IdentityKind, provider.Name()+":"+userEmail, 0, userKey)
 	var identity = new(Identity)
 
-	err = datastore.RunInTransaction(ctx, func(ctx context.Context) error {
-		err := datastore.Get(ctx, identityKey, identity)
+	err = storage.RunInTransaction(ctx, func(ctx context.Context) error {
+		err := storage.Get(ctx, identityKey, identity)
 		if err != nil {
 			return err
 		}
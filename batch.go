@@ -0,0 +1,227 @@
+package apis
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/ales6164/apis/storage"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// MaxBatchOperations limits the number of operations in one batch request.
+const MaxBatchOperations = 100
+
+var (
+	errBatchFailed = errors.New("batch operation failed")
+	errAtomicQuery = errors.New("listings and collection actions can't run in an atomic batch; send them in a batch without atomic")
+)
+
+type batchOperation struct {
+	Method  string            `json:"method"`
+	Path    string            `json:"path"`
+	Body    json.RawMessage   `json:"body,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+}
+
+type batchResult struct {
+	Status  int               `json:"status"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Body    json.RawMessage   `json:"body,omitempty"`
+}
+
+/*
+POST /_batch runs an array of operations like {"method":"PUT","path":"/objects/{id}","body":{...}}
+and responds with their results in the same order. Every operation is served like a separate
+request of the same member, so it goes through the same rules and group checks.
+
+With ?atomic=true operations run in one cross-group transaction and stop at the first failing
+one. Nothing is saved then, the failing operation keeps its result and others get 424.
+Reads in an atomic batch don't see its writes and datastore limits the number of entity
+groups used by a transaction; every written document uses a few of them. Listings and
+collection actions like _export query across entity groups, so they fail with 400 there.
+*/
+func (a *Apis) serveBatch(w http.ResponseWriter, r *http.Request) {
+	ctx := a.NewContext(w, r)
+
+	var ops []batchOperation
+	body, err := ctx.ReadBody()
+	if err == nil {
+		err = json.Unmarshal(body, &ops)
+	}
+	if err != nil {
+		ctx.PrintProblem(err, http.StatusBadRequest)
+		return
+	}
+	if len(ops) == 0 || len(ops) > MaxBatchOperations {
+		ctx.PrintError(fmt.Sprintf("batch needs 1 to %d operations", MaxBatchOperations), http.StatusBadRequest)
+		return
+	}
+	for i, op := range ops {
+		if !strings.HasPrefix(op.Path, "/") {
+			ctx.PrintError(fmt.Sprintf("operation %d: path must start with /", i), http.StatusBadRequest)
+			return
+		}
+	}
+
+	var atomic bool
+	if v := r.URL.Query().Get("atomic"); len(v) > 0 {
+		var err error
+		if atomic, err = strconv.ParseBool(v); err != nil {
+			ctx.PrintError("invalid atomic param", http.StatusBadRequest)
+			return
+		}
+	}
+
+	if !atomic {
+		ctx.PrintJSON(a.runBatch(ctx, ctx, ops, false), http.StatusOK)
+		return
+	}
+
+	var results []batchResult
+	err = storage.RunInBatch(ctx, func(tc context.Context) error {
+		results = a.runBatch(ctx, tc, ops, true)
+		if results[len(results)-1].Status >= http.StatusBadRequest {
+			return errBatchFailed
+		}
+		return nil
+	}, &datastore.TransactionOptions{XG: true})
+	switch err {
+	case nil:
+		ctx.PrintJSON(results, http.StatusOK)
+	case errBatchFailed:
+		failed := results[len(results)-1]
+		dependency := batchResult{Status: http.StatusFailedDependency}
+		dependency.Body, _ = json.Marshal(http.StatusText(http.StatusFailedDependency))
+		for i := range results[:len(results)-1] {
+			results[i] = dependency
+		}
+		for len(results) < len(ops) {
+			results = append(results, dependency)
+		}
+		// audit entries of rolled back operations aren't stored
+		ctx.auditRequest(failed.Status, nil, "_batch")
+		ctx.PrintJSON(results, failed.Status)
+	case datastore.ErrConcurrentTransaction:
+		ctx.PrintProblem(err, http.StatusConflict)
+	default:
+		ctx.PrintProblem(err, http.StatusInternalServerError)
+	}
+}
+
+// Serves operations with storage context tc. Stops after the first failing operation if stopOnError.
+// Headers of the batch request that operations don't get. Results are embedded in the JSON
+// response, preconditions are given per operation and operations share the request ID.
+var batchOnlyHeaders = map[string]bool{
+	"Content-Type":        true,
+	"Content-Length":      true,
+	"Accept":              true,
+	"If-Match":            true,
+	"If-None-Match":       true,
+	"If-Modified-Since":   true,
+	"If-Unmodified-Since": true,
+	"If-Range":            true,
+	RequestIDHeader:       true,
+}
+
+func (a *Apis) runBatch(ctx Context, tc context.Context, ops []batchOperation, stopOnError bool) []batchResult {
+	var results []batchResult
+	for _, op := range ops {
+		req, err := http.NewRequest(strings.ToUpper(op.Method), op.Path, bytes.NewReader(op.Body))
+		if err != nil {
+			res := batchResult{Status: http.StatusBadRequest}
+			res.Body, _ = json.Marshal(err.Error())
+			results = append(results, res)
+			if stopOnError {
+				break
+			}
+			continue
+		}
+		req.Host = ctx.r.Host
+		req.RemoteAddr = ctx.r.RemoteAddr
+		req.TLS = ctx.r.TLS
+		for name, values := range ctx.r.Header {
+			if !batchOnlyHeaders[name] {
+				req.Header[name] = values
+			}
+		}
+		req.Header.Set("Content-Type", "application/json")
+		for name, value := range op.Headers {
+			req.Header.Set(name, value)
+		}
+
+		rw := &batchResponse{header: http.Header{}}
+		opCtx := ctx
+		opCtx.Context = tc
+		opCtx.w = rw
+		opCtx.r = req
+		opCtx.body = new(requestBody)
+		opCtx.hasIncludeMetaHeader = len(req.Header.Get("X-Include-Meta")) > 0
+		opCtx.mediaType, _ = negotiate(req.Header.Get("Accept"))
+		opCtx.kind = nil
+		opCtx.atomic = stopOnError
+		a.serve(opCtx)
+
+		res := rw.result()
+		results = append(results, res)
+		if stopOnError && res.Status >= http.StatusBadRequest {
+			break
+		}
+	}
+	return results
+}
+
+// Records response of a batch operation.
+type batchResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (w *batchResponse) Header() http.Header {
+	return w.header
+}
+
+func (w *batchResponse) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *batchResponse) Write(b []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	return w.body.Write(b)
+}
+
+// JSON bodies, like problems, are included as they are, other bodies as strings.
+func (w *batchResponse) result() batchResult {
+	res := batchResult{Status: w.status}
+	if res.Status == 0 {
+		res.Status = http.StatusOK
+	}
+	for name, values := range w.header {
+		if name == "Content-Type" || name == "X-Content-Type-Options" {
+			continue
+		}
+		if res.Headers == nil {
+			res.Headers = map[string]string{}
+		}
+		res.Headers[name] = strings.Join(values, ", ")
+	}
+	body := bytes.TrimSpace(w.body.Bytes())
+	if len(body) == 0 {
+		return res
+	}
+	mediaType, _, _ := mime.ParseMediaType(w.header.Get("Content-Type"))
+	if (mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")) && json.Valid(body) {
+		res.Body = body
+	} else {
+		res.Body, _ = json.Marshal(string(body))
+	}
+	return res
+}
@@ -0,0 +1,72 @@
+package apis_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+type batchResult struct {
+	Status int             `json:"status"`
+	Body   json.RawMessage `json:"body"`
+}
+
+func TestAtomicBatchListing(t *testing.T) {
+	_, c := newServer(t, nil)
+	ops := []map[string]interface{}{
+		{"method": "POST", "path": "/objects", "body": Object{Name: "a"}},
+		{"method": "GET", "path": "/objects"},
+	}
+
+	var results []batchResult
+	if err := c.Post("/_batch?atomic=true", ops).Expect(t, http.StatusBadRequest).JSON(&results); err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 || results[0].Status != http.StatusFailedDependency || results[1].Status != http.StatusBadRequest {
+		t.Fatalf("got %+v", results)
+	}
+	if !strings.Contains(string(results[1].Body), "atomic") {
+		t.Errorf("listing failed with %s", results[1].Body)
+	}
+
+	ops[1]["path"] = "/objects/_export"
+	c.Post("/_batch?atomic=true", ops).Expect(t, http.StatusBadRequest)
+
+	// nothing was created; without atomic the listing runs
+	ops[1]["path"] = "/objects"
+	if err := c.Post("/_batch", ops).Expect(t, http.StatusOK).JSON(&results); err != nil {
+		t.Fatal(err)
+	}
+	var items []Object
+	if err := json.Unmarshal(results[1].Body, &items); err != nil || len(items) != 1 {
+		t.Fatalf("listing after batch returned %s", results[1].Body)
+	}
+}
+
+func TestBatchHeaders(t *testing.T) {
+	_, c := newServer(t, nil)
+	o := create(t, c, "/objects", Object{Name: "a"})
+	etag := c.Get("/objects/"+o.Id).Expect(t, http.StatusOK).Header.Get("ETag")
+
+	// preconditions of the batch request don't reach its operations
+	ops := []map[string]interface{}{
+		{"method": "PUT", "path": "/objects/" + o.Id, "body": Object{Name: "b"}},
+		{"method": "GET", "path": "/objects/" + o.Id},
+	}
+	var results []batchResult
+	c.Post("/_batch", ops, "If-Match", `"stale"`, "If-None-Match", "*", "X-Request-Id", "batch-1").
+		Expect(t, http.StatusOK).JSON(&results)
+	if len(results) != 2 || results[0].Status != http.StatusOK || results[1].Status != http.StatusOK {
+		t.Fatalf("operations got %+v", results)
+	}
+
+	// preconditions of operations apply
+	ops = []map[string]interface{}{
+		{"method": "PUT", "path": "/objects/" + o.Id, "body": Object{Name: "c"}, "headers": map[string]string{"If-Match": etag}},
+	}
+	c.Post("/_batch", ops).Expect(t, http.StatusOK).JSON(&results)
+	if len(results) != 1 || results[0].Status != http.StatusPreconditionFailed {
+		t.Fatalf("operation with stale If-Match got %+v", results)
+	}
+}
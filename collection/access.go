@@ -1,8 +1,13 @@
 package collection
 
+import (
+	"google.golang.org/appengine/datastore"
+)
+
 // parent is entry key, id is user key
 type GroupRelationship struct {
-	Roles []string // fullControl, ...
+	Roles    []string       // fullControl, ...
+	Document *datastore.Key // entry key; used to remove relationships of deleted entries
 }
 
 type Role string
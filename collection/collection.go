@@ -2,6 +2,7 @@ package collection
 
 import (
 	"errors"
+	"fmt"
 	"github.com/ales6164/apis/kind"
 	"github.com/asaskevich/govalidator"
 	"golang.org/x/net/context"
@@ -9,6 +10,7 @@ import (
 	"reflect"
 	"strconv"
 	"strings"
+	"time"
 )
 
 type Collection struct {
@@ -19,6 +21,27 @@ type Collection struct {
 	member  *datastore.Key
 	KeyGen  func(ctx context.Context, str string, member *datastore.Key) *datastore.Key
 
+	// RequireIfMatch rejects PUT, PATCH and DELETE requests without If-Match header.
+	RequireIfMatch bool
+
+	// SoftDelete moves deleted documents to trash, from where they can be restored until
+	// they are purged TrashRetention after deletion. Defaults to DefaultTrashRetention.
+	SoftDelete     bool
+	TrashRetention time.Duration
+
+	// KeepRevisions stores the previous version of a document on every change.
+	KeepRevisions bool
+
+	// ProjectFields lets listings with fields param use datastore projection queries when
+	// they can. Projection skips documents that don't have every projected property, so
+	// it's only right when all documents have the fields.
+	ProjectFields bool
+
+	hooks        map[string][]Hook             // added with On()
+	validators   map[string]Validator          // added with RegisterValidator()
+	rules        map[reflect.Type][]fieldRules // parsed valid tags
+	unknownRules map[string]bool               // rules of valid tags that aren't registered yet
+
 	hasIdFieldName        bool
 	hasCreatedAtFieldName bool
 	hasUpdatedAtFieldName bool
@@ -68,6 +91,8 @@ func New(name string, i interface{}) *Collection {
 	}
 
 	c.fields = lookup(c, c.t, map[string]*Field{})
+	c.rules, c.unknownRules = map[reflect.Type][]fieldRules{}, map[string]bool{}
+	c.parseRules(c.t)
 
 	return c
 }
@@ -101,34 +126,106 @@ func (c *Collection) Scopes(scopes ...string) []string {
 	return r
 }
 
-// Gets value at path
+// Gets value at path of JSON names and slice indexes. Returns kind.ErrPathNotFound if
+// the path doesn't exist and an invalid value if it passes a nil pointer.
 func (c *Collection) ValueAt(value reflect.Value, path []string) (reflect.Value, error) {
 	var valueHolder = value
 	for _, pathPart := range path {
-		var f *Field
-		// get real field name (in case json field has different name)
-		var ok bool
-		if f, ok = c.fields[pathPart]; ok {
-			pathPart = f.Name
+		for valueHolder.Kind() == reflect.Ptr || valueHolder.Kind() == reflect.Interface {
+			if valueHolder.IsNil() {
+				return reflect.Value{}, nil
+			}
+			valueHolder = valueHolder.Elem()
 		}
 		switch valueHolder.Kind() {
 		case reflect.Slice, reflect.Array:
-			if index, err := strconv.Atoi(pathPart); err == nil {
-				valueHolder = valueHolder.Index(index)
-			} else {
-				return valueHolder, errors.New("error converting string to slice index")
+			index, err := strconv.Atoi(pathPart)
+			if err != nil || index < 0 || index >= valueHolder.Len() {
+				return reflect.Value{}, kind.ErrPathNotFound
 			}
-		default:
-			if valueHolder.Kind() == reflect.Ptr {
-				valueHolder = valueHolder.Elem().FieldByName(pathPart)
-			} else {
-				valueHolder = valueHolder.FieldByName(pathPart)
+			valueHolder = valueHolder.Index(index)
+		case reflect.Map:
+			if valueHolder.Type().Key().Kind() != reflect.String {
+				return reflect.Value{}, kind.ErrPathNotFound
+			}
+			valueHolder = valueHolder.MapIndex(reflect.ValueOf(pathPart).Convert(valueHolder.Type().Key()))
+			if !valueHolder.IsValid() {
+				return reflect.Value{}, kind.ErrPathNotFound
+			}
+		case reflect.Struct:
+			// get real field name (in case json field has different name)
+			f, ok := fieldByJSONName(valueHolder.Type(), pathPart)
+			if !ok {
+				return reflect.Value{}, kind.ErrPathNotFound
 			}
+			valueHolder = valueHolder.FieldByIndex(f.Index)
+		default:
+			return reflect.Value{}, kind.ErrPathNotFound
 		}
 	}
 	return valueHolder, nil
 }
 
+// Finds exported struct field encoded under name in JSON.
+func fieldByJSONName(t reflect.Type, name string) (reflect.StructField, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if len(f.PkgPath) > 0 {
+			continue
+		}
+		jsonName := f.Name
+		if tag := strings.Split(f.Tag.Get("json"), ",")[0]; tag == "-" {
+			continue
+		} else if len(tag) > 0 {
+			jsonName = tag
+		}
+		if jsonName == name {
+			return f, true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+// Select returns only fields at dot separated JSON paths as nested map. Missing values are nil.
+func (c *Collection) Select(value reflect.Value, paths []string) (map[string]interface{}, error) {
+	var out = map[string]interface{}{}
+	for _, p := range paths {
+		path := strings.Split(p, ".")
+		fields := c.fields
+		for i, part := range path {
+			f, ok := fields[part]
+			if !ok || (i < len(path)-1 && f.Fields == nil) {
+				return nil, fmt.Errorf("unknown field %q", p)
+			}
+			fields = f.Fields
+		}
+
+		v, err := c.ValueAt(value, path)
+		if err != nil {
+			return nil, err
+		}
+		var x interface{}
+		if v.IsValid() {
+			if !v.CanInterface() {
+				return nil, fmt.Errorf("unknown field %q", p)
+			}
+			x = v.Interface()
+		}
+
+		m := out
+		for _, part := range path[:len(path)-1] {
+			child, ok := m[part].(map[string]interface{})
+			if !ok {
+				child = map[string]interface{}{}
+				m[part] = child
+			}
+			m = child
+		}
+		m[path[len(path)-1]] = x
+	}
+	return out, nil
+}
+
 func lookup(kind *Collection, typ reflect.Type, fields map[string]*Field) map[string]*Field {
 loop:
 	for i := 0; i < typ.NumField(); i++ {
@@ -255,6 +352,21 @@ func (c *Collection) Data(doc kind.Doc, includeMeta bool) interface{} {
 		}
 	}
 
+	// timestamps that aren't stored with the entity are taken from meta
+	if (c.hasCreatedAtFieldName && !c.isStored(c.createdAtFieldName)) || (c.hasUpdatedAtFieldName && !c.isStored(c.updatedAtFieldName)) {
+		if m, err := doc.Meta(); err == nil {
+			if m, ok := m.(*meta); ok {
+				v := reflectValue.Elem()
+				if c.hasCreatedAtFieldName && !c.isStored(c.createdAtFieldName) {
+					setField(v.FieldByName(c.createdAtFieldName), m.value.CreatedAt)
+				}
+				if c.hasUpdatedAtFieldName && !c.isStored(c.updatedAtFieldName) {
+					setField(v.FieldByName(c.updatedAtFieldName), m.value.UpdatedAt)
+				}
+			}
+		}
+	}
+
 	if includeMeta {
 		meta, _ := doc.Meta()
 		return meta.Print(doc, reflectValue.Interface())
@@ -263,6 +375,64 @@ func (c *Collection) Data(doc kind.Doc, includeMeta bool) interface{} {
 	return reflectValue.Interface()
 }
 
+func (c *Collection) RequiresIfMatch() bool {
+	return c.RequireIfMatch
+}
+
+func (c *Collection) SoftDeletes() bool {
+	return c.SoftDelete
+}
+
+func (c *Collection) KeepsRevisions() bool {
+	return c.KeepRevisions
+}
+
+func (c *Collection) ProjectsFields() bool {
+	return c.ProjectFields
+}
+
+// Property resolves dot separated JSON path to datastore property name and Go type of
+// the field. Auto id field resolves to "__key__". Fields that aren't stored or indexed
+// can't be queried and return an error.
+func (c *Collection) Property(path string) (string, reflect.Type, error) {
+	var names []string
+	var fields = c.fields
+	var t = c.t
+	for _, part := range strings.Split(path, ".") {
+		f, ok := fields[part]
+		if !ok || t.Kind() != reflect.Struct {
+			return "", nil, fmt.Errorf("unknown field %q", path)
+		}
+		if f.IsAutoId && len(names) == 0 {
+			return "__key__", keyType, nil
+		}
+		structField, _ := t.FieldByName(f.Name)
+		name := structField.Name
+		for n, v := range strings.Split(structField.Tag.Get("datastore"), ",") {
+			switch {
+			case n == 0 && v == "-":
+				return "", nil, fmt.Errorf("field %q is not stored", path)
+			case n == 0 && len(v) > 0:
+				name = v
+			case n > 0 && v == "noindex":
+				return "", nil, fmt.Errorf("field %q is not indexed", path)
+			}
+		}
+		names = append(names, name)
+		fields = f.Fields
+		t = structField.Type
+	}
+	return strings.Join(names, "."), t, nil
+}
+
+// Reports if field is saved to datastore.
+func (c *Collection) isStored(fieldName string) bool {
+	if f, ok := c.t.FieldByName(fieldName); ok {
+		return strings.Split(f.Tag.Get("datastore"), ",")[0] != "-"
+	}
+	return false
+}
+
 func (c *Collection) Doc(ctx context.Context, key *datastore.Key, ancestor kind.Doc) (kind.Doc, error) {
 	return NewDoc(ctx, c, key, ancestor)
 }
@@ -3,40 +3,101 @@ package collection
 import (
 	"fmt"
 	"math/rand"
+	"time"
 
+	"github.com/ales6164/apis/kind"
+	"github.com/ales6164/apis/storage"
 	"golang.org/x/net/context"
 
 	"google.golang.org/appengine/datastore"
-	"google.golang.org/appengine/memcache"
 )
 
 type counterConfig struct {
-	Shards int
+	Shards  int
+	GrownAt time.Time `datastore:",noindex"`
 }
 
 type shard struct {
-	Name  string
-	Count int
+	Name      string
+	Count     int
+	UpdatedAt time.Time `datastore:",noindex"`
 }
 
 const (
 	defaultShards = 20
+	maxShards     = 320
 	configKind    = "_counterShardConfig"
 	shardKind     = "_counterShard"
+
+	// writes to one shard closer than this are contention; an entity group takes about one
+	// write per second
+	shardContention = time.Second
+	// shards double at most once in this time
+	shardGrowth = time.Minute
+	// config is cached, so increments don't read it in their transaction
+	configExpiration = 10 * time.Minute
 )
 
 func memcacheKey(name string) string {
 	return shardKind + ":" + name
 }
 
-// Count retrieves the value of the named counter.
+func configMemcacheKey(name string) string {
+	return configKind + ":" + name
+}
+
+func (c *Collection) shardKey(ctx context.Context, i int) *datastore.Key {
+	return datastore.NewKey(ctx, shardKind, fmt.Sprintf("%s-shard%d", c.name, i), 0, nil)
+}
+
+// Gets counter config; default one if it isn't stored yet.
+func (c *Collection) counterConfig(ctx context.Context) (counterConfig, *datastore.Key, bool, error) {
+	var cfg counterConfig
+	ckey := datastore.NewKey(ctx, configKind, c.name, 0, nil)
+	err := storage.Get(ctx, ckey, &cfg)
+	if err == datastore.ErrNoSuchEntity {
+		cfg.Shards = defaultShards
+		return cfg, ckey, false, nil
+	}
+	return cfg, ckey, true, err
+}
+
+// Gets counter config from cache; from datastore and caches it on a miss. Caches of other
+// instances can have fewer shards for a while after growth, which only spreads writes less.
+func (c *Collection) cachedCounterConfig(ctx context.Context) (counterConfig, error) {
+	var cfg counterConfig
+	cache := storage.CacheFromContext(ctx)
+	if err := cache.Get(ctx, configMemcacheKey(c.name), &cfg); err == nil && cfg.Shards > 0 {
+		return cfg, nil
+	}
+	cfg, _, _, err := c.counterConfig(ctx)
+	if err != nil {
+		return cfg, err
+	}
+	_ = cache.Set(ctx, configMemcacheKey(c.name), &cfg, configExpiration)
+	return cfg, nil
+}
+
+// Count retrieves the value of the named counter. Counters are kept per namespace of ctx, that
+// is per parent document of nested collections.
 func (c *Collection) Count(ctx context.Context) (int, error) {
 	total := 0
 	mkey := memcacheKey(c.name)
-	if _, err := memcache.JSON.Get(ctx, mkey, &total); err == nil {
+	cache := storage.CacheFromContext(ctx)
+	if err := cache.Get(ctx, mkey, &total); err == nil {
 		return total, nil
 	}
-	q := datastore.NewQuery(shardKind).Filter("Name =", c.name)
+	total, err := c.sumShards(ctx)
+	if err != nil {
+		return total, err
+	}
+	_ = cache.Set(ctx, mkey, &total, 60*time.Second)
+	return total, nil
+}
+
+func (c *Collection) sumShards(ctx context.Context) (int, error) {
+	total := 0
+	q := storage.NewQuery(shardKind).Filter("Name =", c.name)
 	for t := q.Run(ctx); ; {
 		var s shard
 		_, err := t.Next(&s)
@@ -48,74 +109,178 @@ func (c *Collection) Count(ctx context.Context) (int, error) {
 		}
 		total += s.Count
 	}
-	_ = memcache.JSON.Set(ctx, &memcache.Item{
-		Key:        mkey,
-		Object:     &total,
-		Expiration: 60,
-	})
 	return total, nil
 }
 
 // Increment increments the named counter.
 func (c *Collection) Increment(ctx context.Context) error {
-	// Get counter config.
-	var cfg counterConfig
-	ckey := datastore.NewKey(ctx, configKind, c.name, 0, nil)
-	err := datastore.Get(ctx, ckey, &cfg)
-	if err == datastore.ErrNoSuchEntity {
-		cfg.Shards = defaultShards
-		_, err = datastore.Put(ctx, ckey, &cfg)
-	}
+	return c.incrementBy(ctx, 1)
+}
+
+// Decrement decrements the named counter.
+func (c *Collection) Decrement(ctx context.Context) error {
+	return c.incrementBy(ctx, -1)
+}
 
+/*
+Adds delta to one shard of the named counter. A shard written just before is contended, so
+the counter doubles its shards, up to maxShards, after the commit. The cached total changes
+after the commit too, so retried transactions don't add delta twice.
+*/
+func (c *Collection) incrementBy(ctx context.Context, delta int) error {
+	cfg, err := c.cachedCounterConfig(ctx)
 	if err != nil {
 		return err
 	}
+
 	var s shard
-	shardName := fmt.Sprintf("%s-shard%d", c.name, rand.Intn(cfg.Shards))
-	key := datastore.NewKey(ctx, shardKind, shardName, 0, nil)
-	err = datastore.Get(ctx, key, &s)
+	key := c.shardKey(ctx, rand.Intn(cfg.Shards))
+	err = storage.Get(ctx, key, &s)
 	// A missing entity and a present entity will both work.
 	if err != nil && err != datastore.ErrNoSuchEntity {
 		return err
 	}
+	now := time.Now()
+	contended := now.Sub(s.UpdatedAt) < shardContention
 	s.Name = c.name
-	s.Count++
-	_, err = datastore.Put(ctx, key, &s)
+	s.Count += delta
+	s.UpdatedAt = now
+	_, err = storage.Put(ctx, key, &s)
 	if err != nil {
 		return err
 	}
-	_, _ = memcache.IncrementExisting(ctx, memcacheKey(c.name), 1)
+
+	if contended && cfg.Shards < maxShards && now.Sub(cfg.GrownAt) > shardGrowth {
+		err = storage.AfterCommit(ctx, func(ctx context.Context) error {
+			// the counter works with fewer shards, so failed growth is tried on the next contention
+			_ = c.growShards(ctx)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	_, _ = storage.CacheFromContext(ctx).IncrementExisting(ctx, memcacheKey(c.name), int64(delta))
 	return nil
 }
 
-// Decrement decrements the named counter.
-func (c *Collection) Decrement(ctx context.Context) error {
-	// Get counter config.
-	var cfg counterConfig
-	ckey := datastore.NewKey(ctx, configKind, c.name, 0, nil)
-	err := datastore.Get(ctx, ckey, &cfg)
-	if err == datastore.ErrNoSuchEntity {
-		cfg.Shards = defaultShards
-		_, err = datastore.Put(ctx, ckey, &cfg)
-	}
+// Doubles shards of the counter, up to maxShards, unless they grew in the last shardGrowth.
+// It has its own transaction, so writes of documents don't conflict on the config.
+func (c *Collection) growShards(ctx context.Context) error {
+	return storage.RunInTransaction(ctx, func(tc context.Context) error {
+		cfg, ckey, _, err := c.counterConfig(tc)
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+		if cfg.Shards >= maxShards || now.Sub(cfg.GrownAt) <= shardGrowth {
+			return nil
+		}
+		cfg.Shards *= 2
+		if cfg.Shards > maxShards {
+			cfg.Shards = maxShards
+		}
+		cfg.GrownAt = now
+		if _, err = storage.Put(tc, ckey, &cfg); err != nil {
+			return err
+		}
+		return storage.CacheFromContext(tc).Set(tc, configMemcacheKey(c.name), &cfg, configExpiration)
+	}, nil)
+}
+
+// Counter returns the counter in the namespace of ctx and the number of documents it should
+// have, counted with a keys-only query.
+func (c *Collection) Counter(ctx context.Context) (kind.CounterStatus, error) {
+	cfg, ckey, _, err := c.counterConfig(ctx)
 	if err != nil {
-		return err
+		return kind.CounterStatus{}, err
 	}
-	var s shard
+	status := kind.CounterStatus{Kind: c.name, Namespace: ckey.Namespace(), Shards: cfg.Shards}
+	if !cfg.GrownAt.IsZero() {
+		status.GrownAt = &cfg.GrownAt
+	}
+	if status.Count, err = c.sumShards(ctx); err != nil {
+		return status, err
+	}
+	if status.Documents, err = storage.NewQuery(c.name).KeysOnly().Count(ctx); err != nil {
+		return status, err
+	}
+	status.Drift = status.Count - status.Documents
+	return status, nil
+}
 
-	shardName := fmt.Sprintf("%s-shard%d", c.name, rand.Intn(cfg.Shards))
-	key := datastore.NewKey(ctx, shardKind, shardName, 0, nil)
-	err = datastore.Get(ctx, key, &s)
-	// A missing entity and a present entity will both work.
-	if err != nil && err != datastore.ErrNoSuchEntity {
-		return err
+/*
+Reconcile recounts documents in the namespace of ctx with a keys-only query and rewrites the
+shards with the result. Shards above zero also set the number of shards. Documents written
+while it runs can be missed, so run it when the collection is quiet.
+*/
+func (c *Collection) Reconcile(ctx context.Context, shards int) (kind.CounterStatus, error) {
+	if shards < 0 || shards > maxShards {
+		return kind.CounterStatus{}, kind.ErrInvalidShards
 	}
-	s.Name = c.name
-	s.Count--
-	_, err = datastore.Put(ctx, key, &s)
+	cfg, ckey, _, err := c.counterConfig(ctx)
 	if err != nil {
-		return err
+		return kind.CounterStatus{}, err
 	}
-	_, _ = memcache.IncrementExisting(ctx, memcacheKey(c.name), 1)
-	return nil
+	if shards > 0 {
+		cfg.Shards = shards
+	}
+	documents, err := storage.NewQuery(c.name).KeysOnly().Count(ctx)
+	if err != nil {
+		return kind.CounterStatus{}, err
+	}
+
+	var keys = make([]*datastore.Key, cfg.Shards)
+	var values = make([]interface{}, cfg.Shards)
+	var kept = map[string]bool{}
+	for i := range keys {
+		s := &shard{Name: c.name}
+		if i == 0 {
+			s.Count = documents
+		}
+		keys[i], values[i] = c.shardKey(ctx, i), s
+		kept[keys[i].StringID()] = true
+	}
+	// shards above the new number would still be summed
+	var stale []*datastore.Key
+	t := storage.NewQuery(shardKind).Filter("Name =", c.name).KeysOnly().Run(ctx)
+	for {
+		key, err := t.Next(nil)
+		if err == datastore.Done {
+			break
+		}
+		if err != nil {
+			return kind.CounterStatus{}, err
+		}
+		if !kept[key.StringID()] {
+			stale = append(stale, key)
+		}
+	}
+
+	if _, err = storage.Put(ctx, ckey, &cfg); err != nil {
+		return kind.CounterStatus{}, err
+	}
+	if _, err = storage.PutMulti(ctx, keys, values); err != nil {
+		return kind.CounterStatus{}, err
+	}
+	if len(stale) > 0 {
+		if err = storage.DeleteMulti(ctx, stale); err != nil {
+			return kind.CounterStatus{}, err
+		}
+	}
+	_ = storage.CacheFromContext(ctx).Set(ctx, memcacheKey(c.name), &documents, 60*time.Second)
+	_ = storage.CacheFromContext(ctx).Set(ctx, configMemcacheKey(c.name), &cfg, configExpiration)
+
+	status := kind.CounterStatus{
+		Kind:      c.name,
+		Namespace: ckey.Namespace(),
+		Shards:    cfg.Shards,
+		Count:     documents,
+		Documents: documents,
+	}
+	if !cfg.GrownAt.IsZero() {
+		status.GrownAt = &cfg.GrownAt
+	}
+	return status, nil
 }
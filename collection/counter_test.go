@@ -0,0 +1,149 @@
+package collection
+
+import (
+	"github.com/ales6164/apis/storage"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+type counted struct {
+	Name string
+}
+
+func newContext() context.Context {
+	ctx := appengine.NewContext(httptest.NewRequest("GET", "/", nil))
+	return storage.WithCache(storage.NewContext(ctx, storage.NewMemory()), storage.NewMemoryCache())
+}
+
+func storedConfig(t *testing.T, ctx context.Context, c *Collection) counterConfig {
+	t.Helper()
+	cfg, _, _, err := c.counterConfig(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+func TestCounter(t *testing.T) {
+	ctx := newContext()
+	c := New("counted", counted{})
+	tests := []struct {
+		name  string
+		delta int
+		want  int
+	}{
+		{"increment", 1, 1},
+		{"increment again", 1, 2},
+		{"decrement", -1, 1},
+		{"add more", 3, 4},
+	}
+	for _, tt := range tests {
+		err := storage.RunInTransaction(ctx, func(tc context.Context) error {
+			return c.incrementBy(tc, tt.delta)
+		}, &datastore.TransactionOptions{XG: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the first Count caches the total, which later increments change
+		if n, err := c.Count(ctx); err != nil || n != tt.want {
+			t.Fatalf("%s: count is %d, %v; want %d", tt.name, n, err, tt.want)
+		}
+		if n, err := c.sumShards(ctx); err != nil || n != tt.want {
+			t.Fatalf("%s: shards sum to %d, %v; want %d", tt.name, n, err, tt.want)
+		}
+	}
+}
+
+func TestCounterGrowth(t *testing.T) {
+	ctx := newContext()
+	c := New("counted", counted{})
+	ckey := datastore.NewKey(ctx, configKind, c.name, 0, nil)
+	if _, err := storage.Put(ctx, ckey, &counterConfig{Shards: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	// second write to the only shard is contended
+	for i := 0; i < 2; i++ {
+		if err := c.Increment(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cfg := storedConfig(t, ctx, c)
+	if cfg.Shards != 2 || cfg.GrownAt.IsZero() {
+		t.Fatalf("config is %+v after contention", cfg)
+	}
+	// cached config follows growth, and shards grow once per shardGrowth
+	cached, err := c.cachedCounterConfig(ctx)
+	if err != nil || cached.Shards != 2 {
+		t.Fatalf("cached config is %+v, %v", cached, err)
+	}
+	for i := 0; i < 4; i++ {
+		if err := c.Increment(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if cfg := storedConfig(t, ctx, c); cfg.Shards != 2 {
+		t.Fatalf("shards grew to %d within %s", cfg.Shards, shardGrowth)
+	}
+
+	cfg.GrownAt = time.Now().Add(-2 * shardGrowth)
+	if _, err := storage.Put(ctx, ckey, &cfg); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.growShards(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if cfg := storedConfig(t, ctx, c); cfg.Shards != 4 {
+		t.Fatalf("shards are %d after growth", cfg.Shards)
+	}
+	if n, err := c.Count(ctx); err != nil || n != 6 {
+		t.Fatalf("count is %d, %v", n, err)
+	}
+}
+
+func TestReconcile(t *testing.T) {
+	ctx := newContext()
+	c := New("counted", counted{})
+	for i := 0; i < 5; i++ {
+		if err := c.Increment(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range []string{"a", "b", "c"} {
+		if _, err := storage.Put(ctx, datastore.NewKey(ctx, c.name, name, 0, nil), &counted{Name: name}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	status, err := c.Counter(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Count != 5 || status.Documents != 3 || status.Drift != 2 {
+		t.Fatalf("status is %+v", status)
+	}
+
+	if _, err := c.Reconcile(ctx, maxShards+1); err == nil {
+		t.Fatal("too many shards were accepted")
+	}
+	status, err = c.Reconcile(ctx, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Count != 3 || status.Shards != 4 {
+		t.Fatalf("reconciled to %+v", status)
+	}
+	if n, err := c.Count(ctx); err != nil || n != 3 {
+		t.Fatalf("count is %d, %v", n, err)
+	}
+	if n, err := storage.NewQuery(shardKind).Filter("Name =", c.name).KeysOnly().Count(ctx); err != nil || n > 4 {
+		t.Fatalf("%d shards are left, %v", n, err)
+	}
+	if cached, err := c.cachedCounterConfig(ctx); err != nil || cached.Shards != 4 {
+		t.Fatalf("cached config is %+v, %v", cached, err)
+	}
+}
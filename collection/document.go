@@ -4,11 +4,13 @@ import (
 	"encoding/json"
 	"errors"
 	"github.com/ales6164/apis/kind"
-	"github.com/buger/jsonparser"
+	"github.com/ales6164/apis/storage"
 	"golang.org/x/net/context"
 	"google.golang.org/appengine/datastore"
 	"reflect"
+	"strconv"
 	"strings"
+	"time"
 )
 
 type document struct {
@@ -23,6 +25,8 @@ type document struct {
 	rollbackProperties []datastore.Property
 	ancestor           kind.Doc
 	hasAncestor        bool
+	ifMatch            []string
+	created            bool // by the last write
 	meta               *meta
 	kind.Doc
 }
@@ -45,6 +49,11 @@ func NewDoc(ctx context.Context, kind kind.Kind, key *datastore.Key, ancestor ki
 		hasAncestor: ancestor != nil,
 	}
 
+	// acting member is written to createdBy and updatedBy fields
+	if m, ok := ctx.(interface{ Member() *datastore.Key }); ok {
+		doc.member = m.Member()
+	}
+
 	_, err := doc.Meta()
 
 	return doc, err
@@ -54,6 +63,11 @@ func (d *document) Exists() bool {
 	return d.meta.exists
 }
 
+// Created reports if the last write created the document.
+func (d *document) Created() bool {
+	return d.created
+}
+
 func (d *document) Meta() (kind.Meta, error) {
 	var err error
 	var ancestorMeta kind.Meta
@@ -190,152 +204,213 @@ const (
 )
 
 func (d *document) Get() (kind.Doc, error) {
-	return d, datastore.Get(d.ctx, d.key, d)
+	if err := d.trigger(d.ctx, BeforeRead); err != nil {
+		return d, err
+	}
+	if err := storage.Get(d.ctx, d.key, d); err != nil {
+		return d, err
+	}
+	return d, d.trigger(d.ctx, AfterRead)
 }
 
-func (d *document) Patch(data []byte) error {
-	var endErr error
-	var cb = func(err error) {
-		endErr = err
+// Applies JSON Patch (RFC 6902) to the stored entity. Operations are applied in order
+// inside a transaction and if any of them fails, nothing is saved.
+func (d *document) Patch(data []byte) (kind.Doc, error) {
+	ops, err := parsePatch(data)
+	if err != nil {
+		return d, err
 	}
-	_, err := jsonparser.ArrayEach(data, func(patch []byte, dataType jsonparser.ValueType, offset int, err error) {
-		operation, _ := jsonparser.GetString(patch, "op")
-		value, _, _, _ := jsonparser.Get(patch, "value")
-		path, err := jsonparser.GetString(patch, "path")
-		if err != nil {
-			cb(errors.New("invalid path"))
-			return
-		}
-		pathArray := strings.Split(path, "/")
-		if len(pathArray) > 0 && len(pathArray[0]) == 0 {
-			pathArray = pathArray[1:]
-		}
-		v, err := d.Kind().ValueAt(d.value, pathArray)
-		if err != nil {
-			cb(err)
-			return
-		}
-		switch operation {
-		/*case op_test:*/
-		case op_remove:
-			if v.CanSet() {
-				inputValue := reflect.New(v.Type()).Interface()
-				v.Set(reflect.ValueOf(inputValue).Elem())
-			} else {
-				cb(errors.New("field value can't be set"))
-				return
-			}
-		case op_add:
-			if v.CanSet() {
-				_, err := jsonparser.ArrayEach(value, func(valueItem []byte, dataType jsonparser.ValueType, offset int, err error) {
-					inputValue := reflect.New(v.Type().Elem()).Interface()
-					err = json.Unmarshal(valueItem, &inputValue)
-					if err != nil {
-						cb(err)
-						return
-					}
-					v.Set(reflect.Append(v, reflect.ValueOf(inputValue).Elem()))
-				})
-				if err != nil {
-					cb(err)
-					return
-				}
-			} else {
-				cb(errors.New("field value can't be set"))
-				return
-			}
-		case op_replace:
-			if v.CanSet() {
-				if v.Kind() == reflect.String {
-					v.SetString(string(value))
-				} else {
-					inputValue := reflect.New(v.Type()).Interface()
-					err = json.Unmarshal(value, &inputValue)
-					if err != nil {
-						cb(err)
-						return
-					}
-					v.Set(reflect.ValueOf(inputValue).Elem())
-				}
-			} else {
-				cb(errors.New("field value can't be set"))
-				return
-			}
-		case op_move:
-			from, err := jsonparser.GetString(patch, "from")
-			if err != nil {
-				cb(errors.New("invalid from"))
-				return
-			}
-
-			fromPath := strings.Split(from, "/")
-			if len(fromPath) > 0 && len(fromPath[0]) == 0 {
-				fromPath = fromPath[1:]
-			}
+	return d.update(func(value reflect.Value) (reflect.Value, error) {
+		return applyPatch(d.kind, value, ops)
+	})
+}
 
-			fromV, err := d.Kind().ValueAt(d.value, fromPath)
-			if err != nil {
-				cb(err)
-				return
-			}
+// Applies JSON Merge Patch (RFC 7396) to the stored entity. Only given fields change.
+func (d *document) MergePatch(data []byte) (kind.Doc, error) {
+	c, ok := d.kind.(*Collection)
+	if !ok {
+		return d, errors.New("merge patch not supported")
+	}
+	return d.update(func(value reflect.Value) (reflect.Value, error) {
+		return value, c.merge(value, nil, c.fields, data)
+	})
+}
 
-			if v.CanSet() {
-				v.Set(fromV)
-			} else {
-				cb(errors.New("field value can't be set"))
-				return
-			}
+// SetAt replaces value at path inside the stored entity. Path must exist.
+func (d *document) SetAt(path []string, data []byte) (kind.Doc, error) {
+	if err := json.Unmarshal(data, new(interface{})); err != nil {
+		return d, err
+	}
+	return d.updateAt(operation{Op: op_replace, Value: data}, path)
+}
 
-			if fromV.CanSet() {
-				fromValue := reflect.New(fromV.Type()).Interface()
-				fromV.Set(reflect.ValueOf(fromValue).Elem())
-			} else {
-				cb(errors.New("field value can't be set"))
-				return
-			}
-		case op_copy:
-			from, err := jsonparser.GetString(patch, "from")
-			if err != nil {
-				cb(errors.New("invalid from"))
-				return
-			}
+// DeleteAt removes value at path inside the stored entity. Slice items are removed,
+// fields are set to their zero value.
+func (d *document) DeleteAt(path []string) (kind.Doc, error) {
+	return d.updateAt(operation{Op: op_remove}, path)
+}
 
-			fromPath := strings.Split(from, "/")
-			if len(fromPath) > 0 && len(fromPath[0]) == 0 {
-				fromPath = fromPath[1:]
-			}
+func (d *document) updateAt(o operation, path []string) (kind.Doc, error) {
+	p := pointer(path)
+	o.Path = &p
+	doc, err := d.update(func(value reflect.Value) (reflect.Value, error) {
+		return applyPatch(d.kind, value, []operation{o})
+	})
+	if patchErr, ok := err.(*kind.PatchError); ok {
+		return doc, patchErr.Err
+	}
+	return doc, err
+}
 
-			fromV, err := d.Kind().ValueAt(d.value, fromPath)
-			if err != nil {
-				cb(err)
-				return
+// Loads entity, changes it with f and stores it in a transaction together with its meta.
+func (d *document) update(f func(value reflect.Value) (reflect.Value, error)) (kind.Doc, error) {
+	if d.key == nil || d.key.Incomplete() {
+		return d, errors.New("can't update value for undefined key")
+	}
+	if d.meta == nil {
+		return d, errors.New("entry doesn't match meta")
+	}
+	if d.meta.key == nil {
+		d.meta.key = metaKey(d.defaultCtx, d, d.meta.groupKey)
+	}
+	err := storage.RunInTransaction(d.ctx, func(tc context.Context) error {
+		d.value = reflect.New(d.Type())
+		err := storage.Get(tc, d.key, d)
+		if err != nil {
+			if err == datastore.ErrNoSuchEntity && len(d.ifMatch) > 0 {
+				return kind.ErrPreconditionFailed
 			}
-
-			if v.CanSet() {
-				v.Set(fromV)
-			} else {
-				cb(errors.New("field value can't be set"))
-				return
+			return err
+		}
+		if err = d.checkETag(tc); err != nil {
+			return err
+		}
+		prev := reflect.New(d.Type())
+		prev.Elem().Set(d.value.Elem())
+		d.value, err = f(d.value)
+		if err != nil {
+			return err
+		}
+		d.stamp(prev)
+		if err = d.trigger(tc, BeforeUpdate); err != nil {
+			return err
+		}
+		if err = d.validate(); err != nil {
+			return err
+		}
+		d.key, err = storage.Put(tc, d.key, d)
+		if err != nil {
+			return err
+		}
+		if d.kind.KeepsRevisions() {
+			if err = d.saveRevision(tc); err != nil {
+				return err
 			}
-		default:
-			cb(errors.New("invalid operation"))
-			return
 		}
-	})
+		return d.meta.Save(tc, d, d.meta.group)
+	}, &datastore.TransactionOptions{XG: true})
 	if err != nil {
-		return err
+		return d, err
 	}
-	return endErr
+	d.created = false
+	return d, d.triggerAfter(AfterUpdate)
 }
 
+// Delete removes the document with its meta, revisions and relationships. Collections with
+// soft delete move it to trash instead.
 func (d *document) Delete() error {
-	return datastore.RunInTransaction(d.ctx, func(tc context.Context) error {
-		err := datastore.Delete(tc, d.key)
+	if d.kind.SoftDeletes() {
+		return d.trash()
+	}
+	if d.meta.key == nil {
+		d.meta.key = metaKey(d.defaultCtx, d, d.meta.groupKey)
+	}
+	err := storage.RunInTransaction(d.ctx, func(tc context.Context) error {
+		// missing documents aren't counted and have nothing to delete; hooks get the deleted value
+		d.value = reflect.New(d.Type())
+		err := storage.Get(tc, d.key, d)
 		if err != nil {
+			if err == datastore.ErrNoSuchEntity && len(d.ifMatch) > 0 {
+				return kind.ErrPreconditionFailed
+			}
+			if _, ok := err.(*datastore.ErrFieldMismatch); !ok {
+				return err
+			}
+		}
+		if err = d.checkETag(tc); err != nil {
+			return err
+		}
+		if err = d.trigger(tc, BeforeDelete); err != nil {
+			return err
+		}
+		if err = storage.Delete(tc, d.key); err != nil {
+			return err
+		}
+		if err = storage.Delete(tc, d.meta.key); err != nil {
+			return err
+		}
+		if err = deleteRevisions(tc, d.kind.Name(), d.key); err != nil {
 			return err
 		}
 		return d.kind.Decrement(tc)
 	}, &datastore.TransactionOptions{XG: true})
+	if err != nil {
+		return err
+	}
+	if err = deleteRelationships(d.defaultCtx, d.key); err != nil {
+		return err
+	}
+	return d.triggerAfter(AfterDelete)
+}
+
+// IfMatch makes the next write fail with kind.ErrPreconditionFailed unless the stored entity
+// matches one of the entity tags in the If-Match header value. "*" matches any stored entity.
+func (d *document) IfMatch(header string) {
+	d.ifMatch = nil
+	for _, tag := range strings.Split(header, ",") {
+		if tag = strings.TrimSpace(tag); len(tag) > 0 {
+			d.ifMatch = append(d.ifMatch, tag)
+		}
+	}
+}
+
+// ETag is taken from version field if collection has one, otherwise from meta update time.
+func (d *document) ETag() string {
+	if c, ok := d.kind.(*Collection); ok && c.hasVersionFieldName {
+		switch f := d.value.Elem().FieldByName(c.versionFieldName); f.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			return strconv.Quote(strconv.FormatInt(f.Int(), 10))
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			return strconv.Quote(strconv.FormatUint(f.Uint(), 10))
+		}
+	}
+	if d.meta == nil || !d.meta.exists {
+		return ""
+	}
+	return strconv.Quote(strconv.FormatInt(d.meta.value.UpdatedAt.UnixNano(), 36))
+}
+
+// Compares If-Match with loaded entity. Meta is reloaded in tc so that concurrent writes conflict.
+func (d *document) checkETag(tc context.Context) error {
+	if len(d.ifMatch) == 0 {
+		return nil
+	}
+	if d.meta.key != nil {
+		err := storage.Get(tc, d.meta.key, &d.meta.value)
+		if err == nil {
+			d.meta.exists = true
+		} else if err != datastore.ErrNoSuchEntity {
+			return err
+		}
+	}
+	etag := d.ETag()
+	for _, tag := range d.ifMatch {
+		// weak tags never match
+		if tag == "*" || (tag == etag && len(etag) > 0) {
+			return nil
+		}
+	}
+	return kind.ErrPreconditionFailed
 }
 
 func (d *document) Set(data interface{}) (kind.Doc, error) {
@@ -343,6 +418,9 @@ func (d *document) Set(data interface{}) (kind.Doc, error) {
 	if d.key == nil || d.key.Incomplete() {
 		return d, errors.New("can't set value for undefined key")
 	}
+	if !d.meta.value.DeletedAt.IsZero() {
+		return d, kind.ErrInTrash
+	}
 	if d.value.Elem().CanSet() {
 		if bytes, ok := data.([]byte); ok {
 			inputValue := reflect.New(d.Type()).Interface()
@@ -358,14 +436,57 @@ func (d *document) Set(data interface{}) (kind.Doc, error) {
 		return d, errors.New("field value can't be set")
 	}
 
-	d.key, err = datastore.Put(d.ctx, d.key, d)
+	// precondition must be checked in the write transaction, revision needs the stored entity
+	if len(d.ifMatch) > 0 || (d.kind.KeepsRevisions() && d.meta.exists) {
+		value := d.value
+		return d.update(func(reflect.Value) (reflect.Value, error) {
+			return value, nil
+		})
+	}
+
+	created := false
+	write := func(tc context.Context) error {
+		// keep creation fields and version of the stored entity
+		prev := reflect.New(d.Type())
+		err := storage.Get(tc, d.key, prev.Interface())
+		created = err == datastore.ErrNoSuchEntity
+		if created {
+			prev = reflect.Value{}
+		} else if _, ok := err.(*datastore.ErrFieldMismatch); err != nil && !ok {
+			return err
+		}
+		d.stamp(prev)
+		event := BeforeUpdate
+		if created {
+			event = BeforeCreate
+		}
+		if err = d.trigger(tc, event); err != nil {
+			return err
+		}
+		if err = d.validate(); err != nil {
+			return err
+		}
+		d.key, err = storage.Put(tc, d.key, d)
+		if err != nil {
+			return err
+		}
+		if created {
+			if err = d.kind.Increment(tc); err != nil {
+				return err
+			}
+		}
+		return d.Commit()
+	}
+	// version is read and written in one transaction, so concurrent writes don't share it
+	err = storage.RunInTransaction(d.ctx, write, &datastore.TransactionOptions{XG: true})
 	if err != nil {
 		return d, err
 	}
-
-	err = d.Commit()
-
-	return d, err
+	d.created = created
+	if created {
+		return d, d.triggerAfter(AfterCreate)
+	}
+	return d, d.triggerAfter(AfterUpdate)
 }
 
 func (d *document) SetMember(member *datastore.Key) {
@@ -401,8 +522,15 @@ func (d *document) Add(data interface{}) (kind.Doc, error) {
 	// 4. Store value
 	if d.key.Incomplete() {
 		d.value.Elem().Set(value)
-		err = datastore.RunInTransaction(d.ctx, func(tc context.Context) error {
-			d.key, err = datastore.Put(tc, d.key, d)
+		d.stamp(reflect.Value{})
+		err = storage.RunInTransaction(d.ctx, func(tc context.Context) error {
+			if err := d.trigger(tc, BeforeCreate); err != nil {
+				return err
+			}
+			if err := d.validate(); err != nil {
+				return err
+			}
+			d.key, err = storage.Put(tc, d.key, d)
 			if err != nil {
 				return err
 			}
@@ -412,14 +540,23 @@ func (d *document) Add(data interface{}) (kind.Doc, error) {
 			}
 			return d.Commit()
 		}, &datastore.TransactionOptions{XG: true})
+	} else if !d.meta.value.DeletedAt.IsZero() {
+		err = kind.ErrInTrash
 	} else {
-		err = datastore.RunInTransaction(d.ctx, func(tc context.Context) error {
-			err = datastore.Get(tc, d.key, d)
+		err = storage.RunInTransaction(d.ctx, func(tc context.Context) error {
+			err = storage.Get(tc, d.key, d)
 			if err != nil {
 				if err == datastore.ErrNoSuchEntity {
 					// ok
 					d.value.Elem().Set(value)
-					d.key, err = datastore.Put(tc, d.key, d)
+					d.stamp(reflect.Value{})
+					if err = d.trigger(tc, BeforeCreate); err != nil {
+						return err
+					}
+					if err = d.validate(); err != nil {
+						return err
+					}
+					d.key, err = storage.Put(tc, d.key, d)
 					if err != nil {
 						return err
 					}
@@ -434,22 +571,37 @@ func (d *document) Add(data interface{}) (kind.Doc, error) {
 			return kind.ErrEntityAlreadyExists
 		}, &datastore.TransactionOptions{XG: true})
 	}
-	return d, err
+	if err != nil {
+		return d, err
+	}
+	d.created = true
+	return d, d.triggerAfter(AfterCreate)
 }
 
 func (d *document) SetRole(member *datastore.Key, role ...string) error {
 	if d.key == nil || d.key.Incomplete() {
 		return errors.New("can't set role if key is incomplete")
 	}
-	_, err := datastore.Put(d.defaultCtx, datastore.NewKey(d.defaultCtx, "_groupRelationship", d.key.Encode(), 0, member), &GroupRelationship{
-		Roles: role,
+	_, err := storage.Put(d.defaultCtx, datastore.NewKey(d.defaultCtx, "_groupRelationship", d.key.Encode(), 0, member), &GroupRelationship{
+		Roles:    role,
+		Document: d.key,
 	})
-	return err
+	if err != nil {
+		return err
+	}
+
+	// contexts that keep an audit log record the grant
+	if a, ok := d.defaultCtx.(interface {
+		AuditGrant(key *datastore.Key, member *datastore.Key, roles []string)
+	}); ok {
+		a.AuditGrant(d.key, member, role)
+	}
+	return nil
 }
 
 func (d *document) HasRole(member *datastore.Key, role ...string) bool {
 	var iam = new(GroupRelationship)
-	err := datastore.Get(d.defaultCtx, datastore.NewKey(d.defaultCtx, "_groupRelationship", d.key.Encode(), 0, member), iam)
+	err := storage.Get(d.defaultCtx, datastore.NewKey(d.defaultCtx, "_groupRelationship", d.key.Encode(), 0, member), iam)
 	if err == nil && ContainsScope(iam.Roles, role...) {
 		return true
 	}
@@ -477,20 +629,80 @@ func (d *document) Load(ps []datastore.Property) error {
 }
 
 func (d *document) Save() ([]datastore.Property, error) {
-	//var now = reflect.ValueOf(time.Now())
-	//v := reflect.ValueOf(d.value).Elem()
-	/*for _, meta := range d.Kind.MetaFields {
-		field := v.FieldByName(meta.FieldName)
-		if field.CanSet() {
-			switch meta.Type {
-			case "updatedat":
-				field.Set(now)
-			case "createdat":
-				if !d.hasLoadedData {
-					field.Set(now)
-				}
+	return datastore.SaveStruct(d.value.Interface())
+}
+
+// Fills auto fields before the value is stored. Prev is the stored value or
+// invalid if entity is new.
+func (d *document) stamp(prev reflect.Value) {
+	c, ok := d.kind.(*Collection)
+	if !ok {
+		return
+	}
+	var now = time.Now()
+	v := d.value.Elem()
+	if prev.IsValid() {
+		prev = prev.Elem()
+	}
+	if c.hasCreatedAtFieldName {
+		if prev.IsValid() && !prev.FieldByName(c.createdAtFieldName).IsZero() {
+			setField(v.FieldByName(c.createdAtFieldName), prev.FieldByName(c.createdAtFieldName).Interface())
+		} else {
+			setField(v.FieldByName(c.createdAtFieldName), now)
+		}
+	}
+	if c.hasUpdatedAtFieldName {
+		setField(v.FieldByName(c.updatedAtFieldName), now)
+	}
+	if c.hasCreatedByFieldName {
+		if prev.IsValid() {
+			setField(v.FieldByName(c.createdByFieldName), prev.FieldByName(c.createdByFieldName).Interface())
+		} else {
+			setField(v.FieldByName(c.createdByFieldName), d.member)
+		}
+	}
+	if c.hasUpdatedByFieldName {
+		setField(v.FieldByName(c.updatedByFieldName), d.member)
+	}
+	if c.hasVersionFieldName {
+		field := v.FieldByName(c.versionFieldName)
+		var version int64
+		if prev.IsValid() {
+			switch f := prev.FieldByName(c.versionFieldName); f.Kind() {
+			case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+				version = f.Int()
+			case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+				version = int64(f.Uint())
 			}
 		}
-	}*/
-	return datastore.SaveStruct(d.value.Interface())
+		switch field.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			field.SetInt(version + 1)
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			field.SetUint(uint64(version + 1))
+		}
+	}
+}
+
+// Sets field if value type matches. Keys are also accepted by string fields.
+func setField(field reflect.Value, value interface{}) {
+	if !field.IsValid() || !field.CanSet() {
+		return
+	}
+	if key, ok := value.(*datastore.Key); ok && field.Kind() == reflect.String {
+		if key == nil {
+			field.SetString("")
+		} else {
+			field.SetString(key.Encode())
+		}
+		return
+	}
+	v := reflect.ValueOf(value)
+	if !v.IsValid() {
+		field.Set(reflect.Zero(field.Type()))
+		return
+	}
+	if v.Type().AssignableTo(field.Type()) {
+		field.Set(v)
+	}
 }
@@ -0,0 +1,99 @@
+package collection
+
+import (
+	"github.com/ales6164/apis/kind"
+	"github.com/ales6164/apis/storage"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+)
+
+// Events of document lifecycle hooks.
+const (
+	BeforeRead   = "beforeRead"
+	BeforeCreate = "beforeCreate"
+	BeforeUpdate = "beforeUpdate"
+	BeforeDelete = "beforeDelete"
+	AfterRead    = "afterRead"
+	AfterCreate  = "afterCreate"
+	AfterUpdate  = "afterUpdate"
+	AfterDelete  = "afterDelete"
+)
+
+/*
+Hook runs on a document lifecycle event. Served requests pass apis.Context as ctx. Before-hooks
+of writes run inside the write transaction with the value that is going to be stored, so they
+can change it or reject the write with an error, like *kind.HookError. After-hooks run after the
+commit; their errors are returned but don't undo the write.
+
+Read hooks run on every document a response includes: gets, listings, expanded references,
+exports, trash and revisions. Documents of queries are loaded before BeforeRead runs.
+
+Write hooks don't run on import, restore and purge.
+*/
+type Hook func(ctx context.Context, doc kind.Doc) error
+
+// On adds hooks for event. Hooks of an event run in the order they were added and stop at
+// the first error.
+func (c *Collection) On(event string, hooks ...Hook) *Collection {
+	if c.hooks == nil {
+		c.hooks = map[string][]Hook{}
+	}
+	c.hooks[event] = append(c.hooks[event], hooks...)
+	return c
+}
+
+// Loaded runs read hooks on a document loaded by a query, which Get runs around the load.
+func (d *document) Loaded() error {
+	if err := d.trigger(d.ctx, BeforeRead); err != nil {
+		return err
+	}
+	return d.trigger(d.ctx, AfterRead)
+}
+
+func (c *Collection) hasReadHooks() bool {
+	return len(c.hooks[BeforeRead]) > 0 || len(c.hooks[AfterRead]) > 0
+}
+
+func (d *document) hasHooks(event string) bool {
+	c, ok := d.kind.(*Collection)
+	return ok && len(c.hooks[event]) > 0
+}
+
+// Runs hooks of event with the request context bound to storage context c.
+func (d *document) trigger(c context.Context, event string) error {
+	collection, ok := d.kind.(*Collection)
+	if !ok {
+		return nil
+	}
+	hooks := collection.hooks[event]
+	if len(hooks) == 0 {
+		return nil
+	}
+	ctx := c
+	if w, ok := d.defaultCtx.(interface {
+		WithContext(c context.Context) context.Context
+	}); ok {
+		ctx = w.WithContext(c)
+	}
+	for _, hook := range hooks {
+		if err := hook(ctx, d); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Runs hooks of event after the commit of the batch, or right away outside of batches.
+func (d *document) triggerAfter(event string) error {
+	if !d.hasHooks(event) {
+		return nil
+	}
+	return storage.AfterCommit(d.ctx, func(c context.Context) error {
+		// batches run it with the context of the request
+		c, err := appengine.Namespace(c, d.key.Namespace())
+		if err != nil {
+			return err
+		}
+		return d.trigger(c, event)
+	})
+}
@@ -0,0 +1,88 @@
+package collection
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+)
+
+var (
+	null            = []byte("null")
+	unmarshalerType = reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
+)
+
+// Applies JSON Merge Patch (RFC 7396) to value. Members map to fields by their JSON
+// names, null clears the field and objects are merged into nested structs and maps.
+// Members that don't match any field are ignored.
+func (c *Collection) merge(value reflect.Value, path []string, fields map[string]*Field, data []byte) error {
+	var patch map[string]json.RawMessage
+	if err := json.Unmarshal(data, &patch); err != nil {
+		return err
+	}
+	for name, raw := range patch {
+		f, ok := fields[name]
+		if !ok {
+			continue
+		}
+		fieldPath := append(path[:len(path):len(path)], name)
+		v, err := c.ValueAt(value, fieldPath)
+		if err != nil {
+			return err
+		}
+		if !v.IsValid() || !v.CanSet() {
+			continue
+		}
+		switch {
+		case bytes.Equal(bytes.TrimSpace(raw), null):
+			v.Set(reflect.Zero(v.Type()))
+		case isObject(raw) && v.Kind() == reflect.Struct && f.Fields != nil && !isUnmarshaler(v):
+			if err := c.merge(value, fieldPath, f.Fields, raw); err != nil {
+				return err
+			}
+		case isObject(raw) && v.Kind() == reflect.Map && v.Type().Key().Kind() == reflect.String:
+			if err := mergeMap(v, raw); err != nil {
+				return err
+			}
+		default:
+			n := reflect.New(v.Type())
+			if err := json.Unmarshal(raw, n.Interface()); err != nil {
+				return err
+			}
+			v.Set(n.Elem())
+		}
+	}
+	return nil
+}
+
+func mergeMap(v reflect.Value, data []byte) error {
+	var patch map[string]json.RawMessage
+	if err := json.Unmarshal(data, &patch); err != nil {
+		return err
+	}
+	if v.IsNil() {
+		v.Set(reflect.MakeMap(v.Type()))
+	}
+	for name, raw := range patch {
+		key := reflect.ValueOf(name).Convert(v.Type().Key())
+		if bytes.Equal(bytes.TrimSpace(raw), null) {
+			v.SetMapIndex(key, reflect.Value{})
+			continue
+		}
+		n := reflect.New(v.Type().Elem())
+		if err := json.Unmarshal(raw, n.Interface()); err != nil {
+			return err
+		}
+		v.SetMapIndex(key, n.Elem())
+	}
+	return nil
+}
+
+func isObject(data []byte) bool {
+	data = bytes.TrimSpace(data)
+	return len(data) > 0 && data[0] == '{'
+}
+
+// types with custom decoding (like time.Time) are replaced, not merged
+func isUnmarshaler(v reflect.Value) bool {
+	return v.Type().Implements(unmarshalerType) || reflect.PtrTo(v.Type()).Implements(unmarshalerType)
+}
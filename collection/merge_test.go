@@ -0,0 +1,67 @@
+package collection
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+type mergeAddress struct {
+	City string `json:"city"`
+	Zip  string `json:"zip"`
+}
+
+type merged struct {
+	Name    string            `json:"name"`
+	Tags    []string          `json:"tags"`
+	Address mergeAddress      `json:"address"`
+	Labels  map[string]string `json:"labels"`
+	Time    time.Time         `json:"time"`
+}
+
+func TestMerge(t *testing.T) {
+	c := New("merged", merged{})
+	base := func() merged {
+		return merged{
+			Name:    "a",
+			Tags:    []string{"x", "y"},
+			Address: mergeAddress{City: "Paris", Zip: "75000"},
+			Labels:  map[string]string{"k": "v", "l": "w"},
+		}
+	}
+	tests := []struct {
+		name  string
+		patch string
+		want  func(m *merged)
+	}{
+		{"replace member", `{"name":"b"}`, func(m *merged) { m.Name = "b" }},
+		{"null clears", `{"name":null,"tags":null}`, func(m *merged) { m.Name, m.Tags = "", nil }},
+		{"arrays are replaced", `{"tags":["z"]}`, func(m *merged) { m.Tags = []string{"z"} }},
+		{"nested struct is merged", `{"address":{"city":"Rome"}}`, func(m *merged) { m.Address.City = "Rome" }},
+		{"map is merged", `{"labels":{"k":null,"m":"n"}}`, func(m *merged) { m.Labels = map[string]string{"l": "w", "m": "n"} }},
+		{"time is replaced", `{"time":"2020-01-02T03:04:05Z"}`, func(m *merged) { m.Time = time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC) }},
+		{"unknown members are ignored", `{"unknown":1}`, func(m *merged) {}},
+		{"empty patch", `{}`, func(m *merged) {}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := base()
+			want := base()
+			tt.want(&want)
+			if err := c.merge(reflect.ValueOf(&v), nil, c.fields, []byte(tt.patch)); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(v, want) {
+				t.Fatalf("got %+v, want %+v", v, want)
+			}
+		})
+	}
+
+	v := base()
+	if err := c.merge(reflect.ValueOf(&v), nil, c.fields, []byte(`{"name":1}`)); err == nil {
+		t.Fatal("expected error for wrong type")
+	}
+	if err := c.merge(reflect.ValueOf(&v), nil, c.fields, []byte(`[1]`)); err == nil {
+		t.Fatal("expected error for patch that isn't an object")
+	}
+}
@@ -3,6 +3,7 @@ package collection
 import (
 	"errors"
 	"github.com/ales6164/apis/kind"
+	"github.com/ales6164/apis/storage"
 	"golang.org/x/net/context"
 	"google.golang.org/appengine"
 	"google.golang.org/appengine/datastore"
@@ -23,11 +24,15 @@ type metaValue struct {
 	UpdatedAt time.Time `json:"updatedAt"`
 	GroupId   string    `json:"-"`
 	Id        string    `json:"-"` // every entry should have unique namespace --- or maybe auto generated if needed
+	DeletedAt time.Time `json:"-"` // set while document is in trash
 }
 
 func metaKey(ctx context.Context, d kind.Doc, groupKey *datastore.Key) *datastore.Key {
-	k := d.Key()
-	return datastore.NewKey(ctx, "_meta_"+d.Kind().Name(), k.StringID(), k.IntID(), groupKey)
+	return metaKeyOf(ctx, d.Kind().Name(), d.Key(), groupKey)
+}
+
+func metaKeyOf(ctx context.Context, kindName string, k *datastore.Key, groupKey *datastore.Key) *datastore.Key {
+	return datastore.NewKey(ctx, "_meta_"+kindName, k.StringID(), k.IntID(), groupKey)
 }
 
 func getMeta(ctx context.Context, d kind.Doc, groupMeta kind.Meta) (*meta, error) {
@@ -46,7 +51,7 @@ func getMeta(ctx context.Context, d kind.Doc, groupMeta kind.Meta) (*meta, error
 		m.value.Id = RandStringBytesMaskImprSrc(LetterNumberBytes, 6)
 	} else {
 		k := metaKey(ctx, d, groupKey)
-		err = datastore.Get(ctx, k, &m.value)
+		err = storage.Get(ctx, k, &m.value)
 		if err != nil {
 			if err == datastore.ErrNoSuchEntity {
 				m.value.CreatedAt = time.Now()
@@ -80,6 +85,7 @@ type OutputMeta struct {
 	Id        string      `json:"id"`
 	CreatedAt time.Time   `json:"createdAt"`
 	UpdatedAt time.Time   `json:"updatedAt"`
+	DeletedAt *time.Time  `json:"deletedAt,omitempty"`
 	Value     interface{} `json:"value"`
 }
 
@@ -90,12 +96,16 @@ func (m *meta) Print(d kind.Doc, value interface{}) interface{} {
 	} else {
 		id = d.Key().StringID()
 	}
-	return &OutputMeta{
+	out := &OutputMeta{
 		Id:        id,
 		CreatedAt: m.value.CreatedAt,
 		UpdatedAt: m.value.UpdatedAt,
 		Value:     value,
 	}
+	if !m.value.DeletedAt.IsZero() {
+		out.DeletedAt = &m.value.DeletedAt
+	}
+	return out
 }
 
 func (m *meta) Key() *datastore.Key {
@@ -106,6 +116,10 @@ func (m *meta) Exists() bool {
 	return m.exists
 }
 
+func (m *meta) UpdatedAt() time.Time {
+	return m.value.UpdatedAt
+}
+
 func (m *meta) Save(ctx context.Context, d kind.Doc, groupMeta kind.Meta) error {
 	var err error
 	if d.Key() == nil || d.Key().Incomplete() {
@@ -120,7 +134,7 @@ func (m *meta) Save(ctx context.Context, d kind.Doc, groupMeta kind.Meta) error
 	} else {
 		m.value.UpdatedAt = time.Now()
 	}
-	m.key, err = datastore.Put(ctx, m.key, &m.value)
+	m.key, err = storage.Put(ctx, m.key, &m.value)
 	m.exists = err == nil
 	return err
 }
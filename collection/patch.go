@@ -0,0 +1,411 @@
+package collection
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"github.com/ales6164/apis/kind"
+	"math/big"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+var (
+	errPathNotFound = kind.ErrPathNotFound
+	errInvalidIndex = errors.New("invalid array index")
+	errMissingValue = errors.New("missing value")
+	errMissingFrom  = errors.New("missing from")
+	errInvalidPath  = errors.New("invalid path")
+	errMoveToChild  = errors.New("can't move value into one of its children")
+)
+
+type operation struct {
+	Op    string          `json:"op"`
+	Path  *string         `json:"path"`
+	From  *string         `json:"from"`
+	Value json.RawMessage `json:"value"`
+}
+
+// parses JSON Patch (RFC 6902) document
+func parsePatch(data []byte) ([]operation, error) {
+	var ops []operation
+	if err := json.Unmarshal(data, &ops); err != nil {
+		return nil, err
+	}
+	for i, o := range ops {
+		if o.Path == nil {
+			return nil, &kind.PatchError{Index: i, Op: o.Op, Err: errInvalidPath}
+		}
+	}
+	return ops, nil
+}
+
+// applies operations to JSON representation of value and decodes result into a new value of type t
+func applyPatch(c kind.Kind, value reflect.Value, ops []operation) (reflect.Value, error) {
+	doc, err := toTree(c, value)
+	if err != nil {
+		return value, err
+	}
+
+	out := value
+	for i, o := range ops {
+		if doc, err = applyOperation(doc, o); err != nil {
+			return value, &kind.PatchError{Index: i, Op: o.Op, Path: *o.Path, Err: err}
+		}
+		// every operation must leave the document decodable into the collection type
+		if out, err = fromTree(c, doc, value); err != nil {
+			return value, &kind.PatchError{Index: i, Op: o.Op, Path: *o.Path, Err: err}
+		}
+	}
+	return out, nil
+}
+
+// encodes value as generic JSON tree; known fields that were omitted are set to null
+func toTree(c kind.Kind, value reflect.Value) (interface{}, error) {
+	b, err := json.Marshal(value.Interface())
+	if err != nil {
+		return nil, err
+	}
+	doc, err := decodeTree(b)
+	if err != nil {
+		return nil, err
+	}
+	if m, ok := doc.(map[string]interface{}); ok {
+		if col, ok := c.(*Collection); ok {
+			for name := range col.fields {
+				if _, ok := m[name]; !ok {
+					m[name] = nil
+				}
+			}
+		}
+	}
+	return doc, nil
+}
+
+// decodes JSON tree into a new value; fields hidden from JSON are kept from old value
+func fromTree(c kind.Kind, doc interface{}, old reflect.Value) (reflect.Value, error) {
+	b, err := json.Marshal(doc)
+	if err != nil {
+		return old, err
+	}
+	n := reflect.New(c.Type())
+	if err := json.Unmarshal(b, n.Interface()); err != nil {
+		return old, err
+	}
+	copyHiddenFields(n.Elem(), old.Elem())
+	return n, nil
+}
+
+func copyHiddenFields(dst, src reflect.Value) {
+	t := dst.Type()
+	for i := 0; i < t.NumField(); i++ {
+		if tag, ok := t.Field(i).Tag.Lookup("json"); ok && strings.Split(tag, ",")[0] == "-" {
+			if f := dst.Field(i); f.CanSet() {
+				f.Set(src.Field(i))
+			}
+		}
+	}
+}
+
+func decodeTree(b []byte) (interface{}, error) {
+	var v interface{}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	err := dec.Decode(&v)
+	return v, err
+}
+
+func applyOperation(doc interface{}, o operation) (interface{}, error) {
+	path, err := parsePointer(*o.Path)
+	if err != nil {
+		return doc, err
+	}
+
+	var value interface{}
+	switch o.Op {
+	case op_add, op_replace, op_test:
+		if o.Value == nil {
+			return doc, errMissingValue
+		}
+		if value, err = decodeTree(o.Value); err != nil {
+			return doc, err
+		}
+	case op_move, op_copy:
+		if o.From == nil {
+			return doc, errMissingFrom
+		}
+		from, err := parsePointer(*o.From)
+		if err != nil {
+			return doc, err
+		}
+		if o.Op == op_move && len(from) < len(path) && isPrefix(from, path) {
+			return doc, errMoveToChild
+		}
+		if value, err = get(doc, from); err != nil {
+			return doc, err
+		}
+		if o.Op == op_move {
+			if doc, err = remove(doc, from); err != nil {
+				return doc, err
+			}
+		} else {
+			value = deepCopy(value)
+		}
+	}
+
+	switch o.Op {
+	case op_add, op_move, op_copy:
+		return add(doc, path, value)
+	case op_remove:
+		return remove(doc, path)
+	case op_replace:
+		if _, err := get(doc, path); err != nil {
+			return doc, err
+		}
+		return set(doc, path, value)
+	case op_test:
+		current, err := get(doc, path)
+		if err != nil {
+			return doc, err
+		}
+		if !equal(current, value) {
+			return doc, kind.ErrPatchTestFailed
+		}
+		return doc, nil
+	}
+	return doc, errors.New("invalid operation " + strconv.Quote(o.Op))
+}
+
+// parses JSON Pointer (RFC 6901)
+func parsePointer(p string) ([]string, error) {
+	if len(p) == 0 {
+		return nil, nil
+	}
+	if p[0] != '/' {
+		return nil, errInvalidPath
+	}
+	parts := strings.Split(p[1:], "/")
+	for i, part := range parts {
+		parts[i] = strings.Replace(strings.Replace(part, "~1", "/", -1), "~0", "~", -1)
+	}
+	return parts, nil
+}
+
+// formats path as JSON Pointer
+func pointer(path []string) string {
+	var p string
+	for _, part := range path {
+		p += "/" + strings.Replace(strings.Replace(part, "~", "~0", -1), "/", "~1", -1)
+	}
+	return p
+}
+
+func isPrefix(prefix, path []string) bool {
+	for i := range prefix {
+		if prefix[i] != path[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// index must be a non-negative integer without leading zeros; "-" is allowed when adding
+func arrayIndex(token string, length int, adding bool) (int, error) {
+	if adding && token == "-" {
+		return length, nil
+	}
+	if len(token) == 0 || (len(token) > 1 && token[0] == '0') {
+		return 0, errInvalidIndex
+	}
+	for _, r := range token {
+		if r < '0' || r > '9' {
+			return 0, errInvalidIndex
+		}
+	}
+	i, err := strconv.Atoi(token)
+	if err != nil {
+		return 0, errInvalidIndex
+	}
+	if i > length || (!adding && i == length) {
+		return 0, errPathNotFound
+	}
+	return i, nil
+}
+
+func get(doc interface{}, path []string) (interface{}, error) {
+	for _, token := range path {
+		switch v := doc.(type) {
+		case map[string]interface{}:
+			var ok bool
+			if doc, ok = v[token]; !ok {
+				return nil, errPathNotFound
+			}
+		case []interface{}:
+			i, err := arrayIndex(token, len(v), false)
+			if err != nil {
+				return nil, err
+			}
+			doc = v[i]
+		default:
+			return nil, errPathNotFound
+		}
+	}
+	return doc, nil
+}
+
+// changes the value at the last path token using f and returns the new document
+func update(doc interface{}, path []string, f func(parent interface{}, token string) (interface{}, error)) (interface{}, error) {
+	if len(path) == 1 {
+		return f(doc, path[0])
+	}
+	token := path[0]
+	switch v := doc.(type) {
+	case map[string]interface{}:
+		child, ok := v[token]
+		if !ok {
+			return doc, errPathNotFound
+		}
+		child, err := update(child, path[1:], f)
+		if err != nil {
+			return doc, err
+		}
+		v[token] = child
+		return v, nil
+	case []interface{}:
+		i, err := arrayIndex(token, len(v), false)
+		if err != nil {
+			return doc, err
+		}
+		child, err := update(v[i], path[1:], f)
+		if err != nil {
+			return doc, err
+		}
+		v[i] = child
+		return v, nil
+	}
+	return doc, errPathNotFound
+}
+
+func add(doc interface{}, path []string, value interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+	return update(doc, path, func(parent interface{}, token string) (interface{}, error) {
+		switch v := parent.(type) {
+		case map[string]interface{}:
+			v[token] = value
+			return v, nil
+		case []interface{}:
+			i, err := arrayIndex(token, len(v), true)
+			if err != nil {
+				return parent, err
+			}
+			v = append(v, nil)
+			copy(v[i+1:], v[i:])
+			v[i] = value
+			return v, nil
+		}
+		return parent, errPathNotFound
+	})
+}
+
+func set(doc interface{}, path []string, value interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+	return update(doc, path, func(parent interface{}, token string) (interface{}, error) {
+		switch v := parent.(type) {
+		case map[string]interface{}:
+			v[token] = value
+			return v, nil
+		case []interface{}:
+			i, err := arrayIndex(token, len(v), false)
+			if err != nil {
+				return parent, err
+			}
+			v[i] = value
+			return v, nil
+		}
+		return parent, errPathNotFound
+	})
+}
+
+func remove(doc interface{}, path []string) (interface{}, error) {
+	if len(path) == 0 {
+		return nil, nil
+	}
+	return update(doc, path, func(parent interface{}, token string) (interface{}, error) {
+		switch v := parent.(type) {
+		case map[string]interface{}:
+			if _, ok := v[token]; !ok {
+				return parent, errPathNotFound
+			}
+			delete(v, token)
+			return v, nil
+		case []interface{}:
+			i, err := arrayIndex(token, len(v), false)
+			if err != nil {
+				return parent, err
+			}
+			return append(v[:i], v[i+1:]...), nil
+		}
+		return parent, errPathNotFound
+	})
+}
+
+func deepCopy(v interface{}) interface{} {
+	switch x := v.(type) {
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(x))
+		for k, item := range x {
+			m[k] = deepCopy(item)
+		}
+		return m
+	case []interface{}:
+		a := make([]interface{}, len(x))
+		for i, item := range x {
+			a[i] = deepCopy(item)
+		}
+		return a
+	}
+	return v
+}
+
+// compares JSON values; numbers are equal when their values are
+func equal(a, b interface{}) bool {
+	switch x := a.(type) {
+	case map[string]interface{}:
+		y, ok := b.(map[string]interface{})
+		if !ok || len(x) != len(y) {
+			return false
+		}
+		for k, item := range x {
+			other, ok := y[k]
+			if !ok || !equal(item, other) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		y, ok := b.([]interface{})
+		if !ok || len(x) != len(y) {
+			return false
+		}
+		for i := range x {
+			if !equal(x[i], y[i]) {
+				return false
+			}
+		}
+		return true
+	case json.Number:
+		y, ok := b.(json.Number)
+		if !ok {
+			return false
+		}
+		rx, okx := new(big.Rat).SetString(string(x))
+		ry, oky := new(big.Rat).SetString(string(y))
+		return okx && oky && rx.Cmp(ry) == 0
+	}
+	return a == b
+}
@@ -0,0 +1,149 @@
+package collection
+
+import (
+	"encoding/json"
+	"github.com/ales6164/apis/kind"
+	"reflect"
+	"testing"
+)
+
+func applyJSON(doc, patch string) (string, error) {
+	tree, err := decodeTree([]byte(doc))
+	if err != nil {
+		return "", err
+	}
+	ops, err := parsePatch([]byte(patch))
+	if err != nil {
+		return "", err
+	}
+	for i, o := range ops {
+		if tree, err = applyOperation(tree, o); err != nil {
+			return "", &kind.PatchError{Index: i, Op: o.Op, Path: *o.Path, Err: err}
+		}
+	}
+	b, err := json.Marshal(tree)
+	return string(b), err
+}
+
+func jsonEqual(a, b string) bool {
+	var x, y interface{}
+	if json.Unmarshal([]byte(a), &x) != nil || json.Unmarshal([]byte(b), &y) != nil {
+		return false
+	}
+	return reflect.DeepEqual(x, y)
+}
+
+// Cases from RFC 6902 appendix A and edge cases of JSON Pointer.
+func TestApplyOperation(t *testing.T) {
+	tests := []struct {
+		name  string
+		doc   string
+		patch string
+		want  string
+		err   error // nil means any error when want is empty
+	}{
+		{"add member", `{"foo":"bar"}`, `[{"op":"add","path":"/baz","value":"qux"}]`, `{"baz":"qux","foo":"bar"}`, nil},
+		{"add array element", `{"foo":["bar","baz"]}`, `[{"op":"add","path":"/foo/1","value":"qux"}]`, `{"foo":["bar","qux","baz"]}`, nil},
+		{"append with dash", `{"foo":[1]}`, `[{"op":"add","path":"/foo/-","value":2}]`, `{"foo":[1,2]}`, nil},
+		{"replace root", `{"foo":1}`, `[{"op":"add","path":"","value":[1]}]`, `[1]`, nil},
+		{"remove member", `{"baz":"qux","foo":"bar"}`, `[{"op":"remove","path":"/baz"}]`, `{"foo":"bar"}`, nil},
+		{"remove array element", `{"foo":["bar","qux","baz"]}`, `[{"op":"remove","path":"/foo/1"}]`, `{"foo":["bar","baz"]}`, nil},
+		{"replace", `{"baz":"qux","foo":"bar"}`, `[{"op":"replace","path":"/baz","value":"boo"}]`, `{"baz":"boo","foo":"bar"}`, nil},
+		{"move", `{"foo":{"bar":"baz","waldo":"fred"},"qux":{"corge":"grault"}}`, `[{"op":"move","from":"/foo/waldo","path":"/qux/thud"}]`, `{"foo":{"bar":"baz"},"qux":{"corge":"grault","thud":"fred"}}`, nil},
+		{"move array element", `{"foo":["all","grass","cows","eat"]}`, `[{"op":"move","from":"/foo/1","path":"/foo/3"}]`, `{"foo":["all","cows","eat","grass"]}`, nil},
+		{"copy", `{"foo":{"bar":1}}`, `[{"op":"copy","from":"/foo","path":"/baz"}]`, `{"foo":{"bar":1},"baz":{"bar":1}}`, nil},
+		{"test passes", `{"baz":"qux","foo":["a",2,"c"]}`, `[{"op":"test","path":"/baz","value":"qux"},{"op":"test","path":"/foo/1","value":2}]`, `{"baz":"qux","foo":["a",2,"c"]}`, nil},
+		{"test numbers by value", `{"n":1}`, `[{"op":"test","path":"/n","value":1.0}]`, `{"n":1}`, nil},
+		{"escaped pointer", `{"a/b":{"m~n":1}}`, `[{"op":"replace","path":"/a~1b/m~0n","value":2}]`, `{"a/b":{"m~n":2}}`, nil},
+		{"nested add to missing parent", `{"foo":"bar"}`, `[{"op":"add","path":"/baz/bat","value":"qux"}]`, ``, errPathNotFound},
+		{"test fails", `{"baz":"qux"}`, `[{"op":"test","path":"/baz","value":"bar"}]`, ``, kind.ErrPatchTestFailed},
+		{"remove missing", `{"foo":1}`, `[{"op":"remove","path":"/bar"}]`, ``, errPathNotFound},
+		{"leading zero index", `{"foo":[1,2]}`, `[{"op":"replace","path":"/foo/01","value":3}]`, ``, errInvalidIndex},
+		{"index out of range", `{"foo":[1,2]}`, `[{"op":"add","path":"/foo/3","value":3}]`, ``, nil},
+		{"move into child", `{"foo":{"bar":1}}`, `[{"op":"move","from":"/foo","path":"/foo/bar/baz"}]`, ``, errMoveToChild},
+		{"missing value", `{"foo":1}`, `[{"op":"add","path":"/bar"}]`, ``, errMissingValue},
+		{"missing from", `{"foo":1}`, `[{"op":"copy","path":"/bar"}]`, ``, errMissingFrom},
+		{"pointer without slash", `{"foo":1}`, `[{"op":"replace","path":"foo","value":2}]`, ``, nil},
+		{"unknown op", `{"foo":1}`, `[{"op":"frobnicate","path":"/foo"}]`, ``, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := applyJSON(tt.doc, tt.patch)
+			if len(tt.want) == 0 {
+				if err == nil {
+					t.Fatalf("expected error, got %s", got)
+				}
+				if tt.err != nil {
+					pe, ok := err.(*kind.PatchError)
+					if !ok || pe.Err != tt.err {
+						t.Fatalf("expected %v, got %v", tt.err, err)
+					}
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !jsonEqual(got, tt.want) {
+				t.Fatalf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParsePatch(t *testing.T) {
+	if _, err := parsePatch([]byte(`[{"op":"add","value":1}]`)); err == nil {
+		t.Fatal("operation without path was accepted")
+	}
+	if _, err := parsePatch([]byte(`{"op":"add"}`)); err == nil {
+		t.Fatal("object was accepted as patch")
+	}
+	ops, err := parsePatch([]byte(`[{"op":"remove","path":"/a"},{"op":"add","path":"","value":{}}]`))
+	if err != nil || len(ops) != 2 {
+		t.Fatalf("got %v, %v", ops, err)
+	}
+}
+
+func TestPointer(t *testing.T) {
+	for _, p := range []string{"", "/a", "/a~1b/m~0n", "/0/-"} {
+		path, err := parsePointer(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := pointer(path); got != p {
+			t.Errorf("pointer(parsePointer(%q)) = %q", p, got)
+		}
+	}
+}
+
+type patched struct {
+	Name   string   `json:"name"`
+	Tags   []string `json:"tags"`
+	Hidden string   `json:"-"`
+}
+
+func TestApplyPatch(t *testing.T) {
+	c := New("patched", patched{})
+	value := reflect.ValueOf(&patched{Name: "a", Tags: []string{"x"}, Hidden: "kept"})
+	ops, err := parsePatch([]byte(`[{"op":"replace","path":"/name","value":"b"},{"op":"add","path":"/tags/-","value":"y"}]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := applyPatch(c, value, ops)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := out.Interface().(*patched)
+	if got.Name != "b" || !reflect.DeepEqual(got.Tags, []string{"x", "y"}) || got.Hidden != "kept" {
+		t.Fatalf("got %+v", got)
+	}
+
+	// value of wrong type can't be decoded into the collection type
+	ops, _ = parsePatch([]byte(`[{"op":"replace","path":"/name","value":1}]`))
+	if _, err := applyPatch(c, value, ops); err == nil {
+		t.Fatal("expected error for wrong type")
+	}
+	if value.Interface().(*patched).Name != "a" {
+		t.Fatal("failed patch changed the value")
+	}
+}
@@ -0,0 +1,247 @@
+package collection
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/ales6164/apis/kind"
+	"github.com/ales6164/apis/storage"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Stored on revisions next to properties of the version.
+const (
+	changedAtProperty = "_changedAt"
+	changedByProperty = "_changedBy"
+	updatedAtProperty = "_updatedAt" // when the version was written
+)
+
+// Revisions are child entities of the document under this kind.
+func revisionKind(name string) string {
+	return "_revision_" + name
+}
+
+/*
+Stores properties the document was loaded with as a revision. Run from the write transaction
+after the entity is written and before meta is saved, so the revision keeps the previous
+update time.
+*/
+func (d *document) saveRevision(tc context.Context) error {
+	if !d.hasLoadedData {
+		return nil
+	}
+	ps := append(datastore.PropertyList{}, d.rollbackProperties...)
+	ps = append(ps,
+		datastore.Property{Name: changedAtProperty, Value: time.Now()},
+		datastore.Property{Name: updatedAtProperty, Value: d.meta.value.UpdatedAt, NoIndex: true},
+	)
+	if d.member != nil {
+		ps = append(ps, datastore.Property{Name: changedByProperty, Value: d.member})
+	}
+	_, err := storage.Put(tc, datastore.NewIncompleteKey(tc, revisionKind(d.kind.Name()), d.key), &ps)
+	return err
+}
+
+// Removes revisions of document with key. Ancestor query can run in a transaction.
+func deleteRevisions(ctx context.Context, kindName string, key *datastore.Key) error {
+	var keys []*datastore.Key
+	t := storage.NewQuery(revisionKind(kindName)).Ancestor(key).KeysOnly().Run(ctx)
+	for {
+		k, err := t.Next(nil)
+		if err == datastore.Done {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		keys = append(keys, k)
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	return storage.DeleteMulti(ctx, keys)
+}
+
+// Revisions lists stored versions of the document, most recently replaced first.
+func (d *document) Revisions(cursor string, limit int) ([]kind.Revision, string, error) {
+	if d.key == nil || d.key.Incomplete() {
+		return nil, "", errors.New("can't list revisions of undefined key")
+	}
+	q := storage.NewQuery(revisionKind(d.kind.Name())).Ancestor(d.key).Order("-" + changedAtProperty).Limit(limit + 1)
+	if len(cursor) > 0 {
+		q = q.Start(cursor)
+	}
+	t := q.Run(d.ctx)
+	var revisions []kind.Revision
+	for {
+		var ps datastore.PropertyList
+		if len(revisions) == limit {
+			// next page starts after the last returned revision, if there's one more
+			next, err := t.Cursor()
+			if err != nil {
+				return nil, "", err
+			}
+			if _, err = t.Next(&ps); err == datastore.Done {
+				return revisions, "", nil
+			} else if _, ok := err.(*datastore.ErrFieldMismatch); err != nil && !ok {
+				return nil, "", err
+			}
+			return revisions, next, nil
+		}
+		key, err := t.Next(&ps)
+		if err == datastore.Done {
+			return revisions, "", nil
+		}
+		if err != nil {
+			return nil, "", err
+		}
+		rev, err := d.revision(key, ps)
+		if err != nil {
+			return nil, "", err
+		}
+		revisions = append(revisions, rev)
+	}
+}
+
+// Revision gets stored version of the document with id. Missing revision is ErrNoSuchEntity.
+func (d *document) Revision(id int64) (kind.Revision, error) {
+	if d.key == nil || d.key.Incomplete() {
+		return kind.Revision{}, errors.New("can't get revision of undefined key")
+	}
+	key := datastore.NewKey(d.ctx, revisionKind(d.kind.Name()), "", id, d.key)
+	var ps datastore.PropertyList
+	if err := storage.Get(d.ctx, key, &ps); err != nil {
+		return kind.Revision{}, err
+	}
+	return d.revision(key, ps)
+}
+
+// Loads revision properties into a copy of the document.
+func (d *document) revision(key *datastore.Key, ps datastore.PropertyList) (kind.Revision, error) {
+	rev := kind.Revision{ID: key.IntID()}
+	doc := d.Copy().(*document)
+	doc.hasInputData = false
+	m := *d.meta
+	doc.meta = &m
+
+	var props datastore.PropertyList
+	for _, p := range ps {
+		switch p.Name {
+		case changedAtProperty:
+			rev.ChangedAt, _ = p.Value.(time.Time)
+		case changedByProperty:
+			rev.ChangedBy, _ = p.Value.(*datastore.Key)
+		case updatedAtProperty:
+			m.value.UpdatedAt, _ = p.Value.(time.Time)
+		default:
+			props = append(props, p)
+		}
+	}
+	if err := doc.Load(props); err != nil {
+		if _, ok := err.(*datastore.ErrFieldMismatch); !ok {
+			return rev, err
+		}
+	}
+	rev.Doc = doc
+	return rev, doc.Loaded()
+}
+
+// Diff returns JSON Patch operations that change value of from into value of to.
+func (c *Collection) Diff(from, to kind.Doc) ([]kind.Operation, error) {
+	a, err := toTree(c, from.Value())
+	if err != nil {
+		return nil, err
+	}
+	b, err := toTree(c, to.Value())
+	if err != nil {
+		return nil, err
+	}
+	var ops = []kind.Operation{}
+	return ops, diff(&ops, nil, a, b)
+}
+
+// appends operations for differences between JSON trees a and b at path
+func diff(ops *[]kind.Operation, path []string, a, b interface{}) error {
+	op := func(name string, path []string, value interface{}) error {
+		o := kind.Operation{Op: name, Path: pointer(path)}
+		if name != op_remove {
+			var err error
+			if o.Value, err = json.Marshal(value); err != nil {
+				return err
+			}
+		}
+		*ops = append(*ops, o)
+		return nil
+	}
+	child := func(token string) []string {
+		return append(append([]string{}, path...), token)
+	}
+
+	switch x := a.(type) {
+	case map[string]interface{}:
+		y, ok := b.(map[string]interface{})
+		if !ok {
+			break
+		}
+		var names []string
+		for name := range x {
+			names = append(names, name)
+		}
+		for name := range y {
+			if _, ok := x[name]; !ok {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			xv, inX := x[name]
+			yv, inY := y[name]
+			var err error
+			switch {
+			case !inY:
+				err = op(op_remove, child(name), nil)
+			case !inX:
+				err = op(op_add, child(name), yv)
+			default:
+				err = diff(ops, child(name), xv, yv)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	case []interface{}:
+		y, ok := b.([]interface{})
+		if !ok {
+			break
+		}
+		n := len(x)
+		if len(y) < n {
+			n = len(y)
+		}
+		for i := 0; i < n; i++ {
+			if err := diff(ops, child(strconv.Itoa(i)), x[i], y[i]); err != nil {
+				return err
+			}
+		}
+		// extra items are removed from the end, so indexes stay valid
+		for i := len(x) - 1; i >= n; i-- {
+			if err := op(op_remove, child(strconv.Itoa(i)), nil); err != nil {
+				return err
+			}
+		}
+		for i := n; i < len(y); i++ {
+			if err := op(op_add, child(strconv.Itoa(i)), y[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if equal(a, b) {
+		return nil
+	}
+	return op(op_replace, path, b)
+}
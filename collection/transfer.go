@@ -0,0 +1,300 @@
+package collection
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/ales6164/apis/kind"
+	"github.com/ales6164/apis/storage"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"io"
+	"reflect"
+	"time"
+)
+
+// Documents are exported and imported in chunks of this size.
+const transferChunk = 100
+
+// Longest accepted import line.
+const maxRecordSize = 2 << 20
+
+var errNoDocument = errors.New("document of this collection is required")
+
+/*
+Export writes every document of the collection at the level of doc as NDJSON, one kind.Record
+per line. Fields hidden from JSON aren't exported.
+*/
+func (c *Collection) Export(doc kind.Doc, w io.Writer) error {
+	d, ok := doc.(*document)
+	if !ok || d.meta == nil {
+		return errNoDocument
+	}
+	enc := json.NewEncoder(w)
+	t := storage.NewQuery(c.name).Run(d.ctx)
+	for {
+		var keys []*datastore.Key
+		var values []reflect.Value
+		for len(keys) < transferChunk {
+			v := reflect.New(c.t)
+			key, err := t.Next(v.Interface())
+			if err == datastore.Done {
+				break
+			}
+			if err != nil {
+				if _, ok := err.(*datastore.ErrFieldMismatch); !ok {
+					return err
+				}
+			}
+			keys = append(keys, key)
+			values = append(values, v)
+		}
+		if len(keys) == 0 {
+			return nil
+		}
+
+		metas, err := c.getMetas(d, keys)
+		if err != nil {
+			return err
+		}
+		for i, key := range keys {
+			if c.hasReadHooks() {
+				doc := d.Copy().(*document)
+				doc.key, doc.value = key, values[i]
+				if err = doc.Loaded(); err != nil {
+					return err
+				}
+				values[i] = doc.value
+			}
+			r := kind.Record{
+				Name:      key.StringID(),
+				IntID:     key.IntID(),
+				GroupID:   metas[i].GroupId,
+				MetaID:    metas[i].Id,
+				CreatedAt: metas[i].CreatedAt,
+				UpdatedAt: metas[i].UpdatedAt,
+			}
+			if r.Value, err = json.Marshal(values[i].Interface()); err != nil {
+				return err
+			}
+			if err = enc.Encode(r); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// Loads meta of keys; missing meta is left empty.
+func (c *Collection) getMetas(d *document, keys []*datastore.Key) ([]metaValue, error) {
+	var metaKeys = make([]*datastore.Key, len(keys))
+	for i, key := range keys {
+		metaKeys[i] = metaKeyOf(d.defaultCtx, c.name, key, d.meta.groupKey)
+	}
+	var metas = make([]metaValue, len(keys))
+	err := storage.GetMulti(d.defaultCtx, metaKeys, metas)
+	if errs, ok := err.(appengine.MultiError); ok {
+		for _, err := range errs {
+			if err != nil && err != datastore.ErrNoSuchEntity {
+				return nil, err
+			}
+		}
+		return metas, nil
+	}
+	return metas, err
+}
+
+/*
+Import reads NDJSON written by Export into the collection at the level of doc. Documents keep
+their ids, timestamps and meta ids, so nested collections can be imported after them. Group is
+the one of doc. Fields hidden from JSON keep their stored values. Importing member gets full
+control of created documents like with POST.
+
+Every chunk is written without a transaction: entities first, then meta and the counter.
+Lines that can't be imported are reported and skipped.
+*/
+func (c *Collection) Import(doc kind.Doc, r io.Reader, mode kind.ImportMode) (kind.ImportResult, error) {
+	var result kind.ImportResult
+	d, ok := doc.(*document)
+	if !ok || d.meta == nil {
+		return result, errNoDocument
+	}
+	switch mode {
+	case kind.ImportUpsert, kind.ImportInsert, kind.ImportReplace:
+	default:
+		return result, fmt.Errorf("unknown import mode %q", mode)
+	}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxRecordSize)
+	var line int
+	for {
+		var records []kind.Record
+		var lines []int
+		for len(records) < transferChunk && scanner.Scan() {
+			line++
+			if len(scanner.Bytes()) == 0 {
+				continue
+			}
+			var rec kind.Record
+			err := json.Unmarshal(scanner.Bytes(), &rec)
+			if err == nil && (len(rec.Name) > 0) == (rec.IntID != 0) {
+				err = errors.New("record needs either name or intId")
+			}
+			if err != nil {
+				result.Errors = append(result.Errors, kind.ImportError{Line: line, Error: err.Error()})
+				continue
+			}
+			records = append(records, rec)
+			lines = append(lines, line)
+		}
+		if err := scanner.Err(); err != nil {
+			return result, err
+		}
+		if len(records) == 0 {
+			return result, nil
+		}
+		if err := c.importChunk(d, records, lines, mode, &result); err != nil {
+			return result, err
+		}
+	}
+}
+
+func (c *Collection) importChunk(d *document, records []kind.Record, lines []int, mode kind.ImportMode, result *kind.ImportResult) error {
+	var keys = make([]*datastore.Key, len(records))
+	var stored = make([]interface{}, len(records))
+	var recordMetaKeys = make([]*datastore.Key, len(records))
+	var storedMetas = make([]*metaValue, len(records))
+	for i, rec := range records {
+		keys[i] = datastore.NewKey(d.ctx, c.name, rec.Name, rec.IntID, nil)
+		stored[i] = reflect.New(c.t).Interface()
+		recordMetaKeys[i] = metaKeyOf(d.defaultCtx, c.name, keys[i], d.meta.groupKey)
+		storedMetas[i] = new(metaValue)
+	}
+	var exists = make([]bool, len(records))
+	err := storage.GetMulti(d.ctx, keys, stored)
+	errs, _ := err.(appengine.MultiError)
+	if err != nil && errs == nil {
+		return err
+	}
+	for i := range records {
+		exists[i] = true
+		if errs != nil && errs[i] != nil {
+			if errs[i] == datastore.ErrNoSuchEntity {
+				exists[i] = false
+			} else if _, ok := errs[i].(*datastore.ErrFieldMismatch); !ok {
+				return errs[i]
+			}
+		}
+	}
+	// meta of existing documents keeps what records don't give, like the id their nested
+	// collections are stored under
+	err = storage.GetMulti(d.defaultCtx, recordMetaKeys, storedMetas)
+	metaErrs, _ := err.(appengine.MultiError)
+	if err != nil && metaErrs == nil {
+		return err
+	}
+	for i := range records {
+		if metaErrs != nil && metaErrs[i] != nil {
+			if metaErrs[i] != datastore.ErrNoSuchEntity {
+				return metaErrs[i]
+			}
+			storedMetas[i] = nil
+		}
+	}
+
+	var putKeys, metaKeys, roleKeys, roleDocs []*datastore.Key
+	var values, metas []interface{}
+	var created, updated int
+	var written = map[string]bool{}
+	for i, rec := range records {
+		// repeated key overwrites the one written before
+		if written[keys[i].Encode()] {
+			exists[i] = true
+		}
+		if (mode == kind.ImportInsert && exists[i]) || (mode == kind.ImportReplace && !exists[i]) {
+			result.Skipped++
+			continue
+		}
+		// documents in trash are restored, not overwritten
+		if storedMetas[i] != nil && !storedMetas[i].DeletedAt.IsZero() {
+			result.Errors = append(result.Errors, kind.ImportError{Line: lines[i], Error: kind.ErrInTrash.Error()})
+			continue
+		}
+		v := reflect.New(c.t)
+		if err := json.Unmarshal(rec.Value, v.Interface()); err != nil {
+			result.Errors = append(result.Errors, kind.ImportError{Line: lines[i], Error: err.Error()})
+			continue
+		}
+		if exists[i] {
+			copyHiddenFields(v.Elem(), reflect.ValueOf(stored[i]).Elem())
+			updated++
+		} else {
+			created++
+			if d.member != nil {
+				roleKeys = append(roleKeys, datastore.NewKey(d.defaultCtx, "_groupRelationship", keys[i].Encode(), 0, d.member))
+				roleDocs = append(roleDocs, keys[i])
+			}
+		}
+
+		m := &metaValue{GroupId: d.meta.value.GroupId}
+		if exists[i] && storedMetas[i] != nil {
+			m = storedMetas[i]
+		}
+		if !rec.CreatedAt.IsZero() {
+			m.CreatedAt = rec.CreatedAt
+		} else if m.CreatedAt.IsZero() {
+			m.CreatedAt = time.Now()
+		}
+		if !rec.UpdatedAt.IsZero() {
+			m.UpdatedAt = rec.UpdatedAt
+		} else if exists[i] {
+			m.UpdatedAt = time.Now()
+		} else {
+			m.UpdatedAt = m.CreatedAt
+		}
+		if len(rec.MetaID) > 0 {
+			m.Id = rec.MetaID
+		} else if len(m.Id) == 0 {
+			m.Id = RandStringBytesMaskImprSrc(LetterNumberBytes, 6)
+		}
+		written[keys[i].Encode()] = true
+		putKeys = append(putKeys, keys[i])
+		values = append(values, v.Interface())
+		metaKeys = append(metaKeys, recordMetaKeys[i])
+		metas = append(metas, m)
+	}
+	if len(putKeys) == 0 {
+		return nil
+	}
+
+	if _, err := storage.PutMulti(d.ctx, putKeys, values); err != nil {
+		return err
+	}
+	if _, err := storage.PutMulti(d.defaultCtx, metaKeys, metas); err != nil {
+		return err
+	}
+	if d.member != nil && len(roleKeys) > 0 {
+		var roles = make([]*GroupRelationship, len(roleKeys))
+		for i := range roles {
+			// Document lets Delete remove the relationship. Imports before it was set left
+			// relationships that outlive their documents.
+			roles[i] = &GroupRelationship{Roles: []string{FullControl}, Document: roleDocs[i]}
+		}
+		if _, err := storage.PutMulti(d.defaultCtx, roleKeys, roles); err != nil {
+			return err
+		}
+	}
+	if created > 0 {
+		err := storage.RunInTransaction(d.ctx, func(tc context.Context) error {
+			return c.incrementBy(tc, created)
+		}, &datastore.TransactionOptions{XG: true})
+		if err != nil {
+			return err
+		}
+	}
+	result.Created += created
+	result.Updated += updated
+	return nil
+}
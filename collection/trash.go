@@ -0,0 +1,266 @@
+package collection
+
+import (
+	"errors"
+	"github.com/ales6164/apis/kind"
+	"github.com/ales6164/apis/storage"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"reflect"
+	"time"
+)
+
+// DefaultTrashRetention is used by collections with soft delete and no TrashRetention.
+const DefaultTrashRetention = 30 * 24 * time.Hour
+
+// Stored on entities in trash; used to order them.
+const deletedAtProperty = "_deletedAt"
+
+// Documents in trash are kept in their namespace under this kind.
+func trashKind(name string) string {
+	return "_trash_" + name
+}
+
+func (d *document) trashKey() *datastore.Key {
+	return datastore.NewKey(d.ctx, trashKind(d.kind.Name()), d.key.StringID(), d.key.IntID(), nil)
+}
+
+func withoutDeletedAt(ps datastore.PropertyList) datastore.PropertyList {
+	var out datastore.PropertyList
+	for _, p := range ps {
+		if p.Name != deletedAtProperty {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+/*
+Moves document to trash. Meta is kept with the deletion time, so the document keeps its group
+and id while in trash. Trashed documents aren't counted.
+*/
+func (d *document) trash() error {
+	if d.meta.key == nil {
+		d.meta.key = metaKey(d.defaultCtx, d, d.meta.groupKey)
+	}
+	err := storage.RunInTransaction(d.ctx, func(tc context.Context) error {
+		d.value = reflect.New(d.Type())
+		err := storage.Get(tc, d.key, d)
+		if err != nil {
+			if err == datastore.ErrNoSuchEntity && len(d.ifMatch) > 0 {
+				return kind.ErrPreconditionFailed
+			}
+			if _, ok := err.(*datastore.ErrFieldMismatch); !ok {
+				return err
+			}
+		}
+		if err = d.checkETag(tc); err != nil {
+			return err
+		}
+		if err = d.trigger(tc, BeforeDelete); err != nil {
+			return err
+		}
+
+		now := time.Now()
+		ps := append(datastore.PropertyList{}, d.rollbackProperties...)
+		ps = append(ps, datastore.Property{Name: deletedAtProperty, Value: now})
+		if _, err = storage.Put(tc, d.trashKey(), &ps); err != nil {
+			return err
+		}
+		if err = storage.Delete(tc, d.key); err != nil {
+			return err
+		}
+		d.meta.value.DeletedAt = now
+		if err = d.meta.Save(tc, d, d.meta.group); err != nil {
+			return err
+		}
+		return d.kind.Decrement(tc)
+	}, &datastore.TransactionOptions{XG: true})
+	if err != nil {
+		return err
+	}
+	return d.triggerAfter(AfterDelete)
+}
+
+// Restore moves the document back from trash. Documents that aren't in trash are ErrNoSuchEntity,
+// ErrEntityAlreadyExists if a document was written under the key meanwhile.
+func (d *document) Restore() (kind.Doc, error) {
+	if d.key == nil || d.key.Incomplete() {
+		return d, errors.New("can't restore undefined key")
+	}
+	if d.meta.key == nil {
+		d.meta.key = metaKey(d.defaultCtx, d, d.meta.groupKey)
+	}
+	err := storage.RunInTransaction(d.ctx, func(tc context.Context) error {
+		var ps datastore.PropertyList
+		if err := storage.Get(tc, d.trashKey(), &ps); err != nil {
+			return err
+		}
+		if err := storage.Get(tc, d.key, &datastore.PropertyList{}); err == nil {
+			return kind.ErrEntityAlreadyExists
+		} else if err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		ps = withoutDeletedAt(ps)
+		if _, err := storage.Put(tc, d.key, &ps); err != nil {
+			return err
+		}
+		if err := storage.Delete(tc, d.trashKey()); err != nil {
+			return err
+		}
+		d.value = reflect.New(d.Type())
+		if err := d.Load(ps); err != nil {
+			if _, ok := err.(*datastore.ErrFieldMismatch); !ok {
+				return err
+			}
+		}
+		d.meta.value.DeletedAt = time.Time{}
+		if err := d.meta.Save(tc, d, d.meta.group); err != nil {
+			return err
+		}
+		return d.kind.Increment(tc)
+	}, &datastore.TransactionOptions{XG: true})
+	return d, err
+}
+
+// Trash lists documents in trash at the level of doc, most recently deleted first.
+func (c *Collection) Trash(doc kind.Doc, cursor string, limit int) ([]kind.Doc, string, error) {
+	d, ok := doc.(*document)
+	if !ok || d.meta == nil {
+		return nil, "", errNoDocument
+	}
+	q := storage.NewQuery(trashKind(c.name)).Order("-" + deletedAtProperty).Limit(limit + 1)
+	if len(cursor) > 0 {
+		q = q.Start(cursor)
+	}
+	t := q.Run(d.ctx)
+	var docs []kind.Doc
+	for {
+		var ps datastore.PropertyList
+		if len(docs) == limit {
+			// next page starts after the last returned document, if there's one more
+			next, err := t.Cursor()
+			if err != nil {
+				return nil, "", err
+			}
+			if _, err = t.Next(&ps); err == datastore.Done {
+				return docs, "", nil
+			} else if _, ok := err.(*datastore.ErrFieldMismatch); err != nil && !ok {
+				return nil, "", err
+			}
+			return docs, next, nil
+		}
+		key, err := t.Next(&ps)
+		if err == datastore.Done {
+			return docs, "", nil
+		}
+		if err != nil {
+			return nil, "", err
+		}
+		item, err := NewDoc(d.defaultCtx, c, datastore.NewKey(d.ctx, c.name, key.StringID(), key.IntID(), nil), d.ancestor)
+		if err != nil {
+			return nil, "", err
+		}
+		if err = item.Load(withoutDeletedAt(ps)); err != nil {
+			if _, ok := err.(*datastore.ErrFieldMismatch); !ok {
+				return nil, "", err
+			}
+		}
+		if err = item.Loaded(); err != nil {
+			return nil, "", err
+		}
+		docs = append(docs, item)
+	}
+}
+
+/*
+Purge removes documents that were in trash longer than TrashRetention, together with their
+meta, revisions and relationships. It returns the number of removed documents. Run it periodically, for
+example from a cron handler.
+*/
+func (c *Collection) Purge(ctx context.Context) (int, error) {
+	retention := c.TrashRetention
+	if retention <= 0 {
+		retention = DefaultTrashRetention
+	}
+	q := storage.NewQuery("_meta_"+c.name).
+		Filter("DeletedAt >", time.Time{}).
+		Filter("DeletedAt <", time.Now().Add(-retention)).
+		KeysOnly()
+	var metaKeys []*datastore.Key
+	t := q.Run(ctx)
+	for {
+		key, err := t.Next(nil)
+		if err == datastore.Done {
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+		metaKeys = append(metaKeys, key)
+	}
+
+	var purged int
+	for _, metaKey := range metaKeys {
+		var removed *datastore.Key
+		err := storage.RunInTransaction(ctx, func(tc context.Context) error {
+			removed = nil
+			var m metaValue
+			if err := storage.Get(tc, metaKey, &m); err != nil {
+				if err == datastore.ErrNoSuchEntity {
+					return nil
+				}
+				return err
+			}
+			// restored in the meantime
+			if m.DeletedAt.IsZero() {
+				return nil
+			}
+			nsCtx, err := appengine.Namespace(tc, m.GroupId)
+			if err != nil {
+				return err
+			}
+			trashKey := datastore.NewKey(nsCtx, trashKind(c.name), metaKey.StringID(), metaKey.IntID(), nil)
+			if err = storage.DeleteMulti(tc, []*datastore.Key{trashKey, metaKey}); err != nil {
+				return err
+			}
+			removed = datastore.NewKey(nsCtx, c.name, metaKey.StringID(), metaKey.IntID(), nil)
+			return deleteRevisions(tc, c.name, removed)
+		}, &datastore.TransactionOptions{XG: true})
+		if err != nil {
+			return purged, err
+		}
+		if removed == nil {
+			continue
+		}
+		if err = deleteRelationships(ctx, removed); err != nil {
+			return purged, err
+		}
+		purged++
+	}
+	return purged, nil
+}
+
+// Removes roles members have on the document with key. Query can't run in a transaction, so
+// inside batches it runs after the commit.
+func deleteRelationships(ctx context.Context, key *datastore.Key) error {
+	return storage.AfterCommit(ctx, func(ctx context.Context) error {
+		var keys []*datastore.Key
+		t := storage.NewQuery("_groupRelationship").Filter("Document =", key).KeysOnly().Run(ctx)
+		for {
+			k, err := t.Next(nil)
+			if err == datastore.Done {
+				break
+			}
+			if err != nil {
+				return err
+			}
+			keys = append(keys, k)
+		}
+		if len(keys) == 0 {
+			return nil
+		}
+		return storage.DeleteMulti(ctx, keys)
+	})
+}
@@ -1,9 +1,9 @@
 package collection
 
 import (
+	"github.com/ales6164/apis/storage"
 	"golang.org/x/net/context"
 	"google.golang.org/appengine"
-	"google.golang.org/appengine/search"
 	"math/rand"
 	"net/http"
 	"regexp"
@@ -42,25 +42,12 @@ func RandStringBytesMaskImprSrc(letterBytes string, n int) string {
 
 // clears search index
 func ClearIndex(ctx context.Context, indexName string) error {
-	index, err := search.Open(indexName)
+	index := storage.IndexFromContext(ctx)
+	ids, err := index.List(ctx, indexName)
 	if err != nil {
 		return err
 	}
-
-	var ids []string
-	for t := index.List(ctx, &search.ListOptions{IDsOnly: true}); ; {
-		var doc interface{}
-		id, err := t.Next(&doc)
-		if err == search.Done {
-			break
-		}
-		if err != nil {
-			return err
-		}
-		ids = append(ids, id)
-	}
-
-	return index.DeleteMulti(ctx, ids)
+	return index.DeleteMulti(ctx, indexName, ids)
 }
 
 
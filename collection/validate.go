@@ -0,0 +1,278 @@
+package collection
+
+import (
+	"fmt"
+	"github.com/ales6164/apis/kind"
+	"github.com/asaskevich/govalidator"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Validator checks value of a field with a custom rule. Parent is the struct holding the field.
+type Validator func(value interface{}, parent interface{}) bool
+
+// Validators every collection has, next to the ones of govalidator.
+var validators = map[string]Validator{
+	"slug": IsSlug,
+}
+
+// IsSlug reports if value is a string of word characters and dashes that starts and ends
+// with a letter or a digit.
+func IsSlug(value interface{}, parent interface{}) bool {
+	switch v := value.(type) {
+	case string:
+		if len(v) > 0 && govalidator.Matches(v, `^[\w-]+$`) && govalidator.IsAlphanumeric(v[:1]) && govalidator.IsAlphanumeric(v[len(v)-1:]) {
+			return true
+		}
+	}
+	return false
+}
+
+// RegisterValidator adds rule name for valid tags of the collection. It overrides built-in
+// rules with the same name. It panics if name can't be used in tags.
+func (c *Collection) RegisterValidator(name string, v Validator) *Collection {
+	if len(name) == 0 || strings.ContainsAny(name, ", ") || v == nil {
+		panic(fmt.Errorf("invalid validator %q", name))
+	}
+	if c.validators == nil {
+		c.validators = map[string]Validator{}
+	}
+	c.validators[name] = v
+	delete(c.unknownRules, name)
+	return c
+}
+
+// Rules of a field from its valid tag.
+type fieldRules struct {
+	index int
+	name  string // JSON name
+	rules []string
+}
+
+/*
+Parses valid tags of typ and of the structs its fields hold. Rules that aren't known are kept
+in c.unknownRules until they're registered with RegisterValidator; CheckRules reports the
+ones that are left.
+*/
+func (c *Collection) parseRules(typ reflect.Type) []fieldRules {
+	for typ.Kind() == reflect.Ptr || typ.Kind() == reflect.Slice || typ.Kind() == reflect.Array {
+		typ = typ.Elem()
+	}
+	if typ.Kind() != reflect.Struct || typ == timeType {
+		return nil
+	}
+	if rules, ok := c.rules[typ]; ok {
+		return rules
+	}
+	var rules []fieldRules
+	c.rules[typ] = nil // recursive types
+	for i := 0; i < typ.NumField(); i++ {
+		structField := typ.Field(i)
+		if len(structField.PkgPath) > 0 {
+			continue
+		}
+		f := fieldRules{index: i, name: structField.Name}
+		if val, ok := structField.Tag.Lookup("json"); ok {
+			if n := strings.TrimSpace(strings.Split(val, ",")[0]); n == "-" {
+				continue
+			} else if len(n) > 0 {
+				f.name = n
+			}
+		}
+		if tag := structField.Tag.Get("valid"); len(tag) > 0 && tag != "-" {
+			for _, rule := range strings.Split(tag, ",") {
+				rule = strings.TrimSpace(rule)
+				if len(rule) == 0 || rule == "optional" {
+					continue
+				}
+				if rule != "required" && !c.knownRule(rule) {
+					c.unknownRules[rule] = true
+				}
+				f.rules = append(f.rules, rule)
+			}
+		}
+		c.parseRules(structField.Type)
+		rules = append(rules, f)
+	}
+	c.rules[typ] = rules
+	return rules
+}
+
+func (c *Collection) knownRule(rule string) bool {
+	if _, ok := c.validators[rule]; ok {
+		return true
+	}
+	if _, ok := validators[rule]; ok {
+		return true
+	}
+	if _, ok := govalidator.TagMap[rule]; ok {
+		return true
+	}
+	for _, re := range govalidator.ParamTagRegexMap {
+		if re.MatchString(rule) {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckRules reports rules of valid tags that are neither built in nor registered.
+func (c *Collection) CheckRules() error {
+	var names []string
+	for name := range c.unknownRules {
+		names = append(names, strconv.Quote(name))
+	}
+	if len(names) == 0 {
+		return nil
+	}
+	sort.Strings(names)
+	return fmt.Errorf("collection %s has unknown validators %s", c.name, strings.Join(names, ", "))
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// Checks value of the document after before-hooks changed it.
+func (d *document) validate() error {
+	c, ok := d.kind.(*Collection)
+	if !ok {
+		return nil
+	}
+	return c.validate(d.value)
+}
+
+/*
+Checks value against valid tags of its fields, like `valid:"required,email,length(3|64)"`.
+Rules are govalidator tags and validators of the collection, parsed by New. Empty fields are
+only checked by required. Rules of slices apply to their items, nested structs are checked too. Broken rules
+are returned as *kind.ValidationError.
+*/
+func (c *Collection) validate(value reflect.Value) error {
+	var fieldErrors []kind.FieldError
+	if err := c.validateStruct(&fieldErrors, nil, value); err != nil {
+		return err
+	}
+	if len(fieldErrors) > 0 {
+		return &kind.ValidationError{Errors: fieldErrors}
+	}
+	return nil
+}
+
+func (c *Collection) validateStruct(fieldErrors *[]kind.FieldError, path []string, value reflect.Value) error {
+	for value.Kind() == reflect.Ptr {
+		if value.IsNil() {
+			return nil
+		}
+		value = value.Elem()
+	}
+	if value.Kind() != reflect.Struct || value.Type() == timeType {
+		return nil
+	}
+	for _, f := range c.rules[value.Type()] {
+		fieldPath := append(append([]string{}, path...), f.name)
+		field := value.Field(f.index)
+
+		for _, rule := range f.rules {
+			if rule == "required" {
+				if isEmpty(field) {
+					*fieldErrors = append(*fieldErrors, kind.FieldError{Path: pointer(fieldPath), Rule: rule})
+				}
+				continue
+			}
+			if err := c.checkRule(fieldErrors, fieldPath, rule, field, value); err != nil {
+				return err
+			}
+		}
+
+		// nested values
+		switch field.Kind() {
+		case reflect.Slice, reflect.Array:
+			for j := 0; j < field.Len(); j++ {
+				if err := c.validateStruct(fieldErrors, append(append([]string{}, fieldPath...), strconv.Itoa(j)), field.Index(j)); err != nil {
+					return err
+				}
+			}
+		default:
+			if err := c.validateStruct(fieldErrors, fieldPath, field); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Checks rule on field, or on its items if it's a slice. Empty values pass.
+func (c *Collection) checkRule(fieldErrors *[]kind.FieldError, path []string, rule string, field reflect.Value, parent reflect.Value) error {
+	if (field.Kind() == reflect.Slice && field.Type().Elem().Kind() != reflect.Uint8) || field.Kind() == reflect.Array {
+		for j := 0; j < field.Len(); j++ {
+			if err := c.checkRule(fieldErrors, append(append([]string{}, path...), strconv.Itoa(j)), rule, field.Index(j), parent); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if isEmpty(field) {
+		return nil
+	}
+	ok, err := c.check(rule, field, parent)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		*fieldErrors = append(*fieldErrors, kind.FieldError{Path: pointer(path), Rule: rule})
+	}
+	return nil
+}
+
+// Reports if field passes rule. Unknown rules are an error.
+func (c *Collection) check(rule string, field reflect.Value, parent reflect.Value) (bool, error) {
+	v, ok := c.validators[rule]
+	if !ok {
+		v, ok = validators[rule]
+	}
+	if ok {
+		return v(field.Interface(), parent.Interface()), nil
+	}
+
+	str, isString := toString(field)
+	if f, ok := govalidator.TagMap[rule]; ok {
+		return isString && f(str), nil
+	}
+	for name, re := range govalidator.ParamTagRegexMap {
+		if m := re.FindStringSubmatch(rule); len(m) > 0 {
+			return isString && govalidator.ParamTagMap[name](str, m[1:]...), nil
+		}
+	}
+	return false, fmt.Errorf("unknown validator %q", rule)
+}
+
+// String form of values built-in rules can check.
+func toString(value reflect.Value) (string, bool) {
+	for value.Kind() == reflect.Ptr || value.Kind() == reflect.Interface {
+		if value.IsNil() {
+			return "", false
+		}
+		value = value.Elem()
+	}
+	switch value.Kind() {
+	case reflect.String:
+		return value.String(), true
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64, reflect.Bool:
+		return fmt.Sprint(value.Interface()), true
+	}
+	return "", false
+}
+
+func isEmpty(value reflect.Value) bool {
+	switch value.Kind() {
+	case reflect.Slice, reflect.Map, reflect.String, reflect.Array:
+		return value.Len() == 0
+	case reflect.Ptr, reflect.Interface:
+		return value.IsNil()
+	}
+	return value.IsZero()
+}
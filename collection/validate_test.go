@@ -0,0 +1,60 @@
+package collection
+
+import (
+	"reflect"
+	"testing"
+)
+
+type ruleAddress struct {
+	City string `json:"city" valid:"required"`
+	Zip  string `json:"zip" valid:"numeric,even"`
+}
+
+type ruled struct {
+	Name      string        `json:"name" valid:"required,length(3|16)"`
+	Slug      string        `json:"slug" valid:"slug"`
+	Email     string        `json:"email" valid:"email,optional"`
+	Address   ruleAddress   `json:"address"`
+	Addresses []ruleAddress `json:"addresses"`
+	Tags      []string      `json:"tags" valid:"alpha"`
+	Ignored   string        `json:"-" valid:"required"`
+}
+
+func TestParseRules(t *testing.T) {
+	c := New("ruled", ruled{})
+	if err := c.CheckRules(); err == nil || err.Error() != `collection ruled has unknown validators "even"` {
+		t.Fatalf("rules are checked with %v", err)
+	}
+	want := []fieldRules{
+		{0, "name", []string{"required", "length(3|16)"}},
+		{1, "slug", []string{"slug"}},
+		{2, "email", []string{"email"}},
+		{3, "address", nil},
+		{4, "addresses", nil},
+		{5, "tags", []string{"alpha"}},
+	}
+	if got := c.rules[reflect.TypeOf(ruled{})]; !reflect.DeepEqual(got, want) {
+		t.Errorf("rules are %+v", got)
+	}
+	if got := c.rules[reflect.TypeOf(ruleAddress{})]; len(got) != 2 || got[1].rules[1] != "even" {
+		t.Errorf("rules of nested struct are %+v", got)
+	}
+
+	c.RegisterValidator("even", func(value interface{}, parent interface{}) bool { return true })
+	if err := c.CheckRules(); err != nil {
+		t.Fatalf("rules after registering are checked with %v", err)
+	}
+}
+
+func TestRegisterInvalidValidator(t *testing.T) {
+	for _, name := range []string{"", "a,b", "a b"} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("validator %q is registered", name)
+				}
+			}()
+			New("invalid", ruled{}).RegisterValidator(name, IsSlug)
+		}()
+	}
+}
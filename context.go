@@ -1,13 +1,16 @@
 package apis
 
 import (
-	"encoding/json"
+	"fmt"
+	"github.com/ales6164/apis/kind"
+	"github.com/ales6164/apis/storage"
 	"github.com/dgrijalva/jwt-go"
 	"golang.org/x/net/context"
 	"google.golang.org/appengine"
 	"google.golang.org/appengine/datastore"
 	"google.golang.org/appengine/log"
 	"io/ioutil"
+	stdlog "log"
 	"net/http"
 )
 
@@ -16,16 +19,22 @@ type Context struct {
 	a                    *Apis
 	r                    *http.Request
 	w                    http.ResponseWriter
-	hasReadBody          bool
-	body                 []byte
+	body                 *requestBody
 	session              *Session
 	hasIncludeMetaHeader bool
 	authError            error
 	sessError            error
+	requestID            string
+	mediaType            string    // of the response, see negotiate
+	kind                 kind.Kind // of the requested document; gives columns of CSV
+	atomic               bool      // serves operation of an atomic batch
 }
 
 func (a *Apis) NewContext(w http.ResponseWriter, r *http.Request) (ctx Context) {
-	ctx = Context{Context: appengine.NewContext(r), w: w, r: r, a: a, hasIncludeMetaHeader: len(r.Header.Get("X-Include-Meta")) > 0}
+	ctx = Context{Context: a.storageContext(appengine.NewContext(r)), w: w, r: r, a: a, body: new(requestBody), hasIncludeMetaHeader: len(r.Header.Get("X-Include-Meta")) > 0}
+	ctx.requestID = requestID(r)
+	ctx.mediaType, _ = negotiate(r.Header.Get("Accept"))
+	w.Header().Set(RequestIDHeader, ctx.requestID)
 	var token *jwt.Token
 	if ctx.a.hasAuth {
 		token, ctx.authError = ctx.a.Auth.middleware.CheckJWT(ctx.w, ctx.r)
@@ -34,6 +43,13 @@ func (a *Apis) NewContext(w http.ResponseWriter, r *http.Request) (ctx Context)
 	return ctx
 }
 
+// attaches configured storage backends
+func (a *Apis) storageContext(ctx context.Context) context.Context {
+	ctx = storage.NewContext(ctx, a.Store)
+	ctx = storage.WithCache(ctx, a.Cache)
+	return storage.WithIndex(ctx, a.Index)
+}
+
 func (ctx Context) HasAccess(rules Rules, scopes ...string) bool {
 	var ruleScopes []string
 	if ctx.session.IsValid {
@@ -61,14 +77,59 @@ func (ctx Context) HasAccess(rules Rules, scopes ...string) bool {
 	return false
 }
 
-// reads body once and stores contents
-func (ctx Context) Body() []byte {
-	if !ctx.hasReadBody {
-		ctx.body, _ = ioutil.ReadAll(ctx.r.Body)
+// WithContext returns copy of the request context that uses c for storage. Collection hooks get
+// it bound to the write transaction.
+func (ctx Context) WithContext(c context.Context) context.Context {
+	ctx.Context = c
+	return ctx
+}
+
+// Request body read once and shared by copies of Context.
+type requestBody struct {
+	read bool
+	data []byte
+	err  error
+}
+
+// BodyError is a request body that can't be converted from its media type to JSON.
+type BodyError struct {
+	MediaType string
+	Err       error
+}
+
+func (e *BodyError) Error() string {
+	return fmt.Sprintf("invalid %s body: %v", e.MediaType, e.Err)
+}
+
+func (e *BodyError) Unwrap() error {
+	return e.Err
+}
+
+// ReadBody reads body once and stores contents. Bodies in other supported media types are
+// converted to JSON; if that fails, the error is *BodyError. Copies of ctx share the contents.
+func (ctx Context) ReadBody() ([]byte, error) {
+	if ctx.body == nil {
+		ctx.body = new(requestBody)
+	}
+	if !ctx.body.read {
+		ctx.body.data, ctx.body.err = ioutil.ReadAll(ctx.r.Body)
 		_ = ctx.r.Body.Close()
-		ctx.hasReadBody = true
+		ctx.body.read = true
+		if mediaType := normalizeMediaType(ctx.r.Header.Get("Content-Type")); ctx.body.err == nil && len(ctx.body.data) > 0 && mediaType != MediaTypeJSON && mediaTypes[mediaType] {
+			if b, err := toJSON(mediaType, ctx.body.data, ctx.kind); err != nil {
+				ctx.body.err = &BodyError{MediaType: mediaType, Err: err}
+			} else {
+				ctx.body.data = b
+			}
+		}
 	}
-	return ctx.body
+	return ctx.body.data, ctx.body.err
+}
+
+// Body is ReadBody without the error, for handlers that parse it as JSON anyway.
+func (ctx Context) Body() []byte {
+	b, _ := ctx.ReadBody()
+	return b
 }
 
 func (ctx Context) Member() *datastore.Key {
@@ -79,12 +140,22 @@ func (ctx Context) ExtendSession(seconds int64) error {
 	return ctx.session.Extend(ctx, seconds)
 }
 
+// App Engine logging needs an App Engine request context
+func (ctx *Context) logf(format string, args ...interface{}) {
+	if appengine.IsAppEngine() || appengine.IsDevAppServer() {
+		log.Errorf(ctx, format, args...)
+		return
+	}
+	stdlog.Printf(format, args...)
+}
+
 /**
 RESPONSE
 */
 
+// PrintJSON responds with result encoded in the media type the request accepts; JSON by default.
 func (ctx *Context) PrintJSON(result interface{}, statusCode int, headerPair ...string) {
-	ctx.w.Header().Set("Content-Type", "application/json")
+	ctx.w.Header().Set("Vary", varyHeader)
 	var headerKey string
 	for i, headerEl := range headerPair {
 		if i%2 == 0 {
@@ -95,19 +166,20 @@ func (ctx *Context) PrintJSON(result interface{}, statusCode int, headerPair ...
 			ctx.w.Header().Set(headerKey, headerEl)
 		}
 	}
-	ctx.w.WriteHeader(statusCode)
-	if err := json.NewEncoder(ctx.w).Encode(result); err != nil {
+	if err := ctx.encode(result, statusCode); err != nil {
 		http.Error(ctx.w, err.Error(), http.StatusInternalServerError)
 	}
 }
 
 func (ctx *Context) PrintStatus(s string, c int, descriptors ...string) {
-	log.Errorf(ctx, "context error: ", descriptors)
+	ctx.logf("context error: %v", descriptors)
 	ctx.w.WriteHeader(c)
 	ctx.w.Write([]byte(s))
 }
 
+// PrintError responds with application/problem+json of status c and detail s. Use
+// PrintProblem for errors, so registered ones get their status and code.
 func (ctx *Context) PrintError(s string, c int, descriptors ...string) {
-	log.Errorf(ctx, "context error: ", descriptors)
-	http.Error(ctx.w, s, c)
+	ctx.logf("context error: %v", descriptors)
+	ctx.printProblem(Problem{Status: c, Detail: s})
 }
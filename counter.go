@@ -0,0 +1,51 @@
+package apis
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/ales6164/apis/kind"
+	"net/http"
+)
+
+/*
+GET /{kind}/_counter shows the counter of the collection next to the number of documents it
+should have. POST /{kind}/_counter reconciles the counter with that number; the body can set
+the number of shards, like {"shards": 80}. Counters are kept per parent, so
+/projects/{id}/objects/_counter is the counter of objects in that project. Needs full control.
+*/
+func serveCounter(ctx Context, rules Rules, document kind.Doc) {
+	if ctx.r.Method != http.MethodGet && ctx.r.Method != http.MethodPost {
+		ctx.PrintError(http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	if ok := checkAccess(ctx, rules, document, FullControl); !ok {
+		return
+	}
+	if ctx.r.Method == http.MethodGet {
+		status, err := document.Kind().Counter(document.Context())
+		if err != nil {
+			ctx.PrintProblem(err, http.StatusInternalServerError)
+			return
+		}
+		ctx.PrintJSON(status, http.StatusOK)
+		return
+	}
+
+	var in struct {
+		Shards int `json:"shards"`
+	}
+	body, err := ctx.ReadBody()
+	if err == nil && len(bytes.TrimSpace(body)) > 0 {
+		err = json.Unmarshal(body, &in)
+	}
+	if err != nil {
+		ctx.PrintProblem(err, http.StatusBadRequest)
+		return
+	}
+	status, err := document.Kind().Reconcile(document.Context(), in.Shards)
+	if err != nil {
+		ctx.PrintProblem(err, http.StatusInternalServerError)
+		return
+	}
+	ctx.PrintJSON(status, http.StatusOK)
+}
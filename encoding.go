@@ -0,0 +1,427 @@
+package apis
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"github.com/ales6164/apis/kind"
+	"github.com/ugorji/go/codec"
+	"io"
+	"mime"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Media types of responses and request bodies besides JSON.
+const (
+	MediaTypeJSON    = "application/json"
+	MediaTypeCSV     = "text/csv"
+	MediaTypeMsgpack = "application/msgpack"
+	MediaTypeCBOR    = "application/cbor"
+	MediaTypeNDJSON  = "application/x-ndjson"
+)
+
+// Other names of the media types.
+var mediaTypeAliases = map[string]string{
+	"application/x-msgpack":    MediaTypeMsgpack,
+	"application/vnd.msgpack":  MediaTypeMsgpack,
+	"application/ndjson":       MediaTypeNDJSON,
+	"application/problem+json": MediaTypeJSON,
+	"*/*":                      MediaTypeJSON,
+	"application/*":            MediaTypeJSON,
+	"text/*":                   MediaTypeCSV,
+	// accepted by _events; its errors are JSON
+	"text/event-stream": MediaTypeJSON,
+}
+
+var supportedMediaTypes = []string{MediaTypeJSON, MediaTypeCSV, MediaTypeMsgpack, MediaTypeCBOR, MediaTypeNDJSON}
+
+var mediaTypes = map[string]bool{}
+
+var (
+	msgpackHandle = &codec.MsgpackHandle{WriteExt: true}
+	cborHandle    = &codec.CborHandle{}
+)
+
+func init() {
+	for _, mediaType := range supportedMediaTypes {
+		mediaTypes[mediaType] = true
+	}
+	mapType := reflect.TypeOf(map[string]interface{}(nil))
+	msgpackHandle.MapType = mapType
+	msgpackHandle.RawToString = true
+	cborHandle.MapType = mapType
+}
+
+func normalizeMediaType(v string) string {
+	mediaType, _, err := mime.ParseMediaType(v)
+	if err != nil {
+		return ""
+	}
+	if alias, ok := mediaTypeAliases[mediaType]; ok {
+		return alias
+	}
+	return mediaType
+}
+
+// Picks media type of the response from Accept header. Reports false if none is supported.
+func negotiate(accept string) (string, bool) {
+	if len(strings.TrimSpace(accept)) == 0 {
+		return MediaTypeJSON, true
+	}
+	var best string
+	var bestQ float64
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		if alias, ok := mediaTypeAliases[mediaType]; ok {
+			mediaType = alias
+		}
+		if !mediaTypes[mediaType] {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+		if q > bestQ {
+			best, bestQ = mediaType, q
+		}
+	}
+	return best, bestQ > 0
+}
+
+// Writes result in the negotiated media type. Other types than JSON are encoded from the JSON
+// form of result, so they have the same members. Results are loaded pages, so NDJSON lists are
+// written at once too; only _export streams documents as it reads them.
+func (ctx *Context) encode(result interface{}, statusCode int) error {
+	if len(ctx.mediaType) == 0 || ctx.mediaType == MediaTypeJSON {
+		ctx.w.Header().Set("Content-Type", MediaTypeJSON)
+		ctx.w.WriteHeader(statusCode)
+		return json.NewEncoder(ctx.w).Encode(result)
+	}
+	tree, err := jsonTree(result)
+	if err != nil {
+		return err
+	}
+	tree = numbers(tree)
+
+	switch ctx.mediaType {
+	case MediaTypeMsgpack, MediaTypeCBOR:
+		var h codec.Handle = msgpackHandle
+		if ctx.mediaType == MediaTypeCBOR {
+			h = cborHandle
+		}
+		var buf bytes.Buffer
+		if err := codec.NewEncoder(&buf, h).Encode(tree); err != nil {
+			return err
+		}
+		ctx.w.Header().Set("Content-Type", ctx.mediaType)
+		ctx.w.WriteHeader(statusCode)
+		_, err = ctx.w.Write(buf.Bytes())
+		return err
+	case MediaTypeNDJSON:
+		items, ok := tree.([]interface{})
+		if !ok {
+			items = []interface{}{tree}
+		}
+		ctx.w.Header().Set("Content-Type", MediaTypeNDJSON)
+		ctx.w.WriteHeader(statusCode)
+		enc := json.NewEncoder(ctx.w)
+		for _, item := range items {
+			if err := enc.Encode(item); err != nil {
+				return err
+			}
+		}
+		return nil
+	case MediaTypeCSV:
+		var buf bytes.Buffer
+		if err := writeCSV(&buf, ctx.kind, tree); err != nil {
+			return err
+		}
+		ctx.w.Header().Set("Content-Type", MediaTypeCSV+"; charset=utf-8")
+		ctx.w.WriteHeader(statusCode)
+		_, err = ctx.w.Write(buf.Bytes())
+		return err
+	}
+	return json.NewEncoder(ctx.w).Encode(tree)
+}
+
+// Converts numbers of JSON tree to int64 or float64, so binary encoders keep integers.
+func numbers(v interface{}) interface{} {
+	switch x := v.(type) {
+	case json.Number:
+		if i, err := x.Int64(); err == nil {
+			return i
+		}
+		f, _ := x.Float64()
+		return f
+	case map[string]interface{}:
+		for k, item := range x {
+			x[k] = numbers(item)
+		}
+	case []interface{}:
+		for i, item := range x {
+			x[i] = numbers(item)
+		}
+	}
+	return v
+}
+
+/*
+Columns of CSV for values of type t. Nested structs are flattened into dotted names, like
+address.city; slices and maps are one column with JSON.
+*/
+func csvColumns(t reflect.Type, prefix string) []string {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	var columns []string
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if len(f.PkgPath) > 0 {
+			continue
+		}
+		name := f.Name
+		if val, ok := f.Tag.Lookup("json"); ok {
+			if n := strings.Split(val, ",")[0]; n == "-" {
+				continue
+			} else if len(n) > 0 {
+				name = n
+			}
+		}
+		ft := f.Type
+		for ft.Kind() == reflect.Ptr && ft != keyType {
+			ft = ft.Elem()
+		}
+		if ft.Kind() == reflect.Struct && ft != timeType {
+			columns = append(columns, csvColumns(ft, prefix+name+".")...)
+			continue
+		}
+		columns = append(columns, prefix+name)
+	}
+	return columns
+}
+
+// Flattens nested objects of item into row with dotted names.
+func flatten(row map[string]interface{}, prefix string, item map[string]interface{}) {
+	for k, v := range item {
+		if m, ok := v.(map[string]interface{}); ok && len(m) > 0 {
+			flatten(row, prefix+k+".", m)
+			continue
+		}
+		row[prefix+k] = v
+	}
+}
+
+func csvCell(v interface{}) string {
+	switch x := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return x
+	case int64:
+		return strconv.FormatInt(x, 10)
+	case float64:
+		return strconv.FormatFloat(x, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(x)
+	}
+	b, _ := json.Marshal(v)
+	return string(b)
+}
+
+/*
+Writes items of tree as CSV with a header row. Columns come from fields of the collection
+in their order; members that aren't fields, like meta, follow sorted by name.
+*/
+func writeCSV(w io.Writer, k kind.Kind, tree interface{}) error {
+	items, ok := tree.([]interface{})
+	if !ok {
+		items = []interface{}{tree}
+	}
+	var rows []map[string]interface{}
+	for _, item := range items {
+		row := map[string]interface{}{}
+		if m, ok := item.(map[string]interface{}); ok {
+			flatten(row, "", m)
+		} else {
+			row["value"] = item
+		}
+		rows = append(rows, row)
+	}
+
+	var columns []string
+	known := map[string]bool{}
+	if k != nil {
+		for _, c := range csvColumns(k.Type(), "") {
+			columns = append(columns, c)
+			known[c] = true
+		}
+	}
+	var extra []string
+	for _, row := range rows {
+		for c := range row {
+			if !known[c] {
+				known[c] = true
+				extra = append(extra, c)
+			}
+		}
+	}
+	sort.Strings(extra)
+	columns = append(columns, extra...)
+
+	cw := csv.NewWriter(w)
+	if err := cw.Write(columns); err != nil {
+		return err
+	}
+	for _, row := range rows {
+		record := make([]string, len(columns))
+		for i, c := range columns {
+			record[i] = csvCell(row[c])
+		}
+		if err := cw.Write(record); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+/*
+Converts request body in MessagePack, CBOR, CSV or NDJSON to JSON. CSV rows and NDJSON lines
+are one object or, if there are more, an array. Dotted CSV headers become nested objects;
+cells of non-string fields are parsed as JSON.
+*/
+func toJSON(mediaType string, body []byte, k kind.Kind) ([]byte, error) {
+	var v interface{}
+	switch mediaType {
+	case MediaTypeMsgpack, MediaTypeCBOR:
+		var h codec.Handle = msgpackHandle
+		if mediaType == MediaTypeCBOR {
+			h = cborHandle
+		}
+		if err := codec.NewDecoderBytes(body, h).Decode(&v); err != nil {
+			return nil, err
+		}
+	case MediaTypeNDJSON:
+		var items []interface{}
+		s := bufio.NewScanner(bytes.NewReader(body))
+		s.Buffer(make([]byte, 64*1024), 16*1024*1024)
+		for s.Scan() {
+			line := bytes.TrimSpace(s.Bytes())
+			if len(line) == 0 {
+				continue
+			}
+			var item interface{}
+			if err := json.Unmarshal(line, &item); err != nil {
+				return nil, err
+			}
+			items = append(items, item)
+		}
+		if err := s.Err(); err != nil {
+			return nil, err
+		}
+		v = items
+		if len(items) == 1 {
+			v = items[0]
+		}
+	case MediaTypeCSV:
+		records, err := csv.NewReader(bytes.NewReader(body)).ReadAll()
+		if err != nil {
+			return nil, err
+		}
+		if len(records) == 0 {
+			return nil, io.ErrUnexpectedEOF
+		}
+		var t reflect.Type
+		if k != nil {
+			t = k.Type()
+		}
+		var items []interface{}
+		for _, record := range records[1:] {
+			item := map[string]interface{}{}
+			for i, column := range records[0] {
+				if i >= len(record) || len(record[i]) == 0 {
+					continue
+				}
+				setPath(item, strings.Split(column, "."), csvValue(t, column, record[i]))
+			}
+			items = append(items, item)
+		}
+		v = items
+		if len(items) == 1 {
+			v = items[0]
+		}
+	default:
+		return body, nil
+	}
+	return json.Marshal(v)
+}
+
+func setPath(m map[string]interface{}, path []string, v interface{}) {
+	for _, name := range path[:len(path)-1] {
+		next, ok := m[name].(map[string]interface{})
+		if !ok {
+			next = map[string]interface{}{}
+			m[name] = next
+		}
+		m = next
+	}
+	m[path[len(path)-1]] = v
+}
+
+// Value of CSV cell for column of values of type t. Strings, times and keys stay text.
+func csvValue(t reflect.Type, column, cell string) interface{} {
+	if ft := fieldType(t, strings.Split(column, ".")); ft != nil {
+		for ft.Kind() == reflect.Ptr && ft != keyType {
+			ft = ft.Elem()
+		}
+		if ft.Kind() == reflect.String || ft == timeType || ft == keyType {
+			return cell
+		}
+	}
+	var v interface{}
+	if err := json.Unmarshal([]byte(cell), &v); err != nil {
+		return cell
+	}
+	return v
+}
+
+// Type of field at path of JSON names, nil if there's none.
+func fieldType(t reflect.Type, path []string) reflect.Type {
+	for _, name := range path {
+		if t == nil {
+			return nil
+		}
+		for t.Kind() == reflect.Ptr {
+			t = t.Elem()
+		}
+		if t.Kind() != reflect.Struct {
+			return nil
+		}
+		var next reflect.Type
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			n := f.Name
+			if val, ok := f.Tag.Lookup("json"); ok {
+				if v := strings.Split(val, ",")[0]; len(v) > 0 {
+					n = v
+				}
+			}
+			if n == name {
+				next = f.Type
+				break
+			}
+		}
+		t = next
+	}
+	return t
+}
@@ -0,0 +1,143 @@
+package apis
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/ugorji/go/codec"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestNegotiate(t *testing.T) {
+	tests := []struct {
+		accept string
+		want   string
+		ok     bool
+	}{
+		{"", MediaTypeJSON, true},
+		{"application/json", MediaTypeJSON, true},
+		{"*/*", MediaTypeJSON, true},
+		{"text/csv", MediaTypeCSV, true},
+		{"text/*", MediaTypeCSV, true},
+		{"application/x-msgpack", MediaTypeMsgpack, true},
+		{"application/cbor, application/json;q=0.5", MediaTypeCBOR, true},
+		{"application/json;q=0.5, application/cbor", MediaTypeCBOR, true},
+		{"text/csv;q=0.2, application/x-ndjson;q=0.8", MediaTypeNDJSON, true},
+		{"application/problem+json", MediaTypeJSON, true},
+		{"text/html, image/png", "", false},
+		{"application/json;q=0", "", false},
+		{"application/json;q=x", "", false},
+	}
+	for _, tt := range tests {
+		got, ok := negotiate(tt.accept)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("negotiate(%q) = %q, %v; want %q, %v", tt.accept, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestCSVColumns(t *testing.T) {
+	got := csvColumns(reflect.TypeOf(product{}), "")
+	want := []string{"id", "name", "price", "stock", "active", "tags", "date", "address.city", "note", "secret"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+}
+
+func TestWriteCSV(t *testing.T) {
+	tree := []interface{}{
+		map[string]interface{}{"name": "a", "price": 1.5, "tags": []interface{}{"x", "y"}, "address": map[string]interface{}{"city": "Ljubljana"}},
+		map[string]interface{}{"name": "b, c", "stock": int64(2), "active": true, "meta": "m"},
+	}
+	var buf bytes.Buffer
+	if err := writeCSV(&buf, products, tree); err != nil {
+		t.Fatal(err)
+	}
+	want := "id,name,price,stock,active,tags,date,address.city,note,secret,meta\n" +
+		`,a,1.5,,,"[""x"",""y""]",,Ljubljana,,,` + "\n" +
+		`,"b, c",,2,true,,,,,,m` + "\n"
+	if got := buf.String(); got != want {
+		t.Fatalf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+// Bodies in other media types convert to the same JSON.
+func TestToJSON(t *testing.T) {
+	want := `{"name":"a","price":1.5,"stock":2,"tags":["x","y"],"address":{"city":"New York"}}`
+	var tree interface{}
+	if err := json.Unmarshal([]byte(want), &tree); err != nil {
+		t.Fatal(err)
+	}
+	encode := func(h codec.Handle) []byte {
+		var b []byte
+		if err := codec.NewEncoderBytes(&b, h).Encode(tree); err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	bodies := map[string][]byte{
+		MediaTypeMsgpack: encode(msgpackHandle),
+		MediaTypeCBOR:    encode(cborHandle),
+		MediaTypeNDJSON:  []byte("\n" + want + "\n"),
+		MediaTypeCSV:     []byte("name,price,stock,tags,address.city\na,1.5,2,\"[\"\"x\"\",\"\"y\"\"]\",New York\n"),
+		MediaTypeJSON:    []byte(want),
+	}
+	for mediaType, body := range bodies {
+		got, err := toJSON(mediaType, body, products)
+		if err != nil {
+			t.Errorf("%s: %v", mediaType, err)
+			continue
+		}
+		if !jsonEqual(string(got), want) {
+			t.Errorf("%s converts to %s", mediaType, got)
+		}
+	}
+
+	// more lines and rows are an array
+	got, err := toJSON(MediaTypeNDJSON, []byte("{\"name\":\"a\"}\n{\"name\":\"b\"}\n"), products)
+	if err != nil || !jsonEqual(string(got), `[{"name":"a"},{"name":"b"}]`) {
+		t.Errorf("NDJSON converts to %s, %v", got, err)
+	}
+	got, err = toJSON(MediaTypeCSV, []byte("name,stock\na,1\nb,\n"), products)
+	if err != nil || !jsonEqual(string(got), `[{"name":"a","stock":1},{"name":"b"}]`) {
+		t.Errorf("CSV converts to %s, %v", got, err)
+	}
+	// string fields stay text
+	got, err = toJSON(MediaTypeCSV, []byte("name\n12\n"), products)
+	if err != nil || !jsonEqual(string(got), `{"name":"12"}`) {
+		t.Errorf("CSV converts to %s, %v", got, err)
+	}
+	if _, err := toJSON(MediaTypeCSV, nil, products); err == nil {
+		t.Error("empty CSV was accepted")
+	}
+}
+
+func TestBody(t *testing.T) {
+	r := httptest.NewRequest("POST", "/products", strings.NewReader("name,stock\na,1\n"))
+	r.Header.Set("Content-Type", "text/csv")
+	ctx := Context{r: r, body: new(requestBody), kind: products}
+	first := ctx.Body()
+	// copies share the body that was already read
+	copied := ctx
+	if second := copied.Body(); !bytes.Equal(first, second) || !jsonEqual(string(second), `{"name":"a","stock":1}`) {
+		t.Fatalf("first read %s, second %s", first, second)
+	}
+
+	r = httptest.NewRequest("POST", "/products", strings.NewReader("name,stock\n\"a,1\n"))
+	r.Header.Set("Content-Type", "text/csv")
+	ctx = Context{r: r, body: new(requestBody), kind: products}
+	_, err := ctx.ReadBody()
+	if e, ok := err.(*BodyError); !ok || e.MediaType != MediaTypeCSV {
+		t.Fatalf("broken CSV is read with %v", err)
+	}
+}
+
+func jsonEqual(a, b string) bool {
+	var x, y interface{}
+	if json.Unmarshal([]byte(a), &x) != nil || json.Unmarshal([]byte(b), &y) != nil {
+		return false
+	}
+	return reflect.DeepEqual(x, y)
+}
@@ -0,0 +1,257 @@
+package apis
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/ales6164/apis/kind"
+	"golang.org/x/crypto/bcrypt"
+	"google.golang.org/appengine/datastore"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// Errors of sessions and identities.
+var (
+	ErrTokenNotPresent = errors.New("token is not present")
+	ErrInvalidToken    = errors.New("token is invalid")
+	ErrSessionBlocked  = errors.New("session is blocked")
+	ErrUserNotFound    = errors.New("user doesn't exist")
+)
+
+// ProblemTypeBase prefixes codes of problems that don't have their own type URI.
+var ProblemTypeBase = "urn:apis:problem:"
+
+// Header with the request ID. Incoming values are kept, so IDs can be traced across services.
+const RequestIDHeader = "X-Request-Id"
+
+// ErrorType describes problems of an error. Code is machine readable and stable, like
+// validation_failed; clients should switch on it.
+type ErrorType struct {
+	Status int
+	Code   string
+	Type   string // URI; defaults to ProblemTypeBase + Code
+	Title  string // defaults to status text
+	Detail string // replaces the error message, like for errors that shouldn't be told apart
+	// Members are extra problem members, like the failing fields.
+	Members map[string]interface{}
+}
+
+/*
+Problem is an RFC 7807 problem details response. Every problem has a code and the ID of the
+request, which is also sent in the X-Request-Id header.
+*/
+type Problem struct {
+	Type      string
+	Title     string
+	Status    int
+	Detail    string
+	Instance  string
+	Code      string
+	RequestID string
+	Members   map[string]interface{}
+}
+
+func (p Problem) MarshalJSON() ([]byte, error) {
+	m := map[string]interface{}{}
+	for k, v := range p.Members {
+		m[k] = v
+	}
+	m["type"] = p.Type
+	m["title"] = p.Title
+	m["status"] = p.Status
+	m["code"] = p.Code
+	m["requestId"] = p.RequestID
+	if len(p.Detail) > 0 {
+		m["detail"] = p.Detail
+	}
+	if len(p.Instance) > 0 {
+		m["instance"] = p.Instance
+	}
+	return json.Marshal(m)
+}
+
+var registry = struct {
+	sync.RWMutex
+	types []func(err error) (ErrorType, bool)
+}{}
+
+// RegisterError maps errors that match target with errors.Is to t.
+func RegisterError(target error, t ErrorType) {
+	RegisterErrorFunc(func(err error) (ErrorType, bool) {
+		return t, errors.Is(err, target)
+	})
+}
+
+// RegisterErrorFunc maps errors that f reports to the type it returns, like typed errors
+// with members from their fields. Later registrations take precedence.
+func RegisterErrorFunc(f func(err error) (ErrorType, bool)) {
+	registry.Lock()
+	defer registry.Unlock()
+	registry.types = append(registry.types, f)
+}
+
+func lookupError(err error) (ErrorType, bool) {
+	registry.RLock()
+	defer registry.RUnlock()
+	for i := len(registry.types) - 1; i >= 0; i-- {
+		if t, ok := registry.types[i](err); ok {
+			return t, true
+		}
+	}
+	return ErrorType{}, false
+}
+
+func init() {
+	RegisterError(datastore.ErrNoSuchEntity, ErrorType{Status: http.StatusNotFound, Code: "not_found"})
+	RegisterError(datastore.ErrConcurrentTransaction, ErrorType{Status: http.StatusConflict, Code: "concurrent_transaction"})
+	RegisterError(kind.ErrEntityAlreadyExists, ErrorType{Status: http.StatusConflict, Code: "already_exists"})
+	RegisterError(kind.ErrPreconditionFailed, ErrorType{Status: http.StatusPreconditionFailed, Code: "precondition_failed"})
+	RegisterError(kind.ErrPathNotFound, ErrorType{Status: http.StatusNotFound, Code: "path_not_found"})
+	RegisterError(kind.ErrInTrash, ErrorType{Status: http.StatusConflict, Code: "in_trash"})
+	RegisterError(kind.ErrInvalidShards, ErrorType{Status: http.StatusBadRequest, Code: "invalid_shards"})
+	invalidCredentials := ErrorType{Status: http.StatusUnauthorized, Code: "invalid_credentials", Detail: "email or password is incorrect"}
+	RegisterError(bcrypt.ErrMismatchedHashAndPassword, invalidCredentials)
+	RegisterError(ErrUserNotFound, invalidCredentials)
+	RegisterError(errAtomicQuery, ErrorType{Status: http.StatusBadRequest, Code: "atomic_query"})
+	RegisterError(ErrTokenNotPresent, ErrorType{Status: http.StatusUnauthorized, Code: "token_not_present"})
+	RegisterError(ErrInvalidToken, ErrorType{Status: http.StatusUnauthorized, Code: "invalid_token"})
+	RegisterError(ErrSessionBlocked, ErrorType{Status: http.StatusUnauthorized, Code: "session_blocked"})
+	RegisterErrorFunc(func(err error) (ErrorType, bool) {
+		var syntaxErr *json.SyntaxError
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &syntaxErr) || errors.As(err, &typeErr) {
+			return ErrorType{Status: http.StatusBadRequest, Code: "invalid_json"}, true
+		}
+		return ErrorType{}, false
+	})
+	RegisterErrorFunc(func(err error) (ErrorType, bool) {
+		var e *BodyError
+		return ErrorType{Status: http.StatusBadRequest, Code: "invalid_body"}, errors.As(err, &e)
+	})
+	RegisterErrorFunc(func(err error) (ErrorType, bool) {
+		var e *kind.ValidationError
+		if !errors.As(err, &e) {
+			return ErrorType{}, false
+		}
+		return ErrorType{
+			Status:  http.StatusUnprocessableEntity,
+			Code:    "validation_failed",
+			Members: map[string]interface{}{"errors": e.Errors},
+		}, true
+	})
+	RegisterErrorFunc(func(err error) (ErrorType, bool) {
+		var e *kind.PatchError
+		if !errors.As(err, &e) {
+			return ErrorType{}, false
+		}
+		t := ErrorType{
+			Status:  http.StatusUnprocessableEntity,
+			Code:    "patch_failed",
+			Members: map[string]interface{}{"index": e.Index, "op": e.Op, "path": e.Path},
+		}
+		// failed test is a conflict with the current state
+		if e.Err == kind.ErrPatchTestFailed {
+			t.Status, t.Code = http.StatusConflict, "patch_test_failed"
+		}
+		return t, true
+	})
+	RegisterErrorFunc(func(err error) (ErrorType, bool) {
+		var e *kind.HookError
+		if !errors.As(err, &e) {
+			return ErrorType{}, false
+		}
+		status := e.Status
+		if status == 0 {
+			status = http.StatusBadRequest
+		}
+		return ErrorType{Status: status, Code: "rejected"}, true
+	})
+}
+
+var nonCode = regexp.MustCompile(`[^a-z0-9]+`)
+
+// Code of problems without a registered error, like not_found.
+func statusCode(status int) string {
+	return strings.Trim(nonCode.ReplaceAllString(strings.ToLower(http.StatusText(status)), "_"), "_")
+}
+
+var validRequestID = regexp.MustCompile(`^[\w\-.:]{1,128}$`)
+
+// Keeps request ID of the caller or creates one.
+func requestID(r *http.Request) string {
+	if id := r.Header.Get(RequestIDHeader); validRequestID.MatchString(id) {
+		return id
+	}
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(b)
+}
+
+// Writes problem as application/problem+json.
+func (ctx *Context) printProblem(p Problem) {
+	p.RequestID = ctx.requestID
+	writeProblem(ctx.w, p)
+}
+
+// Writes problem before there's a context, like from Middleware.
+func writeProblem(w http.ResponseWriter, p Problem) {
+	if len(p.Title) == 0 {
+		p.Title = http.StatusText(p.Status)
+	}
+	if len(p.Code) == 0 {
+		p.Code = statusCode(p.Status)
+	}
+	if len(p.Type) == 0 {
+		p.Type = ProblemTypeBase + p.Code
+	}
+	if p.Detail == p.Title {
+		p.Detail = ""
+	}
+	b, err := json.Marshal(p)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(p.Status)
+	w.Write(append(b, '\n'))
+}
+
+// PrintForbidden responds to requests without access. Requests with a rejected token get 401
+// with the reason, others 403.
+func (ctx *Context) PrintForbidden() {
+	if ctx.sessError != nil {
+		ctx.PrintProblem(ctx.sessError, http.StatusUnauthorized)
+		return
+	}
+	ctx.PrintError(http.StatusText(http.StatusForbidden), http.StatusForbidden)
+}
+
+// Detail of unregistered server errors. Their message may expose internals, so only logs have it.
+const internalErrorDetail = "the request failed; quote the request ID when reporting it"
+
+// PrintProblem responds with the problem registered for err. Unregistered errors get status,
+// and a generic detail if it is a server error.
+func (ctx *Context) PrintProblem(err error, status int) {
+	ctx.logf("context error: %v", err)
+	p := Problem{Status: status, Detail: err.Error()}
+	if t, ok := lookupError(err); ok {
+		p.Status, p.Code, p.Type, p.Title, p.Members = t.Status, t.Code, t.Type, t.Title, t.Members
+		if p.Status == 0 {
+			p.Status = status
+		}
+		if len(t.Detail) > 0 {
+			p.Detail = t.Detail
+		}
+	} else if status >= http.StatusInternalServerError {
+		p.Detail = internalErrorDetail
+	}
+	ctx.printProblem(p)
+}
@@ -0,0 +1,105 @@
+package apis_test
+
+import (
+	"errors"
+	"github.com/ales6164/apis"
+	"github.com/ales6164/apis/apistest"
+	"github.com/ales6164/apis/collection"
+	"github.com/ales6164/apis/storage"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+type problem struct {
+	Type      string `json:"type"`
+	Title     string `json:"title"`
+	Status    int    `json:"status"`
+	Code      string `json:"code"`
+	Detail    string `json:"detail"`
+	RequestID string `json:"requestId"`
+}
+
+// Checks that res is a problem with status and code, and returns it.
+func expectProblem(t *testing.T, res *apistest.Response, status int, code string) problem {
+	t.Helper()
+	res.Expect(t, status)
+	if ct := res.Header.Get("Content-Type"); ct != "application/problem+json" {
+		t.Fatalf("Content-Type of %d is %q", status, ct)
+	}
+	var p problem
+	if err := res.JSON(&p); err != nil {
+		t.Fatal(err)
+	}
+	if p.Status != status || p.Code != code || p.Type != apis.ProblemTypeBase+code {
+		t.Fatalf("problem is %+v, want %d %s", p, status, code)
+	}
+	if len(p.RequestID) == 0 || p.RequestID != res.Header.Get(apis.RequestIDHeader) {
+		t.Fatalf("problem has request ID %q, header %q", p.RequestID, res.Header.Get(apis.RequestIDHeader))
+	}
+	return p
+}
+
+type signup struct {
+	Id    string `datastore:"-" auto:"id" json:"id,omitempty"`
+	Email string `json:"email" valid:"required,email"`
+}
+
+func TestProblems(t *testing.T) {
+	signups := collection.New("signups", signup{})
+	s, c := newServer(t, nil, signups)
+
+	expectProblem(t, c.Get("/objects/missing"), http.StatusNotFound, "not_found")
+	expectProblem(t, c.Post("/objects", "{"), http.StatusBadRequest, "invalid_json")
+	p := expectProblem(t, c.Post("/objects", "name\n\"a\n", "Content-Type", "text/csv"), http.StatusBadRequest, "invalid_body")
+	if !strings.Contains(p.Detail, "text/csv") {
+		t.Errorf("detail of broken CSV is %q", p.Detail)
+	}
+	expectProblem(t, c.Post("/objects", "\xc1", "Content-Type", "application/msgpack"), http.StatusBadRequest, "invalid_body")
+	expectProblem(t, c.Post("/signups", signup{Email: "nobody"}), http.StatusUnprocessableEntity, "validation_failed")
+	expectProblem(t, s.Client().Post("/auth/emailpassword/register", map[string]string{
+		"email":    "user@example.com",
+		"password": "secret1",
+	}), http.StatusConflict, "already_exists")
+
+	// request ID of the caller is kept
+	res := c.Get("/objects/missing", apis.RequestIDHeader, "trace-1")
+	if p := expectProblem(t, res, http.StatusNotFound, "not_found"); p.RequestID != "trace-1" {
+		t.Fatalf("request ID is %q", p.RequestID)
+	}
+	res = c.Get("/objects/missing", apis.RequestIDHeader, "not a valid id")
+	if p := expectProblem(t, res, http.StatusNotFound, "not_found"); p.RequestID == "not a valid id" {
+		t.Fatal("invalid request ID is kept")
+	}
+}
+
+// Store that fails reads of the object with id broken.
+type brokenStore struct {
+	*storage.Memory
+}
+
+func (s brokenStore) Get(ctx context.Context, key *datastore.Key, dst interface{}) error {
+	if key.Kind() == "objects" && key.StringID() == "broken" {
+		return errors.New("disk on fire")
+	}
+	return s.Memory.Get(ctx, key, dst)
+}
+
+func (s brokenStore) GetMulti(ctx context.Context, keys []*datastore.Key, dst interface{}) error {
+	for _, key := range keys {
+		if key.Kind() == "objects" && key.StringID() == "broken" {
+			return errors.New("disk on fire")
+		}
+	}
+	return s.Memory.GetMulti(ctx, keys, dst)
+}
+
+func TestServerErrorDetail(t *testing.T) {
+	_, c := newServer(t, &apis.Options{Store: brokenStore{storage.NewMemory()}})
+	p := expectProblem(t, c.Get("/objects/broken"), http.StatusInternalServerError, "internal_server_error")
+	if len(p.Detail) == 0 || strings.Contains(p.Detail, "disk") {
+		t.Fatalf("detail of unregistered error is %q", p.Detail)
+	}
+}
@@ -0,0 +1,373 @@
+package apis
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/ales6164/apis/kind"
+	"github.com/ales6164/apis/storage"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Change types of events.
+const (
+	EventCreate = "create"
+	EventUpdate = "update"
+	EventDelete = "delete"
+)
+
+// Comment sent to idle event streams so proxies keep them open.
+const eventKeepAlive = 15 * time.Second
+
+// Events of a stream buffered for a subscriber. Subscribers that fall behind are dropped.
+const eventBuffer = 64
+
+// Stored events are kept this long when Options don't set EventRetention.
+const DefaultEventRetention = 7 * 24 * time.Hour
+
+// Every time a process stored this many events, the stream of the last one is pruned.
+const eventPruneInterval = 100
+
+// Most events deleted by one prune.
+const eventPruneLimit = 500
+
+// Attempts to store an event or queue its webhook deliveries before the failure is logged.
+const eventAttempts = 3
+
+// Event is a change of a document. Events are stored in the namespace of the document under
+// _change_<kind>, Seq orders them.
+type Event struct {
+	Seq  int64           `json:"-"`
+	Type string          `json:"type"`
+	Kind string          `json:"kind"`
+	Key  *datastore.Key  `json:"key"`
+	Time time.Time       `json:"time"`
+	Data json.RawMessage `json:"data,omitempty" datastore:",noindex"` // document after create or update
+}
+
+func changeKind(name string) string {
+	return "_change_" + name
+}
+
+// Sequence numbers handed out by this process.
+var eventSeq struct {
+	sync.Mutex
+	last  int64
+	count int64
+}
+
+// Sequence number of an event at t: the time in nanoseconds, above the last one of this process.
+// Events stored by other instances at the same time may be numbered out of order.
+func nextEventSeq(t time.Time) (seq int64, prune bool) {
+	eventSeq.Lock()
+	defer eventSeq.Unlock()
+	seq = t.UnixNano()
+	if seq <= eventSeq.last {
+		seq = eventSeq.last + 1
+	}
+	eventSeq.last = seq
+	eventSeq.count++
+	return seq, eventSeq.count%eventPruneInterval == 0
+}
+
+var errEventSeqTaken = errors.New("event sequence number is taken")
+
+/*
+Stores e under its sequence number. Every event is its own entity group, so writes of a
+collection don't wait for each other. When another instance took the number, e moves to the
+next one.
+*/
+func storeEvent(ctx context.Context, e *Event) error {
+	var err error
+	for i := 0; i < eventAttempts; i++ {
+		err = storage.RunInTransaction(ctx, func(tc context.Context) error {
+			key := datastore.NewKey(tc, changeKind(e.Kind), "", e.Seq, nil)
+			err := storage.Get(tc, key, new(Event))
+			if err == nil {
+				e.Seq++
+				return errEventSeqTaken
+			} else if err != datastore.ErrNoSuchEntity {
+				return err
+			}
+			_, err = storage.Put(tc, key, e)
+			return err
+		}, nil)
+		if err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// Deletes events of the stream of kindName stored longer than retention ago. Clients that
+// resume from a deleted event miss the changes up to the oldest kept one.
+func pruneEvents(ctx context.Context, kindName string, retention time.Duration) error {
+	keys, err := storage.NewQuery(changeKind(kindName)).Filter("Time <", time.Now().Add(-retention)).KeysOnly().Limit(eventPruneLimit).GetAll(ctx, nil)
+	if err != nil || len(keys) == 0 {
+		return err
+	}
+	return storage.DeleteMulti(ctx, keys)
+}
+
+// Documents of a collection at one level share a stream.
+func eventStream(namespace, kindName string) string {
+	return namespace + "/" + kindName
+}
+
+// Broker delivers stored events to open event streams. Deployments with more instances
+// should plug in a broker that reaches all of them.
+type Broker interface {
+	Publish(ctx context.Context, stream string, e Event) error
+	// Subscribe returns events published to stream until cancel is called. Channel is closed
+	// when the subscriber is dropped.
+	Subscribe(ctx context.Context, stream string) (events <-chan Event, cancel func(), err error)
+}
+
+// MemoryBroker delivers events within the process.
+type MemoryBroker struct {
+	mu   sync.Mutex
+	subs map[string]map[chan Event]bool
+}
+
+func NewMemoryBroker() *MemoryBroker {
+	return &MemoryBroker{subs: map[string]map[chan Event]bool{}}
+}
+
+func (b *MemoryBroker) Publish(ctx context.Context, stream string, e Event) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.subs[stream] {
+		select {
+		case ch <- e:
+		default:
+			// slow subscriber resumes from stored events
+			delete(b.subs[stream], ch)
+			close(ch)
+		}
+	}
+	return nil
+}
+
+func (b *MemoryBroker) Subscribe(ctx context.Context, stream string) (<-chan Event, func(), error) {
+	ch := make(chan Event, eventBuffer)
+	b.mu.Lock()
+	if b.subs[stream] == nil {
+		b.subs[stream] = map[chan Event]bool{}
+	}
+	b.subs[stream][ch] = true
+	b.mu.Unlock()
+	return ch, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if b.subs[stream][ch] {
+			delete(b.subs[stream], ch)
+			close(ch)
+		}
+	}, nil
+}
+
+// Stores and publishes change made by a served request. Inside batches it's done after the
+// commit, so rolled back changes aren't published.
+func (ctx Context) publishChange(status int, document kind.Doc, action string, inValue bool) {
+	if status >= http.StatusBadRequest || document == nil || document.Key() == nil || document.Key().Incomplete() {
+		return
+	}
+	var typ string
+	switch {
+	case action == "_restore":
+		typ = EventCreate
+	case action == "_revisions/_restore":
+		typ = EventUpdate
+	case len(action) > 0:
+		return
+	case ctx.r.Method == http.MethodPost:
+		typ = EventCreate
+	case ctx.r.Method == http.MethodPut && document.Created():
+		typ = EventCreate
+	case ctx.r.Method == http.MethodPut || ctx.r.Method == http.MethodPatch:
+		typ = EventUpdate
+	case ctx.r.Method == http.MethodDelete && inValue:
+		typ = EventUpdate
+	case ctx.r.Method == http.MethodDelete:
+		typ = EventDelete
+	default:
+		return
+	}
+
+	e := Event{
+		Type: typ,
+		Kind: document.Kind().Name(),
+		Key:  document.Key(),
+	}
+	if typ != EventDelete {
+		var err error
+		if e.Data, err = json.Marshal(document.Kind().Data(document, false)); err != nil {
+			ctx.logf("event error: %v", err)
+			return
+		}
+	}
+	err := storage.AfterCommit(ctx, func(c context.Context) error {
+		var prune bool
+		e.Time = time.Now()
+		e.Seq, prune = nextEventSeq(e.Time)
+
+		// stored events only serve streams that resume; live streams and webhooks don't need them
+		nsCtx, err := appengine.Namespace(c, e.Key.Namespace())
+		if err == nil {
+			err = storeEvent(nsCtx, &e)
+		}
+		if err != nil {
+			ctx.logf("event error: storing %s event of %v: %v", e.Type, e.Key, err)
+		} else if prune {
+			retention := ctx.a.EventRetention
+			if retention <= 0 {
+				retention = DefaultEventRetention
+			}
+			if err := pruneEvents(nsCtx, e.Kind, retention); err != nil {
+				ctx.logf("event error: %v", err)
+			}
+		}
+
+		if err := ctx.a.Broker.Publish(c, eventStream(e.Key.Namespace(), e.Kind), e); err != nil {
+			ctx.logf("event error: publishing %s event of %v: %v", e.Type, e.Key, err)
+		}
+		for i := 0; i < eventAttempts; i++ {
+			if err = ctx.a.queueWebhooks(c, e); err == nil {
+				break
+			}
+		}
+		if err != nil {
+			ctx.logf("event error: queueing webhooks of %s event of %v: %v", e.Type, e.Key, err)
+		}
+		return nil
+	})
+	if err != nil {
+		ctx.logf("event error: %v", err)
+	}
+}
+
+/*
+GET /{kind}/_events streams changes of documents in the collection as Server-Sent Events.
+Nested collections stream changes within the group of the parent document. Access is
+checked like for reads when the stream opens.
+
+Every event has the sequence number as id. Clients that reconnect with Last-Event-ID header
+or lastEventId param first get stored events after it. App Engine ends requests after a
+while; EventSource reconnects and resumes on its own.
+*/
+func serveEvents(ctx Context, rules Rules, document kind.Doc) {
+	if ctx.r.Method != http.MethodGet {
+		ctx.PrintError(http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	if ok := checkAccess(ctx, rules, document, ReadOnly, ReadWrite, FullControl); !ok {
+		return
+	}
+	if !canFlush(ctx.w) {
+		ctx.PrintError("streaming not supported", http.StatusNotImplemented)
+		return
+	}
+
+	var last int64
+	lastID := ctx.r.Header.Get("Last-Event-ID")
+	if len(lastID) == 0 {
+		lastID = ctx.r.URL.Query().Get("lastEventId")
+	}
+	if len(lastID) > 0 {
+		var err error
+		if last, err = strconv.ParseInt(lastID, 10, 64); err != nil {
+			ctx.PrintError("invalid Last-Event-ID", http.StatusBadRequest)
+			return
+		}
+	}
+
+	namespace := document.Key().Namespace()
+	kindName := document.Kind().Name()
+	events, cancel, err := ctx.a.Broker.Subscribe(ctx, eventStream(namespace, kindName))
+	if err != nil {
+		ctx.PrintProblem(err, http.StatusInternalServerError)
+		return
+	}
+	defer cancel()
+
+	ctx.w.Header().Set("Content-Type", "text/event-stream")
+	ctx.w.Header().Set("Cache-Control", "no-store")
+	ctx.w.Header().Set("X-Accel-Buffering", "no")
+	ctx.w.WriteHeader(http.StatusOK)
+	flush := ctx.w.(http.Flusher).Flush
+	flush()
+
+	send := func(e Event) bool {
+		if e.Seq <= last {
+			return true
+		}
+		b, err := json.Marshal(e)
+		if err != nil {
+			ctx.logf("event error: %v", err)
+			return true
+		}
+		if _, err = fmt.Fprintf(ctx.w, "id: %d\nevent: %s\ndata: %s\n\n", e.Seq, e.Type, b); err != nil {
+			return false
+		}
+		last = e.Seq
+		flush()
+		return true
+	}
+
+	// stored events the client missed; live ones are buffered meanwhile
+	if len(lastID) > 0 {
+		nsCtx, err := appengine.Namespace(ctx, namespace)
+		if err != nil {
+			ctx.logf("event error: %v", err)
+			return
+		}
+		t := storage.NewQuery(changeKind(kindName)).Filter("Seq >", last).Order("Seq").Run(nsCtx)
+		for {
+			var e Event
+			_, err := t.Next(&e)
+			if err == datastore.Done {
+				break
+			}
+			if err != nil {
+				ctx.logf("event error: %v", err)
+				return
+			}
+			if !send(e) {
+				return
+			}
+		}
+	}
+
+	keepAlive := time.NewTicker(eventKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-ctx.r.Context().Done():
+			return
+		case e, ok := <-events:
+			if !ok || !send(e) {
+				return
+			}
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(ctx.w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+			flush()
+		}
+	}
+}
+
+// Reports if the response can be streamed.
+func canFlush(w http.ResponseWriter) bool {
+	if sw, ok := w.(*statusWriter); ok {
+		w = sw.ResponseWriter
+	}
+	_, ok := w.(http.Flusher)
+	return ok
+}
@@ -0,0 +1,108 @@
+package apis_test
+
+import (
+	"errors"
+	"github.com/ales6164/apis"
+	"github.com/ales6164/apis/storage"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Stored events of objects in the default namespace, in order.
+func storedEvents(t *testing.T, store storage.Store) []apis.Event {
+	t.Helper()
+	ctx := storage.NewContext(appengine.NewContext(httptest.NewRequest("GET", "/", nil)), store)
+	var events []apis.Event
+	if _, err := storage.NewQuery("_change_objects").Order("Seq").GetAll(ctx, &events); err != nil {
+		t.Fatal(err)
+	}
+	return events
+}
+
+func TestEventSequence(t *testing.T) {
+	s, c := newServer(t, nil)
+	c.Put("/objects/a", Object{Name: "a"}).Expect(t, http.StatusOK)
+	c.Put("/objects/a", Object{Name: "b"}).Expect(t, http.StatusOK)
+	o := create(t, c, "/objects", Object{Name: "c"})
+	c.Delete("/objects/"+o.Id).Expect(t, http.StatusOK)
+
+	events := storedEvents(t, s.Store)
+	types := []string{apis.EventCreate, apis.EventUpdate, apis.EventCreate, apis.EventDelete}
+	if len(events) != len(types) {
+		t.Fatalf("stored %d events, want %d", len(events), len(types))
+	}
+	for i, e := range events {
+		if e.Type != types[i] {
+			t.Errorf("event %d is %s, want %s", i, e.Type, types[i])
+		}
+		if i > 0 && e.Seq <= events[i-1].Seq {
+			t.Errorf("event %d has sequence %d after %d", i, e.Seq, events[i-1].Seq)
+		}
+	}
+}
+
+func TestEventRetention(t *testing.T) {
+	s, c := newServer(t, &apis.Options{EventRetention: time.Nanosecond})
+	// events are pruned once in a while; a stream of this many gets pruned at least once
+	for i := 0; i < 101; i++ {
+		c.Put("/objects/a", Object{Name: "a"}).Expect(t, http.StatusOK)
+	}
+	if n := len(storedEvents(t, s.Store)); n >= 100 {
+		t.Fatalf("%d events are kept", n)
+	}
+}
+
+// Store that can't store events.
+type eventlessStore struct {
+	*storage.Memory
+}
+
+func (s eventlessStore) Put(ctx context.Context, key *datastore.Key, src interface{}) (*datastore.Key, error) {
+	if strings.HasPrefix(key.Kind(), "_change_") {
+		return nil, errors.New("unavailable")
+	}
+	return s.Memory.Put(ctx, key, src)
+}
+
+func TestEventWithoutStore(t *testing.T) {
+	broker := apis.NewMemoryBroker()
+	store := eventlessStore{storage.NewMemory()}
+	_, c := newServer(t, &apis.Options{
+		Store:              store,
+		Broker:             broker,
+		WebhookPermissions: apis.Permissions{apis.AllAuthenticatedUsers: {apis.FullControl}},
+	})
+	var hook apis.Webhook
+	c.Post("/_webhooks", apis.Webhook{URL: "https://example.com/hook", Kind: "objects", Events: []string{apis.WebhookCreated}, Active: true}).
+		Expect(t, http.StatusCreated).JSON(&hook)
+	events, cancel, err := broker.Subscribe(context.Background(), "/objects")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cancel()
+
+	// the change is published and its webhooks queued though the event isn't stored
+	create(t, c, "/objects", Object{Name: "a"})
+	select {
+	case e := <-events:
+		if e.Type != apis.EventCreate || e.Seq == 0 {
+			t.Errorf("published %+v", e)
+		}
+	default:
+		t.Error("event wasn't published")
+	}
+	var deliveries []apis.WebhookDelivery
+	c.Get("/_webhooks/"+hook.Id+"/deliveries").Expect(t, http.StatusOK).JSON(&deliveries)
+	if len(deliveries) != 1 {
+		t.Errorf("queued %d deliveries", len(deliveries))
+	}
+	if n := len(storedEvents(t, store.Memory)); n != 0 {
+		t.Errorf("stored %d events", n)
+	}
+}
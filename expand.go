@@ -0,0 +1,249 @@
+package apis
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/ales6164/apis/kind"
+	"github.com/ales6164/apis/storage"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"reflect"
+	"strings"
+)
+
+// Longest dot separated path accepted by expand param.
+const maxExpandDepth = 3
+
+var keySliceType = reflect.TypeOf([]*datastore.Key{})
+
+// parses comma separated expand param; first segment of every path must be a key field
+func parseExpand(doc kind.Doc, values []string) ([][]string, error) {
+	var paths [][]string
+	for _, v := range values {
+		for _, p := range strings.Split(v, ",") {
+			if p = strings.TrimSpace(p); len(p) == 0 {
+				continue
+			}
+			path := strings.Split(p, ".")
+			if len(path) > maxExpandDepth {
+				return nil, fmt.Errorf("expand path %q is deeper than %d", p, maxExpandDepth)
+			}
+			if !isReference(doc.Kind(), path[0]) {
+				return nil, fmt.Errorf("field %q is not a reference", path[0])
+			}
+			paths = append(paths, path)
+		}
+	}
+	return paths, nil
+}
+
+func isReference(k kind.Kind, field string) bool {
+	if _, err := k.Select(reflect.New(k.Type()), []string{field}); err != nil {
+		return false
+	}
+	v, err := k.ValueAt(reflect.New(k.Type()), []string{field})
+	return err == nil && v.IsValid() && (v.Type() == keyType || v.Type() == keySliceType)
+}
+
+/*
+Replaces *datastore.Key fields in data with the referenced documents. A reference is expanded
+only when the caller could read it directly: documents without a group are checked against
+top level rules, documents in the group of the requested document against rules next to the
+requested collection. Other references are left as keys, missing documents become null.
+*/
+type expander struct {
+	ctx   Context
+	scope Rules    // rules that matched the requested collection
+	doc   kind.Doc // requested document or collection
+}
+
+// Expands paths in items which are data of docs. Items with meta have data under value.
+func (e expander) expand(docs []kind.Doc, items []interface{}, paths [][]string, includeMeta bool) ([]interface{}, error) {
+	var trees = make([]interface{}, len(items))
+	for i, item := range items {
+		t, err := jsonTree(item)
+		if err != nil {
+			return nil, err
+		}
+		items[i], trees[i] = t, t
+		if m, ok := t.(map[string]interface{}); ok && includeMeta {
+			trees[i] = m["value"]
+		}
+	}
+	return items, e.expandTrees(docs, trees, paths)
+}
+
+func (e expander) expandTrees(docs []kind.Doc, trees []interface{}, paths [][]string) error {
+	// paths grouped by field, in order of appearance
+	var fields []string
+	var rest = map[string][][]string{}
+	for _, p := range paths {
+		if _, ok := rest[p[0]]; !ok {
+			fields = append(fields, p[0])
+			rest[p[0]] = nil
+		}
+		if len(p) > 1 {
+			rest[p[0]] = append(rest[p[0]], p[1:])
+		}
+	}
+
+	for _, field := range fields {
+		// references of every document
+		var refs = make([][]*datastore.Key, len(docs))
+		var keys []*datastore.Key
+		for i, doc := range docs {
+			if !isReference(doc.Kind(), field) {
+				continue
+			}
+			v, err := doc.Kind().ValueAt(doc.Value(), []string{field})
+			if err != nil || !v.IsValid() {
+				continue
+			}
+			switch x := v.Interface().(type) {
+			case *datastore.Key:
+				refs[i] = []*datastore.Key{x}
+			case []*datastore.Key:
+				refs[i] = x
+			}
+			keys = append(keys, refs[i]...)
+		}
+
+		loaded, missing, err := e.load(keys)
+		if err != nil {
+			return err
+		}
+
+		var loadedDocs []kind.Doc
+		var loadedTrees []interface{}
+		var treeOf = map[string]interface{}{}
+		for id, doc := range loaded {
+			t, err := jsonTree(doc.Kind().Data(doc, false))
+			if err != nil {
+				return err
+			}
+			treeOf[id] = t
+			loadedDocs = append(loadedDocs, doc)
+			loadedTrees = append(loadedTrees, t)
+		}
+
+		replace := func(key *datastore.Key, value interface{}) interface{} {
+			if key == nil {
+				return value
+			}
+			if t, ok := treeOf[key.Encode()]; ok {
+				return t
+			}
+			if missing[key.Encode()] {
+				return nil
+			}
+			return value
+		}
+		for i, t := range trees {
+			m, ok := t.(map[string]interface{})
+			if !ok || len(refs[i]) == 0 {
+				continue
+			}
+			switch value := m[field].(type) {
+			case []interface{}:
+				for j := range value {
+					if j < len(refs[i]) {
+						value[j] = replace(refs[i][j], value[j])
+					}
+				}
+			case nil:
+			default:
+				m[field] = replace(refs[i][0], value)
+			}
+		}
+
+		if len(rest[field]) > 0 && len(loadedDocs) > 0 {
+			if err := e.expandTrees(loadedDocs, loadedTrees, rest[field]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Loads documents the caller can read. Returned maps are keyed by encoded key.
+func (e expander) load(keys []*datastore.Key) (loaded map[string]kind.Doc, missing map[string]bool, err error) {
+	loaded, missing = map[string]kind.Doc{}, map[string]bool{}
+	var ids []string
+	var docs []kind.Doc
+	var docKeys []*datastore.Key
+	var allowed = map[string]bool{}
+	for _, key := range keys {
+		if key == nil || key.Incomplete() {
+			continue
+		}
+		id := key.Encode()
+		if _, ok := allowed[id]; ok {
+			continue
+		}
+		k, ok := e.ctx.a.kinds[key.Kind()]
+		if !ok {
+			allowed[id] = false
+			continue
+		}
+		var rules Rules
+		var ancestor kind.Doc
+		switch ns := key.Namespace(); {
+		case len(ns) == 0:
+			rules, ok = e.ctx.a.Rules.Match[k]
+		case e.doc.HasAncestor() && ns == e.doc.Key().Namespace():
+			rules, ok = e.scope.Match[k]
+			ancestor = e.doc.Ancestor()
+		default:
+			ok = false
+		}
+		if allowed[id] = ok && e.ctx.HasAccess(rules, ReadOnly, ReadWrite, FullControl); !allowed[id] {
+			continue
+		}
+		doc, err := k.Doc(e.ctx, key, ancestor)
+		if err != nil {
+			return nil, nil, err
+		}
+		ids = append(ids, id)
+		docs = append(docs, doc)
+		docKeys = append(docKeys, doc.Key())
+	}
+	if len(docs) == 0 {
+		return loaded, missing, nil
+	}
+
+	err = storage.GetMulti(e.ctx, docKeys, docs)
+	errs, _ := err.(appengine.MultiError)
+	if err != nil && errs == nil {
+		return nil, nil, err
+	}
+	for i, doc := range docs {
+		if errs != nil && errs[i] != nil {
+			if errs[i] == datastore.ErrNoSuchEntity {
+				missing[ids[i]] = true
+				continue
+			}
+			if _, ok := errs[i].(*datastore.ErrFieldMismatch); !ok {
+				return nil, nil, errs[i]
+			}
+		}
+		if err := doc.Loaded(); err != nil {
+			return nil, nil, err
+		}
+		loaded[ids[i]] = doc
+	}
+	return loaded, missing, nil
+}
+
+// converts v to generic JSON value
+func jsonTree(v interface{}) (interface{}, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var t interface{}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	err = dec.Decode(&t)
+	return t, err
+}
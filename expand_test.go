@@ -0,0 +1,70 @@
+package apis_test
+
+import (
+	"encoding/json"
+	"github.com/ales6164/apis"
+	"github.com/ales6164/apis/collection"
+	"github.com/ales6164/apis/storage"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestExpandAccess(t *testing.T) {
+	notes := collection.New("notes", Note{})
+	secrets := collection.New("secrets", Object{})
+	s, c := newServer(t, &apis.Options{Rules: apis.Rules{Match: apis.Match{
+		secrets: {Permissions: apis.Permissions{"admin": {apis.FullControl}}},
+	}}}, notes)
+	s.HandleKind(secrets)
+
+	// documents the caller can't read, stored around the API
+	ctx := storage.NewContext(appengine.NewContext(httptest.NewRequest("GET", "/", nil)), s.Store)
+	secret := datastore.NewKey(ctx, "secrets", "s1", 0, nil)
+	if _, err := storage.Put(ctx, secret, &Object{Name: "secret"}); err != nil {
+		t.Fatal(err)
+	}
+	otherCtx, err := appengine.Namespace(ctx, "other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	foreign := datastore.NewKey(otherCtx, "objects", "o1", 0, nil)
+	if _, err := storage.Put(otherCtx, foreign, &Object{Name: "foreign"}); err != nil {
+		t.Fatal(err)
+	}
+	c.Get("/secrets/"+secret.Encode()).Expect(t, http.StatusForbidden)
+
+	o := create(t, c, "/objects", Object{Name: "a"})
+	readable, err := datastore.DecodeKey(o.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, test := range map[string]struct {
+		ref      *datastore.Key
+		expanded bool
+	}{
+		"readable": {readable, true},
+		"denied":   {secret, false},
+		"foreign":  {foreign, false},
+	} {
+		var note Note
+		c.Post("/notes", Note{Name: name, Ref: test.ref}).Expect(t, http.StatusOK).JSON(&note)
+		var out struct {
+			Ref json.RawMessage `json:"ref"`
+		}
+		c.Get("/notes/"+note.Id+"?expand=ref").Expect(t, http.StatusOK).JSON(&out)
+
+		var key *datastore.Key
+		isKey := json.Unmarshal(out.Ref, &key) == nil
+		if test.expanded {
+			var ref Object
+			if err := json.Unmarshal(out.Ref, &ref); err != nil || ref.Name != "a" {
+				t.Errorf("%s reference is %s", name, out.Ref)
+			}
+		} else if !isKey || !key.Equal(test.ref) {
+			t.Errorf("%s reference is %s, want key %s", name, out.Ref, test.ref.Encode())
+		}
+	}
+}
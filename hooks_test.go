@@ -0,0 +1,85 @@
+package apis_test
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"github.com/ales6164/apis/collection"
+	"github.com/ales6164/apis/kind"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+	"net/http"
+	"testing"
+)
+
+type Note struct {
+	Id     string         `datastore:"-" auto:"id" json:"id,omitempty"`
+	Name   string         `json:"name"`
+	Secret string         `json:"secret"`
+	Ref    *datastore.Key `json:"ref,omitempty"`
+}
+
+func TestReadHooks(t *testing.T) {
+	notes := collection.New("notes", Note{})
+	notes.KeepRevisions = true
+	notes.On(collection.AfterRead, func(ctx context.Context, doc kind.Doc) error {
+		doc.Value().Elem().FieldByName("Secret").SetString("")
+		return nil
+	})
+	_, c := newServer(t, nil, notes)
+
+	var a, b Note
+	c.Post("/notes", Note{Name: "a", Secret: "s"}).Expect(t, http.StatusOK).JSON(&a)
+	c.Put("/notes/"+a.Id, Note{Name: "a", Secret: "s2"}).Expect(t, http.StatusOK)
+	ref, err := datastore.DecodeKey(a.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Post("/notes", Note{Name: "b", Secret: "s", Ref: ref}).Expect(t, http.StatusOK).JSON(&b)
+
+	var note Note
+	c.Get("/notes/"+a.Id).Expect(t, http.StatusOK).JSON(&note)
+	var list []Note
+	c.Get("/notes").Expect(t, http.StatusOK).JSON(&list)
+	var revisions []struct {
+		Value Note `json:"value"`
+	}
+	c.Get("/notes/"+a.Id+"/_revisions").Expect(t, http.StatusOK).JSON(&revisions)
+	var expanded struct {
+		Ref Note `json:"ref"`
+	}
+	c.Get("/notes/"+b.Id+"?expand=ref").Expect(t, http.StatusOK).JSON(&expanded)
+	var exported []Note
+	s := bufio.NewScanner(bytes.NewReader(c.Get("/notes/_export").Expect(t, http.StatusOK).Body))
+	for s.Scan() {
+		var r kind.Record
+		var n Note
+		if err := json.Unmarshal(s.Bytes(), &r); err != nil {
+			t.Fatal(err)
+		}
+		if err := json.Unmarshal(r.Value, &n); err != nil {
+			t.Fatal(err)
+		}
+		exported = append(exported, n)
+	}
+
+	reads := map[string][]Note{
+		"get":     {note},
+		"listing": list,
+		"expand":  {expanded.Ref},
+		"export":  exported,
+	}
+	for _, r := range revisions {
+		reads["revisions"] = append(reads["revisions"], r.Value)
+	}
+	for read, items := range reads {
+		for _, n := range items {
+			if len(n.Secret) > 0 {
+				t.Errorf("%s returned secret of %s", read, n.Name)
+			}
+		}
+	}
+	if len(list) != 2 || len(exported) != 2 || len(revisions) != 1 || expanded.Ref.Name != "a" {
+		t.Fatalf("read %d listed, %d exported, %d revisions and expanded %+v", len(list), len(exported), len(revisions), expanded.Ref)
+	}
+}
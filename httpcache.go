@@ -0,0 +1,118 @@
+package apis
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/ales6164/apis/kind"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Cache-Control used when Rules don't declare one. Responses can be stored but must
+// be revalidated with ETag or Last-Modified.
+const (
+	PublicCacheControl  = "public, no-cache"
+	PrivateCacheControl = "private, no-cache"
+)
+
+// Request headers that change the body of responses besides the URL.
+const varyHeader = "Accept, X-Include-Meta"
+
+// Cache-Control policy for GET responses. Collections readable by AllUsers are
+// public unless the document belongs to a group or the response has expanded references.
+func (r Rules) cacheControl(document kind.Doc, expand [][]string) string {
+	if len(r.CacheControl) > 0 {
+		return r.CacheControl
+	}
+	if !document.HasAncestor() && len(expand) == 0 && ContainsScope(r.Permissions[AllUsers], ReadOnly, ReadWrite, FullControl) {
+		return PublicCacheControl
+	}
+	return PrivateCacheControl
+}
+
+// Sets ETag and Last-Modified headers and reports if the client already has this version.
+// If-Modified-Since is ignored when If-None-Match is present.
+func notModified(w http.ResponseWriter, r *http.Request, etag string, lastModified time.Time) bool {
+	w.Header().Set("Vary", varyHeader)
+	if len(etag) > 0 {
+		w.Header().Set("ETag", etag)
+	}
+	if !lastModified.IsZero() {
+		w.Header().Set("Last-Modified", lastModified.UTC().Format(http.TimeFormat))
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	if inm := r.Header.Get("If-None-Match"); len(inm) > 0 {
+		if len(etag) == 0 {
+			return false
+		}
+		for _, tag := range strings.Split(inm, ",") {
+			// weak comparison
+			tag = strings.TrimSpace(tag)
+			if tag == "*" || strings.TrimPrefix(tag, "W/") == strings.TrimPrefix(etag, "W/") {
+				return true
+			}
+		}
+		return false
+	}
+	if ims := r.Header.Get("If-Modified-Since"); len(ims) > 0 && !lastModified.IsZero() {
+		if t, err := http.ParseTime(ims); err == nil {
+			return !lastModified.Truncate(time.Second).After(t)
+		}
+	}
+	return false
+}
+
+// Weak ETag computed from JSON representation of v.
+func weakETag(v ...interface{}) string {
+	h := sha1.New()
+	if err := json.NewEncoder(h).Encode(v); err != nil {
+		return ""
+	}
+	return `W/"` + hex.EncodeToString(h.Sum(nil)) + `"`
+}
+
+/*
+ETag of the representation of document in the response to ctx. Selected fields, meta and media
+types other than JSON change the body, so their hash is added to the version, as in "3+8f2a1c0d".
+The full JSON representation keeps the ETag of the document.
+*/
+func representationETag(ctx Context, document kind.Doc, fields []string) string {
+	etag := document.ETag()
+	if len(etag) < 2 || (len(fields) == 0 && !ctx.hasIncludeMetaHeader && (len(ctx.mediaType) == 0 || ctx.mediaType == MediaTypeJSON)) {
+		return etag
+	}
+	sorted := append([]string(nil), fields...)
+	sort.Strings(sorted)
+	h := sha1.New()
+	if err := json.NewEncoder(h).Encode([]interface{}{sorted, ctx.hasIncludeMetaHeader, ctx.mediaType}); err != nil {
+		return etag
+	}
+	return etag[:len(etag)-1] + "+" + hex.EncodeToString(h.Sum(nil))[:8] + `"`
+}
+
+// ETag of the document in If-Match header value tags of any representation of it.
+func documentETags(ifMatch string) string {
+	tags := strings.Split(ifMatch, ",")
+	for i, tag := range tags {
+		tag = strings.TrimSpace(tag)
+		if n := strings.LastIndex(tag, "+"); n > 0 && strings.HasSuffix(tag, `"`) {
+			tag = tag[:n] + `"`
+		}
+		tags[i] = tag
+	}
+	return strings.Join(tags, ", ")
+}
+
+// Serves HEAD as GET without the body.
+type headWriter struct {
+	http.ResponseWriter
+}
+
+func (w headWriter) Write(b []byte) (int, error) {
+	return len(b), nil
+}
@@ -1,16 +1,128 @@
 package kind
 
 import (
+	"encoding/json"
 	"errors"
+	"fmt"
 	"golang.org/x/net/context"
 	"google.golang.org/appengine/datastore"
+	"io"
 	"reflect"
+	"strings"
+	"time"
 )
 
 var (
 	ErrEntityAlreadyExists = errors.New("entity already exists") // on doc.Add() if entity already exists
+	ErrPatchTestFailed     = errors.New("test operation failed") // on doc.Patch() if test operation doesn't match
+	ErrPreconditionFailed  = errors.New("precondition failed")   // on write if entity doesn't match doc.IfMatch()
+	ErrPathNotFound        = errors.New("path not found")        // if field or index at path doesn't exist
+	ErrInTrash             = errors.New("document is in trash")  // on write of soft deleted document
+	ErrInvalidShards       = errors.New("invalid shard count")   // on kind.Reconcile() with too many shards
 )
 
+// PatchError is returned by doc.Patch() when an operation can't be applied.
+// No operations are applied in that case.
+type PatchError struct {
+	Index int    // index of the failing operation
+	Op    string // operation name
+	Path  string
+	Err   error
+}
+
+func (e *PatchError) Error() string {
+	return fmt.Sprintf("operation %d (%s %s): %v", e.Index, e.Op, e.Path, e.Err)
+}
+
+// HookError is returned by collection hooks to reject a request. Status is the HTTP status of
+// the response.
+type HookError struct {
+	Status  int
+	Message string
+}
+
+func (e *HookError) Error() string {
+	return e.Message
+}
+
+// ValidationError is returned by writes of values that break rules of valid field tags.
+type ValidationError struct {
+	Errors []FieldError
+}
+
+// FieldError is a broken rule of a field.
+type FieldError struct {
+	Path string `json:"path"` // JSON pointer to the field
+	Rule string `json:"rule"` // like required or length(3|64)
+}
+
+func (e *ValidationError) Error() string {
+	var s []string
+	for _, f := range e.Errors {
+		s = append(s, f.Path+" "+f.Rule)
+	}
+	return "validation failed: " + strings.Join(s, ", ")
+}
+
+// Operation is a JSON Patch (RFC 6902) operation, returned by kind.Diff().
+type Operation struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+// Revision is a previous version of a document, stored when the document was changed.
+type Revision struct {
+	ID        int64          `json:"id"`
+	ChangedAt time.Time      `json:"changedAt"`           // when the version was replaced
+	ChangedBy *datastore.Key `json:"changedBy,omitempty"` // member who replaced it
+	Doc       Doc            `json:"-"`                   // document with value of the version
+}
+
+// Record is a document with its meta, one line of NDJSON export and import.
+type Record struct {
+	Name      string          `json:"name,omitempty"`    // string id of the key
+	IntID     int64           `json:"intId,omitempty"`   // numeric id of the key
+	GroupID   string          `json:"groupId,omitempty"` // group the document belongs to
+	MetaID    string          `json:"metaId"`            // group the document is to its nested collections
+	CreatedAt time.Time       `json:"createdAt"`
+	UpdatedAt time.Time       `json:"updatedAt"`
+	Value     json.RawMessage `json:"value"`
+}
+
+type ImportMode string
+
+const (
+	ImportUpsert  ImportMode = "upsert"  // creates new and overwrites existing documents
+	ImportInsert  ImportMode = "insert"  // creates new documents, existing are skipped
+	ImportReplace ImportMode = "replace" // overwrites existing documents, new are skipped
+)
+
+type ImportResult struct {
+	Created int           `json:"created"`
+	Updated int           `json:"updated"`
+	Skipped int           `json:"skipped"`
+	Errors  []ImportError `json:"errors,omitempty"`
+}
+
+// ImportError is a line that couldn't be imported.
+type ImportError struct {
+	Line  int    `json:"line"`
+	Error string `json:"error"`
+}
+
+// CounterStatus is the sharded counter of a kind in one namespace, next to the number of
+// documents it should have.
+type CounterStatus struct {
+	Kind      string     `json:"kind"`
+	Namespace string     `json:"namespace,omitempty"`
+	Shards    int        `json:"shards"`
+	Count     int        `json:"count"`     // sum of shards
+	Documents int        `json:"documents"` // counted with a keys-only query
+	Drift     int        `json:"drift"`     // count - documents
+	GrownAt   *time.Time `json:"grownAt,omitempty"`
+}
+
 type Field interface {
 	Name() string
 	Fields() map[string]Field
@@ -25,8 +137,16 @@ type Doc interface {
 	Ancestor() Doc
 	Add(data interface{}) (Doc, error) // transaction function in 1/2 case
 	Set(data interface{}) (Doc, error)
-	Patch(data []byte) error // transaction function
+	Patch(data []byte) (Doc, error)                // transaction function
+	MergePatch(data []byte) (Doc, error)           // transaction function
+	SetAt(path []string, data []byte) (Doc, error) // transaction function
+	DeleteAt(path []string) (Doc, error)           // transaction function
 	Delete() error
+	Restore() (Doc, error) // transaction function
+	Revisions(cursor string, limit int) (revisions []Revision, next string, err error)
+	Revision(id int64) (Revision, error)
+	IfMatch(header string)
+	ETag() string
 	Kind() Kind
 	Value() reflect.Value
 	Key() *datastore.Key
@@ -38,6 +158,8 @@ type Doc interface {
 	Context() context.Context
 	Meta() (Meta, error)
 	Exists() bool
+	Created() bool // reports if the last write created the document
+	Loaded() error // runs read hooks on a document loaded by a query
 	/*SetParent(doc Doc) (Doc, error)*/
 }
 
@@ -46,6 +168,7 @@ type Meta interface {
 	Key() *datastore.Key
 	ID() string
 	Exists() bool
+	UpdatedAt() time.Time
 	Print(doc Doc, value interface{}) interface{}
 }
 
@@ -54,11 +177,24 @@ type Kind interface {
 	Key(ctx context.Context, str string, member *datastore.Key) *datastore.Key
 	Data(doc Doc, includeMeta bool) interface{}
 	ValueAt(value reflect.Value, path []string) (reflect.Value, error)
+	Property(path string) (name string, t reflect.Type, err error)
+	Select(value reflect.Value, paths []string) (map[string]interface{}, error)
 	Fields() map[string]Field
 	Scopes(scopes ...string) []string
 	Type() reflect.Type
 	Count(ctx context.Context) (int, error)
 	Increment(ctx context.Context) error
 	Decrement(ctx context.Context) error
+	Counter(ctx context.Context) (CounterStatus, error)
+	Reconcile(ctx context.Context, shards int) (CounterStatus, error)
+	Export(doc Doc, w io.Writer) error
+	Import(doc Doc, r io.Reader, mode ImportMode) (ImportResult, error)
+	Trash(doc Doc, cursor string, limit int) (docs []Doc, next string, err error)
+	Purge(ctx context.Context) (int, error)
+	SoftDeletes() bool
+	KeepsRevisions() bool
+	Diff(from, to Doc) ([]Operation, error)
 	Doc(ctx context.Context, key *datastore.Key, ancestor Doc) (Doc, error)
+	RequiresIfMatch() bool
+	ProjectsFields() bool
 }
@@ -1,27 +1,33 @@
 package apis
 
 import (
+	"errors"
 	"github.com/ales6164/apis/kind"
+	"github.com/ales6164/apis/storage"
 	"google.golang.org/appengine/datastore"
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
 )
 
 type QueryResult struct {
 	Items      []interface{}
-	Total      int
+	Total      int  // -1 if not counted
+	Estimated  bool // Total is the counter of the collection, not of filtered results
 	Count      int
 	Limit      int
 	Offset     int
 	Order      string
 	LinkHeader string
 	StatusCode int
+	docs       []kind.Doc // documents of Items
 }
 
 /*
-Valid params are order, limit, offset, name, id, and filters.
-Filters param is an array of filter pairs:
+Valid params are where, order, fields, cursor, limit, offset and count; see query.go for the syntax.
+Expand param is handled by the caller, see expand.go.
+Filters param is an older form of where and is an array of filter pairs:
 filters[0][filterStr] "fieldName >"
 filters[0][value] "fieldValue"
  */
@@ -31,14 +37,34 @@ func Query(doc kind.Doc, req *http.Request, params map[string][]string) (QueryRe
 		Items: []interface{}{},
 	}
 	hasIncludeMetaHeader := len(req.Header.Get("X-Include-Meta")) > 0
-	q := datastore.NewQuery(doc.Kind().Name())
+	q := storage.NewQuery(doc.Kind().Name())
+	var filters []queryFilter
+	var orders []string
+	var fields []string
 	var filterMap = map[string]map[string]string{}
 	for name, values := range params {
 		switch name {
+		case "where":
+			for _, v := range values {
+				f, err := parseWhere(doc, v)
+				if err != nil {
+					return r, err
+				}
+				filters = append(filters, f)
+			}
 		case "order":
-			v := values[len(values)-1]
-			q = q.Order(v)
-
+			for _, v := range values {
+				o, err := parseOrder(doc, v)
+				if err != nil {
+					return r, err
+				}
+				orders = append(orders, o...)
+			}
+		case "fields":
+			var err error
+			if fields, err = parseFields(doc, values); err != nil {
+				return r, err
+			}
 		case "limit":
 			v := values[len(values)-1]
 			l, err := strconv.Atoi(v)
@@ -57,45 +83,139 @@ func Query(doc kind.Doc, req *http.Request, params map[string][]string) (QueryRe
 			if strings.Split(name, "[")[0] == "filters" {
 				fm := getParams(name)
 				if len(fm["num"]) > 0 && len(fm["nam"]) > 0 {
-					if m, ok := filterMap[fm["num"]]; ok {
-						m[fm["nam"]] = values[len(values)-1]
-						var filterStr = m["filterStr"]
-						var value = m["value"]
-						if len(filterStr) > 0 && len(value) > 0 {
-							q = q.Filter(filterStr, value)
-						}
-					} else {
-						filterMap[fm["num"]] = map[string]string{
-							fm["nam"]: values[len(values)-1],
-						}
+					if _, ok := filterMap[fm["num"]]; !ok {
+						filterMap[fm["num"]] = map[string]string{}
 					}
+					filterMap[fm["num"]][fm["nam"]] = values[len(values)-1]
 				}
 			}
 		}
 	}
+	for _, m := range filterMap {
+		if len(m["filterStr"]) > 0 && len(m["value"]) > 0 {
+			f, err := parseWhere(doc, m["filterStr"]+m["value"])
+			if err != nil {
+				return r, err
+			}
+			filters = append(filters, f)
+		}
+	}
+	if err := checkQuery(filters, orders); err != nil {
+		return r, err
+	}
+	count, err := parseCount(params["count"])
+	if err != nil {
+		return r, err
+	}
+	q = applyFilters(q, filters, orders)
+
+	// fields are filtered after load unless projection can be used and the collection opted in
+	if len(fields) > 0 {
+		if names, ok := projection(doc, fields, filters, orders); ok {
+			if len(names) == 0 {
+				q = q.KeysOnly()
+			} else if doc.Kind().ProjectsFields() {
+				q = q.Project(names...)
+			}
+		}
+	}
 
-	// set limit
-	q = q.Limit(r.Limit)
-	// set offset
-	q = q.Offset(r.Offset)
+	if r.Limit < 1 {
+		return r, errors.New("limit must be positive")
+	}
 
-	var err error
-	r.Total, err = doc.Kind().Count(doc.Context())
+	// cursor paging unless offset is requested; in filters can't have cursors
+	var token cursorToken
+	var cursorPaging = len(params["cursor"]) > 0 || (len(params["offset"]) == 0 && !hasInFilter(filters))
+	if cursorPaging && hasInFilter(filters) {
+		return r, errors.New("cursor can't be used with in filters, use offset")
+	}
+	if v := params["cursor"]; len(v) > 0 {
+		var err error
+		if token, err = decodeCursorToken(v[len(v)-1]); err != nil {
+			return r, err
+		}
+		q = q.Start(token.Cursor)
+	}
+
+	switch count {
+	case CountExact:
+		r.Total, err = applyFilters(storage.NewQuery(doc.Kind().Name()), filters, nil).KeysOnly().Count(doc.Context())
+	case CountEstimate:
+		r.Total, err = doc.Kind().Count(doc.Context())
+		r.Estimated = len(filters) > 0
+	default:
+		r.Total = -1
+	}
 	if err != nil {
 		return r, err
 	}
 
+	// without exact total, offset pages look for the next one like cursor pages
+	var probe = cursorPaging || r.Total < 0 || r.Estimated
+	if probe {
+		// one more to see if there is a next page
+		q = q.Limit(r.Limit + 1)
+	} else {
+		q = q.Limit(r.Limit)
+	}
+	if !cursorPaging {
+		q = q.Offset(r.Offset)
+	}
+
+	var hasNext bool
+	var endCursor string
 	t := q.Run(doc.Context())
 	for {
+		if probe && r.Count == r.Limit {
+			if cursorPaging {
+				if endCursor, err = t.Cursor(); err != nil {
+					return r, err
+				}
+			}
+			_, err = t.Next(doc.Copy())
+			if err != datastore.Done {
+				if _, ok := err.(*datastore.ErrFieldMismatch); err != nil && !ok {
+					return r, err
+				}
+				hasNext = true
+			}
+			break
+		}
+
 		var h = doc.Copy()
 		key, err := t.Next(h)
-		h.SetKey(key)
 		if err == datastore.Done {
 			break
 		}
+		if err != nil {
+			if _, ok := err.(*datastore.ErrFieldMismatch); !ok {
+				return r, err
+			}
+		}
+		h.SetKey(key)
+		if err = h.Loaded(); err != nil {
+			return r, err
+		}
 
 		r.Count++
-		r.Items = append(r.Items, doc.Kind().Data(h, hasIncludeMetaHeader))
+		r.docs = append(r.docs, h)
+		if len(fields) > 0 {
+			item, err := selectData(h, fields, hasIncludeMetaHeader)
+			if err != nil {
+				return r, err
+			}
+			r.Items = append(r.Items, item)
+		} else {
+			r.Items = append(r.Items, doc.Kind().Data(h, hasIncludeMetaHeader))
+		}
+	}
+
+	// estimate is exact on the last page when the offset is known
+	if r.Estimated && !hasNext && (!cursorPaging || len(token.Cursor) == 0) {
+		r.Total, r.Estimated = r.Offset+r.Count, false
+	} else if r.Estimated && !cursorPaging && r.Total < r.Offset+r.Count+1 {
+		r.Total = r.Offset + r.Count + 1
 	}
 
 	if r.Count > 0 {
@@ -104,32 +224,60 @@ func Query(doc kind.Doc, req *http.Request, params map[string][]string) (QueryRe
 		r.StatusCode = http.StatusNoContent
 	}
 
-	var linkHeader []string
-	if (r.Total - r.Offset - r.Count) > 0 {
-		// has more items to fetch
+	link := func(rel string, set func(q url.Values)) string {
 		q := req.URL.Query()
-		q.Set("offset", strconv.Itoa(r.Offset+r.Count))
-		linkHeader = append(linkHeader, "<"+getSchemeAndHost(req)+req.URL.Path+"?"+q.Encode()+`>; rel="next"`)
-		if (r.Total - r.Offset - r.Count - r.Limit) > 0 {
-			// next is not last
-			q := req.URL.Query()
-			q.Set("offset", strconv.Itoa(r.Total+r.Limit))
-			linkHeader = append(linkHeader, "<"+getSchemeAndHost(req)+req.URL.Path+"?"+q.Encode()+`>; rel="last"`)
-		}
+		q.Del("cursor")
+		q.Del("offset")
+		set(q)
+		return "<" + getSchemeAndHost(req) + req.URL.Path + "?" + q.Encode() + `>; rel="` + rel + `"`
 	}
-	if r.Offset > 0 {
-		// get previous link
-		q := req.URL.Query()
-		offset := r.Offset - r.Limit
-		if offset < 0 {
-			offset = 0
+
+	var linkHeader []string
+	if cursorPaging {
+		if hasNext {
+			linkHeader = append(linkHeader, link("next", func(q url.Values) {
+				q.Set("cursor", token.next(endCursor).encode())
+			}))
 		}
-		q.Set("offset", strconv.Itoa(r.Offset-r.Limit))
-		linkHeader = append(linkHeader, "<"+getSchemeAndHost(req)+req.URL.Path+"?"+q.Encode()+`>; rel="prev"`)
-		if offset > 0 {
-			// previous is not first
-			q.Set("offset", "0")
-			linkHeader = append(linkHeader, "<"+getSchemeAndHost(req)+req.URL.Path+"?"+q.Encode()+`>; rel="first"`)
+		if prev, ok := token.prev(); ok {
+			linkHeader = append(linkHeader, link("prev", func(q url.Values) {
+				if len(prev.Cursor) > 0 || len(prev.Prev) > 0 {
+					q.Set("cursor", prev.encode())
+				}
+			}))
+		}
+		if len(token.Cursor) > 0 {
+			linkHeader = append(linkHeader, link("first", func(q url.Values) {}))
+		}
+	} else {
+		if (probe && hasNext) || (!probe && (r.Total-r.Offset-r.Count) > 0) {
+			// has more items to fetch
+			linkHeader = append(linkHeader, link("next", func(q url.Values) {
+				q.Set("offset", strconv.Itoa(r.Offset+r.Count))
+			}))
+			if !probe && (r.Total-r.Offset-r.Count-r.Limit) > 0 {
+				// next is not last; last page starts at a multiple of limit from current offset
+				last := r.Offset + ((r.Total-r.Offset-1)/r.Limit)*r.Limit
+				linkHeader = append(linkHeader, link("last", func(q url.Values) {
+					q.Set("offset", strconv.Itoa(last))
+				}))
+			}
+		}
+		if r.Offset > 0 {
+			// get previous link
+			offset := r.Offset - r.Limit
+			if offset < 0 {
+				offset = 0
+			}
+			linkHeader = append(linkHeader, link("prev", func(q url.Values) {
+				q.Set("offset", strconv.Itoa(offset))
+			}))
+			if offset > 0 {
+				// previous is not first
+				linkHeader = append(linkHeader, link("first", func(q url.Values) {
+					q.Set("offset", "0")
+				}))
+			}
 		}
 	}
 
@@ -138,6 +286,18 @@ func Query(doc kind.Doc, req *http.Request, params map[string][]string) (QueryRe
 	return r, nil
 }
 
+// Header pairs with the total for PrintJSON. Empty values aren't set.
+func (r QueryResult) totalHeaders() []string {
+	var total, estimated string
+	if r.Total >= 0 {
+		total = strconv.Itoa(r.Total)
+	}
+	if r.Estimated {
+		estimated = "true"
+	}
+	return []string{"X-Total-Count", total, TotalEstimatedHeader, estimated}
+}
+
 /*
 /kinds QUERY, POST
 /kinds/{key} GET, PUT, DELETE
@@ -18,6 +18,15 @@ var (
 	ErrPasswordTooShort  = errors.New("password must be at least 6 characters long")
 )
 
+func init() {
+	apis.RegisterError(ErrEmailUndefined, apis.ErrorType{Status: http.StatusBadRequest, Code: "email_required"})
+	apis.RegisterError(ErrPasswordUndefined, apis.ErrorType{Status: http.StatusBadRequest, Code: "password_required"})
+	apis.RegisterError(ErrInvalidCallback, apis.ErrorType{Status: http.StatusBadRequest, Code: "invalid_callback"})
+	apis.RegisterError(ErrInvalidEmail, apis.ErrorType{Status: http.StatusBadRequest, Code: "invalid_email"})
+	apis.RegisterError(ErrPasswordTooLong, apis.ErrorType{Status: http.StatusBadRequest, Code: "password_too_long"})
+	apis.RegisterError(ErrPasswordTooShort, apis.ErrorType{Status: http.StatusBadRequest, Code: "password_too_short"})
+}
+
 type Provider struct {
 	*Config
 	*apis.Auth
@@ -51,38 +60,38 @@ func (p *Provider) Login(ctx apis.Context) {
 	password, _ := jsonparser.GetString(body, "password")
 
 	if len(email) == 0 {
-		ctx.PrintError(ErrEmailUndefined.Error(), http.StatusBadRequest)
+		ctx.PrintProblem(ErrEmailUndefined, http.StatusBadRequest)
 		return
 	} else if !govalidator.IsEmail(email) || len(email) > 128 || len(email) < 5 {
-		ctx.PrintError(ErrInvalidEmail.Error(), http.StatusBadRequest)
+		ctx.PrintProblem(ErrInvalidEmail, http.StatusBadRequest)
 		return
 	}
 
 	if len(password) > 256 {
-		ctx.PrintError(ErrPasswordTooLong.Error(), http.StatusBadRequest)
+		ctx.PrintProblem(ErrPasswordTooLong, http.StatusBadRequest)
 		return
 	} else if len(password) < 6 {
-		ctx.PrintError(ErrPasswordTooShort.Error(), http.StatusBadRequest)
+		ctx.PrintProblem(ErrPasswordTooShort, http.StatusBadRequest)
 		return
 	}
 
 	// create user
 	identity, err := p.Auth.GetIdentity(ctx, p, email, password)
 	if err != nil {
-		ctx.PrintError(err.Error(), http.StatusConflict)
+		ctx.PrintProblem(err, http.StatusConflict)
 		return
 	}
 
 	// create session
 	session, err := p.NewSession(ctx, p.Name(), identity.IdentityKey, identity.UserKey, identity.User.Roles...)
 	if err != nil {
-		ctx.PrintError(err.Error(), http.StatusConflict)
+		ctx.PrintProblem(err, http.StatusConflict)
 		return
 	}
 
 	signedToken, err := p.Auth.SignedToken(session)
 	if err != nil {
-		ctx.PrintError(err.Error(), http.StatusInternalServerError)
+		ctx.PrintProblem(err, http.StatusInternalServerError)
 		return
 	}
 
@@ -103,38 +112,38 @@ func (p *Provider) Register(ctx apis.Context) {
 	password, _ := jsonparser.GetString(body, "password")
 
 	if len(email) == 0 {
-		ctx.PrintError(ErrEmailUndefined.Error(), http.StatusBadRequest)
+		ctx.PrintProblem(ErrEmailUndefined, http.StatusBadRequest)
 		return
 	} else if !govalidator.IsEmail(email) || len(email) > 128 || len(email) < 5 {
-		ctx.PrintError(ErrInvalidEmail.Error(), http.StatusBadRequest)
+		ctx.PrintProblem(ErrInvalidEmail, http.StatusBadRequest)
 		return
 	}
 
 	if len(password) > 256 {
-		ctx.PrintError(ErrPasswordTooLong.Error(), http.StatusBadRequest)
+		ctx.PrintProblem(ErrPasswordTooLong, http.StatusBadRequest)
 		return
 	} else if len(password) < 6 {
-		ctx.PrintError(ErrPasswordTooShort.Error(), http.StatusBadRequest)
+		ctx.PrintProblem(ErrPasswordTooShort, http.StatusBadRequest)
 		return
 	}
 
 	// create user
 	identity, err := p.Auth.CreateUser(ctx, p, email, false, password)
 	if err != nil {
-		ctx.PrintError(err.Error(), http.StatusConflict)
+		ctx.PrintProblem(err, http.StatusConflict)
 		return
 	}
 
 	// create session
 	session, err := p.NewSession(ctx, p.Name(), identity.IdentityKey, identity.UserKey, identity.User.Roles...)
 	if err != nil {
-		ctx.PrintError(err.Error(), http.StatusConflict)
+		ctx.PrintProblem(err, http.StatusConflict)
 		return
 	}
 
 	signedToken, err := p.Auth.SignedToken(session)
 	if err != nil {
-		ctx.PrintError(err.Error(), http.StatusInternalServerError)
+		ctx.PrintProblem(err, http.StatusInternalServerError)
 		return
 	}
 
@@ -0,0 +1,376 @@
+package apis
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/ales6164/apis/kind"
+	"github.com/ales6164/apis/storage"
+	"google.golang.org/appengine/datastore"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+Query language used by collection listings:
+where=price>10
+where=tags in [a,b]
+where=address.city="New York"
+order=-createdAt,name
+
+Field names are JSON names of collection fields. Values are converted to the field type.
+*/
+
+var whereExpr = regexp.MustCompile(`^\s*([\w.]+)\s*(<=|>=|==|!=|=|<|>|\bnot in\b|\bin\b)\s*(.*?)\s*$`)
+
+var (
+	timeType = reflect.TypeOf(time.Time{})
+	keyType  = reflect.TypeOf(&datastore.Key{})
+)
+
+type queryFilter struct {
+	field string // JSON name
+	name  string // datastore property name
+	op    string
+	value interface{}
+}
+
+// parses where expression into filter on datastore property
+func parseWhere(doc kind.Doc, expr string) (queryFilter, error) {
+	m := whereExpr.FindStringSubmatch(expr)
+	if m == nil {
+		return queryFilter{}, fmt.Errorf("invalid where expression %q", expr)
+	}
+	return newQueryFilter(doc, m[1], m[2], m[3])
+}
+
+func newQueryFilter(doc kind.Doc, field, op, raw string) (queryFilter, error) {
+	var f = queryFilter{field: field}
+	switch op {
+	case "<", "<=", "=", ">=", ">", "in":
+		f.op = op
+	case "==":
+		f.op = "="
+	default:
+		return f, fmt.Errorf("operator %q is not supported", op)
+	}
+
+	name, t, err := doc.Kind().Property(field)
+	if err != nil {
+		return f, err
+	}
+	f.name = name
+
+	// multi-valued properties match on any of their values
+	if t.Kind() == reflect.Slice && t.Elem().Kind() != reflect.Uint8 {
+		t = t.Elem()
+	}
+
+	if f.op == "in" {
+		if !strings.HasPrefix(raw, "[") || !strings.HasSuffix(raw, "]") {
+			return f, fmt.Errorf("value of in operator on %q must be a list like [a,b]", field)
+		}
+		var values []interface{}
+		for _, item := range splitList(raw[1 : len(raw)-1]) {
+			v, err := coerce(doc, t, item)
+			if err != nil {
+				return f, fmt.Errorf("invalid value for %q: %v", field, err)
+			}
+			values = append(values, v)
+		}
+		if len(values) == 0 || len(values) > storage.MaxInValues {
+			return f, fmt.Errorf("in operator on %q needs 1 to %d values", field, storage.MaxInValues)
+		}
+		f.value = values
+		return f, nil
+	}
+
+	if f.value, err = coerce(doc, t, raw); err != nil {
+		return f, fmt.Errorf("invalid value for %q: %v", field, err)
+	}
+	return f, nil
+}
+
+// splits comma separated list; commas inside quotes are kept
+func splitList(s string) []string {
+	var items []string
+	var quote rune
+	var start int
+	for i, r := range s {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == '"' || r == '\'':
+			quote = r
+		case r == ',':
+			items = append(items, s[start:i])
+			start = i + 1
+		}
+	}
+	if len(strings.TrimSpace(s)) > 0 {
+		items = append(items, s[start:])
+	}
+	return items
+}
+
+func unquote(s string) string {
+	s = strings.TrimSpace(s)
+	if len(s) > 1 && (s[0] == '"' || s[0] == '\'') && s[len(s)-1] == s[0] {
+		return s[1 : len(s)-1]
+	}
+	return s
+}
+
+// converts query value to the type datastore stores for t
+func coerce(doc kind.Doc, t reflect.Type, raw string) (interface{}, error) {
+	raw = unquote(raw)
+	switch t {
+	case timeType:
+		for _, layout := range []string{time.RFC3339Nano, "2006-01-02"} {
+			if v, err := time.Parse(layout, raw); err == nil {
+				return v, nil
+			}
+		}
+		return nil, fmt.Errorf("%q is not a RFC 3339 time or date", raw)
+	case keyType:
+		if v, err := datastore.DecodeKey(raw); err == nil {
+			return v, nil
+		}
+		if v := doc.Kind().Key(doc.Context(), raw, nil); v != nil {
+			return v, nil
+		}
+		return nil, fmt.Errorf("%q is not a key", raw)
+	}
+	switch t.Kind() {
+	case reflect.String:
+		return raw, nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.ParseInt(raw, 10, t.Bits())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		v, err := strconv.ParseUint(raw, 10, t.Bits())
+		return int64(v), err
+	case reflect.Float32, reflect.Float64:
+		return strconv.ParseFloat(raw, t.Bits())
+	case reflect.Bool:
+		return strconv.ParseBool(raw)
+	}
+	return nil, fmt.Errorf("fields of type %s can't be queried", t)
+}
+
+// parses comma separated order list
+func parseOrder(doc kind.Doc, s string) ([]string, error) {
+	var orders []string
+	for _, field := range strings.Split(s, ",") {
+		field = strings.TrimSpace(field)
+		var desc string
+		if strings.HasPrefix(field, "-") {
+			desc = "-"
+			field = field[1:]
+		} else if strings.HasPrefix(field, "+") {
+			field = field[1:]
+		}
+		if len(field) == 0 {
+			return nil, errors.New("empty order field")
+		}
+		name, _, err := doc.Kind().Property(field)
+		if err != nil {
+			return nil, err
+		}
+		orders = append(orders, desc+name)
+	}
+	return orders, nil
+}
+
+// Datastore allows inequality filters on one property only and that property has to be
+// ordered first.
+func checkQuery(filters []queryFilter, orders []string) error {
+	var inequality *queryFilter
+	for i, f := range filters {
+		switch f.op {
+		case "<", "<=", ">=", ">":
+			if inequality != nil && inequality.name != f.name {
+				return fmt.Errorf("inequality filters are allowed on one field only, got %q and %q", inequality.field, f.field)
+			}
+			inequality = &filters[i]
+		}
+	}
+	if inequality != nil && len(orders) > 0 && strings.TrimPrefix(orders[0], "-") != inequality.name {
+		return fmt.Errorf("first order must be on %q because it has an inequality filter", inequality.field)
+	}
+	return nil
+}
+
+func applyFilters(q *storage.Query, filters []queryFilter, orders []string) *storage.Query {
+	for _, f := range filters {
+		if f.op == "in" {
+			q = q.Filter(f.name+" in", f.value)
+		} else {
+			q = q.Filter(f.name+" "+f.op, f.value)
+		}
+	}
+	for _, o := range orders {
+		q = q.Order(o)
+	}
+	return q
+}
+
+/*
+Ways to count results of a listing, chosen with count param. Counters are kept per namespace,
+so listings of nested collections like /projects/{id}/objects count documents of their parent.
+Listings estimate unless exact or none is asked for, since exact counts read every key.
+*/
+const (
+	CountExact    = "exact"    // keys-only query with the filters
+	CountEstimate = "estimate" // counter of the collection; filtered listings mark it as estimate
+	CountNone     = "none"     // no total
+)
+
+// Header that marks X-Total-Count as estimate.
+const TotalEstimatedHeader = "X-Total-Count-Estimated"
+
+func parseCount(values []string) (string, error) {
+	if len(values) == 0 || len(values[len(values)-1]) == 0 {
+		return CountEstimate, nil
+	}
+	switch v := values[len(values)-1]; v {
+	case CountExact, CountEstimate, CountNone:
+		return v, nil
+	default:
+		return "", fmt.Errorf("count must be %s, %s or %s", CountExact, CountEstimate, CountNone)
+	}
+}
+
+// Keeps start cursors of a few previous pages so that prev links can be built;
+// datastore cursors only move forward.
+const maxCursorHistory = 5
+
+// Opaque cursor token used in cursor query param.
+type cursorToken struct {
+	Cursor string   `json:"c,omitempty"` // start of the page
+	Prev   []string `json:"p,omitempty"` // starts of previous pages, nearest first
+}
+
+func (t cursorToken) encode() string {
+	b, _ := json.Marshal(t)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeCursorToken(s string) (cursorToken, error) {
+	var t cursorToken
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err == nil {
+		err = json.Unmarshal(b, &t)
+	}
+	if err != nil {
+		return t, errors.New("invalid cursor")
+	}
+	return t, nil
+}
+
+// token for the page after t, which ends at cursor
+func (t cursorToken) next(cursor string) cursorToken {
+	prev := append([]string{t.Cursor}, t.Prev...)
+	if len(prev) > maxCursorHistory {
+		prev = prev[:maxCursorHistory]
+	}
+	return cursorToken{Cursor: cursor, Prev: prev}
+}
+
+// token for the page before t; ok is false when it is not known anymore
+func (t cursorToken) prev() (cursorToken, bool) {
+	if len(t.Prev) == 0 {
+		return t, false
+	}
+	return cursorToken{Cursor: t.Prev[0], Prev: t.Prev[1:]}, true
+}
+
+func hasInFilter(filters []queryFilter) bool {
+	for _, f := range filters {
+		if f.op == "in" {
+			return true
+		}
+	}
+	return false
+}
+
+// parses comma separated fields param; paths are checked against collection fields
+func parseFields(doc kind.Doc, values []string) ([]string, error) {
+	var fields []string
+	for _, v := range values {
+		for _, field := range strings.Split(v, ",") {
+			if field = strings.TrimSpace(field); len(field) > 0 {
+				fields = append(fields, field)
+			}
+		}
+	}
+	if len(fields) == 0 {
+		return nil, errors.New("fields can't be empty")
+	}
+	if _, err := doc.Kind().Select(reflect.New(doc.Type()), fields); err != nil {
+		return nil, err
+	}
+	return fields, nil
+}
+
+// Datastore projection can be used when every field is an indexed single value that isn't
+// filtered by equality, and every order is projected. Keys only are enough for the id field.
+// Documents without a projected property aren't returned, see Collection.ProjectFields.
+func projection(doc kind.Doc, fields []string, filters []queryFilter, orders []string) (names []string, ok bool) {
+	var projected = map[string]bool{}
+	for _, field := range fields {
+		name, t, err := doc.Kind().Property(field)
+		if err != nil {
+			return nil, false
+		}
+		if name == "__key__" {
+			continue
+		}
+		switch t.Kind() {
+		case reflect.String, reflect.Bool, reflect.Float32, reflect.Float64,
+			reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		default:
+			if t != keyType {
+				return nil, false
+			}
+		}
+		for _, f := range filters {
+			if f.name == name && (f.op == "=" || f.op == "in") {
+				return nil, false
+			}
+		}
+		if !projected[name] {
+			projected[name] = true
+			names = append(names, name)
+		}
+	}
+	for _, o := range orders {
+		if name := strings.TrimPrefix(o, "-"); name != "__key__" && !projected[name] {
+			return nil, false
+		}
+	}
+	return names, true
+}
+
+// data of document limited to fields
+func selectData(doc kind.Doc, fields []string, includeMeta bool) (interface{}, error) {
+	// fills auto fields
+	doc.Kind().Data(doc, false)
+	out, err := doc.Kind().Select(doc.Value(), fields)
+	if err != nil {
+		return nil, err
+	}
+	if includeMeta {
+		meta, err := doc.Meta()
+		if err != nil {
+			return nil, err
+		}
+		return meta.Print(doc, out), nil
+	}
+	return out, nil
+}
@@ -0,0 +1,210 @@
+package apis
+
+import (
+	"github.com/ales6164/apis/collection"
+	"github.com/ales6164/apis/kind"
+	"github.com/ales6164/apis/storage"
+	"google.golang.org/appengine"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+type address struct {
+	City string `json:"city"`
+}
+
+type product struct {
+	Id      string    `datastore:"-" auto:"id" json:"id"`
+	Name    string    `json:"name"`
+	Price   float64   `json:"price"`
+	Stock   int       `datastore:"stock" json:"stock"`
+	Active  bool      `json:"active"`
+	Tags    []string  `json:"tags"`
+	Date    time.Time `json:"date"`
+	Address address   `json:"address"`
+	Note    string    `datastore:",noindex" json:"note"`
+	Secret  string    `datastore:"-" json:"secret"`
+}
+
+var products = collection.New("products", product{})
+
+func newDoc(t *testing.T) kind.Doc {
+	t.Helper()
+	ctx := storage.NewContext(appengine.NewContext(httptest.NewRequest("GET", "/", nil)), storage.NewMemory())
+	doc, err := products.Doc(ctx, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return doc
+}
+
+func TestParseWhere(t *testing.T) {
+	doc := newDoc(t)
+	date := time.Date(2020, 5, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		expr string
+		want queryFilter
+		err  string // part of error message; empty if there's none
+	}{
+		{expr: "price>10", want: queryFilter{field: "price", name: "Price", op: ">", value: 10.0}},
+		{expr: " stock <= 3 ", want: queryFilter{field: "stock", name: "stock", op: "<=", value: int64(3)}},
+		{expr: "name==a", want: queryFilter{field: "name", name: "Name", op: "=", value: "a"}},
+		{expr: `name="New, York"`, want: queryFilter{field: "name", name: "Name", op: "=", value: "New, York"}},
+		{expr: "active=true", want: queryFilter{field: "active", name: "Active", op: "=", value: true}},
+		{expr: "date>=2020-05-01", want: queryFilter{field: "date", name: "Date", op: ">=", value: date}},
+		{expr: "date<2020-05-01T00:00:00Z", want: queryFilter{field: "date", name: "Date", op: "<", value: date}},
+		{expr: `address.city='New York'`, want: queryFilter{field: "address.city", name: "Address.City", op: "=", value: "New York"}},
+		{expr: "tags=a", want: queryFilter{field: "tags", name: "Tags", op: "=", value: "a"}},
+		{expr: `tags in [a,"b,c"]`, want: queryFilter{field: "tags", name: "Tags", op: "in", value: []interface{}{"a", "b,c"}}},
+		{expr: "stock in [1, 2]", want: queryFilter{field: "stock", name: "stock", op: "in", value: []interface{}{int64(1), int64(2)}}},
+		{expr: "price", err: "invalid where expression"},
+		{expr: "price!=1", err: "not supported"},
+		{expr: "tags not in [a]", err: "not supported"},
+		{expr: "color=red", err: "unknown field"},
+		{expr: "note=a", err: "not indexed"},
+		{expr: "secret=a", err: "not stored"},
+		{expr: "stock=many", err: "invalid value"},
+		{expr: "date=yesterday", err: "invalid value"},
+		{expr: "tags in a,b", err: "must be a list"},
+		{expr: "tags in []", err: "needs 1 to"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			got, err := parseWhere(doc, tt.expr)
+			if len(tt.err) > 0 {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("expected error with %q, got %v", tt.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("got %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckQuery(t *testing.T) {
+	doc := newDoc(t)
+	tests := []struct {
+		name   string
+		where  []string
+		order  string
+		failed bool
+	}{
+		{name: "equality filters", where: []string{"name=a", "active=true"}, order: "-stock"},
+		{name: "range on one field", where: []string{"price>1", "price<10"}},
+		{name: "range ordered by its field", where: []string{"price>1"}, order: "-price,name"},
+		{name: "range on two fields", where: []string{"price>1", "stock<10"}, failed: true},
+		{name: "range ordered by other field", where: []string{"price>1"}, order: "name", failed: true},
+		{name: "range ordered by its field second", where: []string{"price>1"}, order: "name,price", failed: true},
+		{name: "in with order", where: []string{"tags in [a,b]"}, order: "name"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var filters []queryFilter
+			for _, expr := range tt.where {
+				f, err := parseWhere(doc, expr)
+				if err != nil {
+					t.Fatal(err)
+				}
+				filters = append(filters, f)
+			}
+			var orders []string
+			if len(tt.order) > 0 {
+				var err error
+				if orders, err = parseOrder(doc, tt.order); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := checkQuery(filters, orders); (err != nil) != tt.failed {
+				t.Fatalf("checkQuery returned %v", err)
+			}
+		})
+	}
+}
+
+func TestParseOrder(t *testing.T) {
+	doc := newDoc(t)
+	got, err := parseOrder(doc, "-date, +name,address.city")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"-Date", "Name", "Address.City"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for _, s := range []string{"", "name,", "-", "color"} {
+		if _, err := parseOrder(doc, s); err == nil {
+			t.Errorf("order %q was accepted", s)
+		}
+	}
+}
+
+func TestParseCount(t *testing.T) {
+	for values, want := range map[string]string{
+		"":         CountEstimate,
+		"exact":    CountExact,
+		"estimate": CountEstimate,
+		"none":     CountNone,
+	} {
+		got, err := parseCount(strings.Split(values, ","))
+		if err != nil || got != want {
+			t.Errorf("count=%s is %s, %v; want %s", values, got, err, want)
+		}
+	}
+	if got, _ := parseCount(nil); got != CountEstimate {
+		t.Errorf("default count is %s", got)
+	}
+	if _, err := parseCount([]string{"all"}); err == nil {
+		t.Error("count=all was accepted")
+	}
+}
+
+func TestCursorToken(t *testing.T) {
+	var token cursorToken
+	var pages []string
+	for i := 0; i < maxCursorHistory+2; i++ {
+		cursor := "c" + strconv.Itoa(i)
+		token = token.next(cursor)
+		pages = append(pages, cursor)
+
+		decoded, err := decodeCursorToken(token.encode())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(decoded, token) {
+			t.Fatalf("decoded %+v, encoded %+v", decoded, token)
+		}
+	}
+	if len(token.Prev) != maxCursorHistory {
+		t.Fatalf("token keeps %d previous pages", len(token.Prev))
+	}
+
+	// previous pages are walked back until the history ends
+	for i := len(pages) - 2; ; i-- {
+		prev, ok := token.prev()
+		if !ok {
+			if want := len(pages) - 1 - maxCursorHistory; i+1 != want {
+				t.Fatalf("history ended at page %d, want %d", i+1, want)
+			}
+			break
+		}
+		if prev.Cursor != pages[i] {
+			t.Fatalf("page before %s is %s, want %s", token.Cursor, prev.Cursor, pages[i])
+		}
+		token = prev
+	}
+
+	for _, s := range []string{"%%", "bm90IGpzb24"} {
+		if _, err := decodeCursorToken(s); err == nil {
+			t.Errorf("cursor %q was accepted", s)
+		}
+	}
+}
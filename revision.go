@@ -0,0 +1,121 @@
+package apis
+
+import (
+	"github.com/ales6164/apis/kind"
+	"net/http"
+	"strconv"
+)
+
+type revisionResponse struct {
+	kind.Revision
+	Value interface{} `json:"value"`
+}
+
+/*
+Serves previous versions of documents in collections that keep revisions:
+
+	GET  /{kind}/{id}/_revisions                   lists revisions, most recent first
+	GET  /{kind}/{id}/_revisions/{rev}             gets one
+	GET  /{kind}/{id}/_revisions/{rev}/_diff?to=   JSON Patch from rev to another revision or
+	                                               the current document when to is empty
+	POST /{kind}/{id}/_revisions/{rev}/_restore    writes rev as the current version
+
+Restore is a normal write, so it's stored as a revision too and can be undone.
+*/
+func serveRevisions(ctx Context, rules Rules, document kind.Doc, path []string) {
+	if !document.Kind().KeepsRevisions() || len(path) > 2 || (len(path) == 2 && path[1] != "_diff" && path[1] != "_restore") {
+		ctx.PrintError(http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	method := http.MethodGet
+	if len(path) == 2 && path[1] == "_restore" {
+		method = http.MethodPost
+	}
+	if ctx.r.Method != method {
+		ctx.PrintError(http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	scopes := []string{ReadOnly, ReadWrite, FullControl}
+	if method == http.MethodPost {
+		scopes = []string{ReadWrite, FullControl}
+	}
+	if ok := checkAccess(ctx, rules, document, scopes...); !ok {
+		return
+	}
+
+	if len(path) == 0 {
+		limit, ok := pageLimit(ctx)
+		if !ok {
+			return
+		}
+		revisions, next, err := document.Revisions(ctx.r.URL.Query().Get("cursor"), limit)
+		if err != nil {
+			ctx.PrintProblem(err, http.StatusBadRequest)
+			return
+		}
+		var items = []revisionResponse{}
+		for _, rev := range revisions {
+			items = append(items, revisionResponse{Revision: rev, Value: rev.Doc.Kind().Data(rev.Doc, false)})
+		}
+		ctx.w.Header().Set("Cache-Control", rules.cacheControl(document, nil))
+		ctx.PrintJSON(items, http.StatusOK, "Link", nextLink(ctx.r, next))
+		return
+	}
+
+	rev, ok := getRevision(ctx, document, path[0])
+	if !ok {
+		return
+	}
+	switch {
+	case len(path) == 1:
+		ctx.w.Header().Set("Cache-Control", rules.cacheControl(document, nil))
+		ctx.PrintJSON(revisionResponse{Revision: rev, Value: rev.Doc.Kind().Data(rev.Doc, false)}, http.StatusOK)
+	case path[1] == "_diff":
+		var to kind.Doc
+		if id := ctx.r.URL.Query().Get("to"); len(id) > 0 {
+			other, ok := getRevision(ctx, document, id)
+			if !ok {
+				return
+			}
+			to = other.Doc
+		} else {
+			var err error
+			if to, err = document.Get(); err != nil {
+				ctx.PrintProblem(err, http.StatusInternalServerError)
+				return
+			}
+		}
+		ops, err := document.Kind().Diff(rev.Doc, to)
+		if err != nil {
+			ctx.PrintProblem(err, http.StatusInternalServerError)
+			return
+		}
+		ctx.w.Header().Set("Cache-Control", rules.cacheControl(document, nil))
+		ctx.PrintJSON(ops, http.StatusOK)
+	case path[1] == "_restore":
+		if ok := checkPrecondition(ctx, document); !ok {
+			return
+		}
+		document, err := document.Set(rev.Doc.Value().Interface())
+		if err != nil {
+			ctx.PrintProblem(err, http.StatusInternalServerError)
+			return
+		}
+		ctx.PrintJSON(document.Kind().Data(document, ctx.hasIncludeMetaHeader), http.StatusOK, "ETag", representationETag(ctx, document, nil))
+	}
+}
+
+// Gets revision by id from path. Responds with 404 if there is no such revision.
+func getRevision(ctx Context, document kind.Doc, id string) (kind.Revision, bool) {
+	n, err := strconv.ParseInt(id, 10, 64)
+	if err != nil || n <= 0 {
+		ctx.PrintError(http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return kind.Revision{}, false
+	}
+	rev, err := document.Revision(n)
+	if err != nil {
+		ctx.PrintProblem(err, http.StatusInternalServerError)
+		return rev, false
+	}
+	return rev, true
+}
@@ -0,0 +1,84 @@
+package apis_test
+
+import (
+	"fmt"
+	"github.com/ales6164/apis/collection"
+	"github.com/ales6164/apis/kind"
+	"net/http"
+	"testing"
+)
+
+type revision struct {
+	kind.Revision
+	Value Object `json:"value"`
+}
+
+func TestRevisions(t *testing.T) {
+	versioned := collection.New("versioned", Object{})
+	versioned.KeepRevisions = true
+	_, c := newServer(t, nil, versioned)
+	o := create(t, c, "/versioned", Object{Name: "a"})
+	path := "/versioned/" + o.Id
+	c.Put(path, Object{Name: "b"}).Expect(t, http.StatusOK)
+	c.Put(path, Object{Name: "c"}).Expect(t, http.StatusOK)
+
+	var revisions []revision
+	c.Get(path+"/_revisions").Expect(t, http.StatusOK).JSON(&revisions)
+	if len(revisions) != 2 || revisions[0].Value.Name != "b" || revisions[1].Value.Name != "a" {
+		t.Fatalf("revisions are %+v", revisions)
+	}
+	a, b := revisions[1], revisions[0]
+	aPath := fmt.Sprintf("%s/_revisions/%d", path, a.ID)
+
+	var got revision
+	c.Get(aPath).Expect(t, http.StatusOK).JSON(&got)
+	if got.ID != a.ID || got.Value.Name != "a" {
+		t.Fatalf("revision %d is %+v", a.ID, got)
+	}
+
+	diff := func(p string) map[string]string {
+		var ops []kind.Operation
+		c.Get(p).Expect(t, http.StatusOK).JSON(&ops)
+		changes := map[string]string{}
+		for _, op := range ops {
+			changes[op.Op+" "+op.Path] = string(op.Value)
+		}
+		return changes
+	}
+	if changes := diff(aPath + "/_diff"); changes["replace /name"] != `"c"` {
+		t.Errorf("diff to the current document is %v", changes)
+	}
+	if changes := diff(fmt.Sprintf("%s/_diff?to=%d", aPath, b.ID)); changes["replace /name"] != `"b"` || changes["replace /version"] != "2" {
+		t.Errorf("diff to revision %d is %v", b.ID, changes)
+	}
+
+	// restore is a write that keeps the replaced version
+	var restored Object
+	c.Post(aPath+"/_restore", nil).Expect(t, http.StatusOK).JSON(&restored)
+	var current Object
+	c.Get(path).Expect(t, http.StatusOK).JSON(&current)
+	if restored.Name != "a" || current.Name != "a" {
+		t.Fatalf("restored %+v, current is %+v", restored, current)
+	}
+	c.Get(path+"/_revisions").Expect(t, http.StatusOK).JSON(&revisions)
+	if len(revisions) != 3 || revisions[0].Value.Name != "c" {
+		t.Fatalf("revisions after restore are %+v", revisions)
+	}
+
+	c.Get(aPath+"/_restore").Expect(t, http.StatusMethodNotAllowed)
+	for _, p := range []string{
+		path + "/_revisions/999999",
+		path + "/_revisions/first",
+		aPath + "/_diff?to=999999",
+		aPath + "/_other",
+	} {
+		c.Get(p).Expect(t, http.StatusNotFound)
+	}
+	c.Post(path+"/_revisions/999999/_restore", nil).Expect(t, http.StatusNotFound)
+
+	// collections without revisions
+	other := create(t, c, "/objects", Object{Name: "a"})
+	c.Put("/objects/"+other.Id, Object{Name: "b"}).Expect(t, http.StatusOK)
+	c.Get("/objects/" + other.Id + "/_revisions").Expect(t, http.StatusNotFound)
+	c.Get("/objects/" + other.Id + "/_revisions/1").Expect(t, http.StatusNotFound)
+}
@@ -3,31 +3,62 @@ package apis
 import (
 	"github.com/ales6164/apis/kind"
 	"google.golang.org/appengine/datastore"
+	"mime"
 	"net/http"
-	"strconv"
 	"strings"
+	"time"
 )
 
 func (a *Apis) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	a.serve(a.NewContext(w, r))
+}
+
+func (a *Apis) serve(ctx Context) {
+	sw := &statusWriter{ResponseWriter: ctx.w}
+	ctx.w = sw
+	w, r := ctx.w, ctx.r
+
 	path := getPath(r.URL.Path)
 
 	rules := a.Rules
 
-	ctx := a.NewContext(w, r)
-
 	var document kind.Doc
 
+	// matched action, like _export or _revisions/_restore
+	var actionName string
+
+	// rules that matched the requested collection
+	var scope Rules
+
+	// path inside the document
+	var valuePath []string
+
+	// action on collection, like _export
+	var action func(ctx Context, rules Rules, document kind.Doc)
+
+	// action on document, like _restore, and path after it
+	var documentAction func(ctx Context, rules Rules, document kind.Doc, path []string)
+	var actionPath []string
+
+	defer func() {
+		ctx.auditRequest(sw.status, document, actionName)
+		ctx.publishChange(sw.status, document, actionName, len(valuePath) > 0)
+	}()
+
 	// analyse path in pairs
 	for i := 0; i < len(path); i += 2 {
 		// get collection kind and match it to rules
 		if k, ok := a.kinds[path[i]]; ok {
-			if rules, ok = rules.Match[k]; ok {
+			if r, ok := rules.Match[k]; ok {
 				// got latest rules
+				scope, rules = rules, r
 				var err error
 
 				// create key
 				var key *datastore.Key
-				if (i + 1) < len(path) {
+				if (i+2) == len(path) && collectionActions[path[i+1]] != nil {
+					action, actionName = collectionActions[path[i+1]], path[i+1]
+				} else if (i + 1) < len(path) {
 					key = k.Key(ctx, path[i+1], ctx.Member())
 					if key == nil {
 						ctx.PrintError("error decoding key", http.StatusBadRequest)
@@ -38,16 +69,62 @@ func (a *Apis) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 				document, err = k.Doc(ctx, key, document)
 
 				if err != nil {
-					ctx.PrintError(err.Error(), http.StatusBadRequest)
+					ctx.PrintProblem(err, http.StatusBadRequest)
 					return
 				}
 				continue
 			}
 		}
+		if document != nil && !document.Key().Incomplete() && documentActions[path[i]] != nil {
+			documentAction, actionPath = documentActions[path[i]], path[i+1:]
+			actionName = path[i]
+			if n := len(actionPath); n > 0 && strings.HasPrefix(actionPath[n-1], "_") {
+				actionName += "/" + actionPath[n-1]
+			}
+			break
+		}
+		// segments after a document that aren't nested collections address a value inside it
+		if document != nil && !document.Key().Incomplete() {
+			valuePath = path[i:]
+			break
+		}
 		ctx.PrintError(http.StatusText(http.StatusNotFound), http.StatusNotFound)
 		return
 	}
 
+	if document != nil {
+		ctx.kind = document.Kind()
+	}
+
+	// bodies of document writes are converted once the kind is known; actions read their own
+	if action == nil && documentAction == nil {
+		if _, err := ctx.ReadBody(); err != nil {
+			ctx.PrintProblem(err, http.StatusBadRequest)
+			return
+		}
+	}
+
+	if len(valuePath) > 0 {
+		serveValue(ctx, rules, document, valuePath)
+		return
+	}
+
+	// queries in a transaction are limited to one entity group
+	if ctx.atomic && document != nil && (action != nil || (ctx.r.Method == http.MethodGet && document.Key().Incomplete())) {
+		ctx.PrintProblem(errAtomicQuery, http.StatusBadRequest)
+		return
+	}
+
+	if action != nil {
+		action(ctx, rules, document)
+		return
+	}
+
+	if documentAction != nil {
+		documentAction(ctx, rules, document, actionPath)
+		return
+	}
+
 	//document.SetMember(ctx.Member(), ctx.session.isAuthenticated)
 
 	// TODO: Check api.Rules for access
@@ -59,15 +136,14 @@ func (a *Apis) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	case http.MethodGet:
 		// check rules
 		if ok := ctx.HasAccess(rules, ReadOnly, ReadWrite, FullControl); !ok {
-			//ctx.PrintError(http.StatusText(http.StatusForbidden), http.StatusForbidden)
-			ctx.PrintJSON(ctx.session, http.StatusForbidden)
+			ctx.PrintForbidden()
 			return
 		}
 
 		// check group access
 		if document.HasAncestor() {
 			if ok := document.Ancestor().HasRole(ctx.Member(), ReadOnly, ReadWrite, FullControl); !ok {
-				ctx.PrintError(http.StatusText(http.StatusForbidden), http.StatusForbidden)
+				ctx.PrintForbidden()
 				return
 			}
 		}
@@ -75,34 +151,91 @@ func (a *Apis) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		if !document.Key().Incomplete() {
 			document, err = document.Get()
 			if err != nil {
-				if err == datastore.ErrNoSuchEntity {
-					ctx.PrintError(http.StatusText(http.StatusNotFound), http.StatusNotFound)
+				ctx.PrintProblem(err, http.StatusInternalServerError)
+				return
+			}
+			var lastModified time.Time
+			if meta, err := document.Meta(); err == nil && meta.Exists() {
+				lastModified = meta.UpdatedAt()
+			}
+			var fields []string
+			if v := r.URL.Query()["fields"]; len(v) > 0 {
+				if fields, err = parseFields(document, v); err != nil {
+					ctx.PrintProblem(err, http.StatusBadRequest)
 					return
 				}
-				ctx.PrintError(err.Error(), http.StatusInternalServerError)
+			}
+			expand, err := parseExpand(document, r.URL.Query()["expand"])
+			if err != nil {
+				ctx.PrintProblem(err, http.StatusBadRequest)
 				return
 			}
-			ctx.PrintJSON(document.Kind().Data(document, ctx.hasIncludeMetaHeader), http.StatusOK)
+			w.Header().Set("Cache-Control", rules.cacheControl(document, expand))
+			if len(expand) == 0 && notModified(w, r, representationETag(ctx, document, fields), lastModified) {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			var data interface{}
+			if len(fields) > 0 {
+				data, err = selectData(document, fields, ctx.hasIncludeMetaHeader)
+				if err != nil {
+					ctx.PrintProblem(err, http.StatusInternalServerError)
+					return
+				}
+			} else {
+				data = document.Kind().Data(document, ctx.hasIncludeMetaHeader)
+			}
+			if len(expand) > 0 {
+				// referenced documents change independently, so the version can't be used as ETag
+				items, err := expander{ctx: ctx, scope: scope, doc: document}.expand([]kind.Doc{document}, []interface{}{data}, expand, ctx.hasIncludeMetaHeader)
+				if err != nil {
+					ctx.PrintProblem(err, http.StatusInternalServerError)
+					return
+				}
+				data = items[0]
+				if notModified(w, r, weakETag(ctx.mediaType, data), time.Time{}) {
+					w.WriteHeader(http.StatusNotModified)
+					return
+				}
+			}
+			ctx.PrintJSON(data, http.StatusOK)
 		} else {
+			expand, err := parseExpand(document, r.URL.Query()["expand"])
+			if err != nil {
+				ctx.PrintProblem(err, http.StatusBadRequest)
+				return
+			}
 			queryResults, err := Query(document, ctx.r, ctx.r.URL.Query())
 			if err != nil {
-				ctx.PrintError(err.Error(), http.StatusBadRequest)
+				ctx.PrintProblem(err, http.StatusBadRequest)
 				return
 			}
+			if len(expand) > 0 {
+				queryResults.Items, err = expander{ctx: ctx, scope: scope, doc: document}.expand(queryResults.docs, queryResults.Items, expand, ctx.hasIncludeMetaHeader)
+				if err != nil {
+					ctx.PrintProblem(err, http.StatusInternalServerError)
+					return
+				}
+			}
 
-			ctx.PrintJSON(queryResults.Items, queryResults.StatusCode, "X-Total-Count", strconv.Itoa(queryResults.Total), "Link", queryResults.LinkHeader)
+			w.Header().Set("Cache-Control", rules.cacheControl(document, expand))
+			if notModified(w, r, weakETag(ctx.mediaType, queryResults.Items, queryResults.Total, queryResults.LinkHeader), time.Time{}) {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			ctx.PrintJSON(queryResults.Items, queryResults.StatusCode, append(queryResults.totalHeaders(), "Link", queryResults.LinkHeader)...)
 		}
 	case http.MethodPost:
 		// check rules
 		if ok := ctx.HasAccess(rules, ReadWrite, FullControl); !ok {
-			ctx.PrintError(http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			ctx.PrintForbidden()
 			return
 		}
 
 		// check group access
 		if document.HasAncestor() {
 			if ok := document.Ancestor().HasRole(ctx.Member(), ReadWrite, FullControl); !ok {
-				ctx.PrintError(http.StatusText(http.StatusForbidden), http.StatusForbidden)
+				ctx.PrintForbidden()
 				return
 			}
 		}
@@ -112,37 +245,40 @@ func (a *Apis) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		} else {
 			document, err = document.Add(ctx.Body())
 			if err != nil {
-				ctx.PrintError(err.Error(), http.StatusInternalServerError)
+				ctx.PrintProblem(err, http.StatusInternalServerError)
 				return
 			}
 			err = document.SetRole(ctx.Member(), FullControl)
 			if err != nil {
-				ctx.PrintError(err.Error(), http.StatusInternalServerError)
+				ctx.PrintProblem(err, http.StatusInternalServerError)
 				return
 			}
-			ctx.PrintJSON(document.Kind().Data(document, ctx.hasIncludeMetaHeader), http.StatusOK)
+			ctx.PrintJSON(document.Kind().Data(document, ctx.hasIncludeMetaHeader), http.StatusOK, "ETag", representationETag(ctx, document, nil))
 		}
 	case http.MethodDelete:
 		// check rules
 		if ok := ctx.HasAccess(rules, Delete, FullControl); !ok {
-			ctx.PrintError(http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			ctx.PrintForbidden()
 			return
 		}
 
 		// check group access
 		if document.HasAncestor() {
 			if ok := document.Ancestor().HasRole(ctx.Member(), Delete, FullControl); !ok {
-				ctx.PrintError(http.StatusText(http.StatusForbidden), http.StatusForbidden)
+				ctx.PrintForbidden()
 				return
 			}
 		}
 
-		if !document.Key().Incomplete() {
+		if document.Key().Incomplete() {
 			ctx.PrintError(http.StatusText(http.StatusNotImplemented), http.StatusNotImplemented)
 		} else {
+			if ok := checkPrecondition(ctx, document); !ok {
+				return
+			}
 			err = document.Delete()
 			if err != nil {
-				ctx.PrintError(err.Error(), http.StatusInternalServerError)
+				ctx.PrintProblem(err, http.StatusInternalServerError)
 				return
 			}
 
@@ -152,14 +288,14 @@ func (a *Apis) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	case http.MethodPut:
 		// check rules
 		if ok := ctx.HasAccess(rules, ReadWrite, FullControl); !ok {
-			ctx.PrintError(http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			ctx.PrintForbidden()
 			return
 		}
 
 		// check group access
 		if document.HasAncestor() {
 			if ok := document.Ancestor().HasRole(ctx.Member(), ReadWrite, FullControl); !ok {
-				ctx.PrintError(http.StatusText(http.StatusForbidden), http.StatusForbidden)
+				ctx.PrintForbidden()
 				return
 			}
 		}
@@ -167,13 +303,56 @@ func (a *Apis) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		if document.Key().Incomplete() {
 			ctx.PrintError(http.StatusText(http.StatusNotImplemented), http.StatusNotImplemented)
 		} else {
+			if ok := checkPrecondition(ctx, document); !ok {
+				return
+			}
 			document, err = document.Set(ctx.Body())
 			if err != nil {
-				ctx.PrintError(err.Error(), http.StatusInternalServerError)
+				ctx.PrintProblem(err, http.StatusInternalServerError)
+				return
+			}
+			ctx.PrintJSON(document.Kind().Data(document, ctx.hasIncludeMetaHeader), http.StatusOK, "ETag", representationETag(ctx, document, nil))
+		}
+	case http.MethodPatch:
+		// check rules
+		if ok := ctx.HasAccess(rules, ReadWrite, FullControl); !ok {
+			ctx.PrintForbidden()
+			return
+		}
+
+		// check group access
+		if document.HasAncestor() {
+			if ok := document.Ancestor().HasRole(ctx.Member(), ReadWrite, FullControl); !ok {
+				ctx.PrintForbidden()
 				return
 			}
-			ctx.PrintJSON(document.Kind().Data(document, ctx.hasIncludeMetaHeader), http.StatusOK)
 		}
+
+		if document.Key().Incomplete() {
+			ctx.PrintError(http.StatusText(http.StatusNotImplemented), http.StatusNotImplemented)
+			return
+		}
+
+		if ok := checkPrecondition(ctx, document); !ok {
+			return
+		}
+
+		mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		switch mediaType {
+		case "application/json-patch+json":
+			document, err = document.Patch(ctx.Body())
+		case "application/merge-patch+json":
+			document, err = document.MergePatch(ctx.Body())
+		default:
+			w.Header().Set("Accept-Patch", "application/json-patch+json, application/merge-patch+json")
+			ctx.PrintError(http.StatusText(http.StatusUnsupportedMediaType), http.StatusUnsupportedMediaType)
+			return
+		}
+		if err != nil {
+			ctx.PrintProblem(err, http.StatusInternalServerError)
+			return
+		}
+		ctx.PrintJSON(document.Kind().Data(document, ctx.hasIncludeMetaHeader), http.StatusOK, "ETag", representationETag(ctx, document, nil))
 	default:
 		ctx.PrintError(http.StatusText(http.StatusNotImplemented), http.StatusNotImplemented)
 
@@ -193,6 +372,35 @@ func (a *Apis) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	return false
 }*/
 
+// Checks rules and group access for scopes. Responds with 403 if there is no access.
+func checkAccess(ctx Context, rules Rules, document kind.Doc, scopes ...string) bool {
+	// check rules
+	if ok := ctx.HasAccess(rules, scopes...); !ok {
+		ctx.PrintForbidden()
+		return false
+	}
+
+	// check group access
+	if document.HasAncestor() {
+		if ok := document.Ancestor().HasRole(ctx.Member(), scopes...); !ok {
+			ctx.PrintForbidden()
+			return false
+		}
+	}
+	return true
+}
+
+// Passes If-Match header to document. Collections that require it get 428 without it.
+func checkPrecondition(ctx Context, document kind.Doc) bool {
+	ifMatch := ctx.r.Header.Get("If-Match")
+	if len(ifMatch) == 0 && document.Kind().RequiresIfMatch() {
+		ctx.PrintError(http.StatusText(http.StatusPreconditionRequired), http.StatusPreconditionRequired)
+		return false
+	}
+	document.IfMatch(documentETags(ifMatch))
+	return true
+}
+
 func getPath(p string) []string {
 	if p[:1] == "/" {
 		p = p[1:]
@@ -0,0 +1,370 @@
+package apis_test
+
+import (
+	"fmt"
+	"github.com/ales6164/apis"
+	"github.com/ales6164/apis/apistest"
+	"github.com/ales6164/apis/collection"
+	"github.com/ales6164/apis/kind"
+	"github.com/ales6164/apis/storage"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+type Object struct {
+	Id      string `datastore:"-" auto:"id" json:"id,omitempty"`
+	Version int    `auto:"version" json:"version"`
+	Name    string `json:"name"`
+	N       int    `json:"n"`
+}
+
+var objects = collection.New("objects", Object{})
+
+// Server with objects every user has full control of, and a registered user.
+func newServer(t *testing.T, options *apis.Options, kinds ...*collection.Collection) (*apistest.Server, *apistest.Client) {
+	t.Helper()
+	if options == nil {
+		options = &apis.Options{}
+	}
+	full := apis.Permissions{apis.AllAuthenticatedUsers: {apis.FullControl}}
+	if options.Rules.Match == nil {
+		options.Rules.Match = apis.Match{}
+	}
+	options.Rules.Match[objects] = apis.Rules{Permissions: full}
+	for _, k := range kinds {
+		options.Rules.Match[k] = apis.Rules{Permissions: full}
+	}
+	s := apistest.New(options, objects)
+	for _, k := range kinds {
+		s.HandleKind(k)
+	}
+	c, err := s.Register("user@example.com", "secret1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, c
+}
+
+func create(t *testing.T, c *apistest.Client, path string, o Object) Object {
+	t.Helper()
+	var out Object
+	if err := c.Post(path, o).Expect(t, http.StatusOK).JSON(&out); err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func TestConcurrentPutVersions(t *testing.T) {
+	_, c := newServer(t, nil)
+	o := create(t, c, "/objects", Object{Name: "a"})
+
+	const writers = 8
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	versions := map[int]bool{}
+	etags := map[string]bool{}
+	succeeded := 0
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			res := c.Put("/objects/"+o.Id, Object{Name: fmt.Sprint("w", i)})
+			if res.StatusCode != http.StatusOK {
+				return
+			}
+			var out Object
+			if err := res.JSON(&out); err != nil {
+				t.Error(err)
+				return
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			succeeded++
+			if versions[out.Version] {
+				t.Errorf("version %d returned twice", out.Version)
+			}
+			versions[out.Version] = true
+			etags[res.Header.Get("ETag")] = true
+		}(i)
+	}
+	wg.Wait()
+	if len(etags) != succeeded {
+		t.Errorf("%d writes got %d ETags", succeeded, len(etags))
+	}
+
+	var final Object
+	c.Get("/objects/"+o.Id).Expect(t, http.StatusOK).JSON(&final)
+	if final.Version != o.Version+succeeded {
+		t.Errorf("version is %d after %d writes to version %d", final.Version, succeeded, o.Version)
+	}
+}
+
+func TestRepresentationETags(t *testing.T) {
+	_, c := newServer(t, nil)
+	o := create(t, c, "/objects", Object{Name: "a"})
+	path := "/objects/" + o.Id
+
+	res := c.Get(path).Expect(t, http.StatusOK)
+	etag := res.Header.Get("ETag")
+	if vary := res.Header.Get("Vary"); vary != "Accept, X-Include-Meta" {
+		t.Errorf("Vary of 200 is %q", vary)
+	}
+	tags := map[string]string{"": etag}
+	for name, header := range map[string][]string{
+		"meta":   {"X-Include-Meta", "true"},
+		"csv":    {"Accept", "text/csv"},
+		"fields": nil,
+	} {
+		p := path
+		if name == "fields" {
+			p += "?fields=name"
+		}
+		tag := c.Get(p, header...).Expect(t, http.StatusOK).Header.Get("ETag")
+		for other, v := range tags {
+			if v == tag {
+				t.Errorf("%s and %q representations have ETag %s", name, other, tag)
+			}
+		}
+		tags[name] = tag
+	}
+
+	res = c.Get(path, "If-None-Match", etag).Expect(t, http.StatusNotModified)
+	if vary := res.Header.Get("Vary"); vary != "Accept, X-Include-Meta" {
+		t.Errorf("Vary of 304 is %q", vary)
+	}
+	c.Get(path, "If-None-Match", etag, "Accept", "text/csv").Expect(t, http.StatusOK)
+	c.Get(path, "If-None-Match", tags["csv"], "Accept", "text/csv").Expect(t, http.StatusNotModified)
+
+	// ETag of any representation is a precondition for writes
+	c.Put(path, Object{Name: "b"}, "If-Match", tags["meta"]).Expect(t, http.StatusOK)
+	c.Put(path, Object{Name: "c"}, "If-Match", tags["meta"]).Expect(t, http.StatusPreconditionFailed)
+}
+
+func TestHead(t *testing.T) {
+	_, c := newServer(t, nil)
+	o := create(t, c, "/objects", Object{Name: "a"})
+
+	get := c.Get("/objects/"+o.Id).Expect(t, http.StatusOK)
+	head := c.Do(http.MethodHead, "/objects/"+o.Id, nil).Expect(t, http.StatusOK)
+	if len(head.Body) > 0 {
+		t.Errorf("HEAD has body %s", head.String())
+	}
+	if head.Header.Get("ETag") != get.Header.Get("ETag") {
+		t.Errorf("HEAD has ETag %s, GET %s", head.Header.Get("ETag"), get.Header.Get("ETag"))
+	}
+	c.Do(http.MethodHead, "/objects/"+o.Id, nil, "If-None-Match", get.Header.Get("ETag")).Expect(t, http.StatusNotModified)
+	c.Do(http.MethodHead, "/objects", nil).Expect(t, http.StatusOK)
+}
+
+// Link header values by relation, with the target path relative to host.
+func links(t *testing.T, header, host string) map[string]string {
+	t.Helper()
+	rels := map[string]string{}
+	for _, v := range strings.Split(header, ",") {
+		parts := strings.SplitN(strings.TrimSpace(v), ";", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		target := strings.Trim(parts[0], "<>")
+		if !strings.HasPrefix(target, host+"/") {
+			t.Fatalf("link %s isn't on %s", target, host)
+		}
+		rel := strings.TrimSuffix(strings.TrimPrefix(strings.TrimSpace(parts[1]), `rel="`), `"`)
+		rels[rel] = strings.TrimPrefix(target, host)
+	}
+	return rels
+}
+
+func TestListingLinks(t *testing.T) {
+	_, c := newServer(t, nil)
+	for i := 0; i < 5; i++ {
+		create(t, c, "/objects", Object{Name: fmt.Sprint(i)})
+	}
+
+	seen := map[string]bool{}
+	var pages []map[string]string
+	path := "/objects?limit=2"
+	for path != "" {
+		res := c.Get(path).Expect(t, http.StatusOK)
+		var items []Object
+		if err := res.JSON(&items); err != nil {
+			t.Fatal(err)
+		}
+		for _, o := range items {
+			if seen[o.Id] {
+				t.Fatalf("%s listed twice", o.Id)
+			}
+			seen[o.Id] = true
+		}
+		rels := links(t, res.Header.Get("Link"), "http://example.com")
+		pages = append(pages, rels)
+		path = rels["next"]
+	}
+	if len(seen) != 5 || len(pages) != 3 {
+		t.Fatalf("listed %d objects on %d pages", len(seen), len(pages))
+	}
+	if len(pages[2]["prev"]) == 0 || len(pages[2]["first"]) == 0 {
+		t.Fatalf("last page has links %v", pages[2])
+	}
+	first := links(t, c.Get(pages[2]["first"]).Expect(t, http.StatusOK).Header.Get("Link"), "http://example.com")
+	if first["next"] != pages[0]["next"] {
+		t.Errorf("first link leads to page with next %s, want %s", first["next"], pages[0]["next"])
+	}
+}
+
+func TestDeleteMissing(t *testing.T) {
+	_, c := newServer(t, nil)
+	o := create(t, c, "/objects", Object{Name: "a"})
+	create(t, c, "/objects", Object{Name: "b"})
+
+	c.Delete("/objects/"+o.Id).Expect(t, http.StatusOK)
+	c.Delete("/objects/"+o.Id).Expect(t, http.StatusNotFound)
+	res := c.Get("/objects?count=estimate").Expect(t, http.StatusOK)
+	if total := res.Header.Get("X-Total-Count"); total != "1" {
+		t.Fatalf("X-Total-Count is %s after deleting one of two objects twice", total)
+	}
+}
+
+func TestDeleteImported(t *testing.T) {
+	s, c := newServer(t, nil)
+	relationships := func() int {
+		ctx := storage.NewContext(appengine.NewContext(httptest.NewRequest("GET", "/", nil)), s.Store)
+		n, err := storage.NewQuery("_groupRelationship").KeysOnly().Count(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+	before := relationships()
+	c.Post("/objects/_import", `{"name":"a","metaId":"m1","value":{"name":"a"}}`+"\n", "Content-Type", "application/x-ndjson").Expect(t, http.StatusOK)
+	if n := relationships(); n != before+1 {
+		t.Fatalf("import added %d relationships", n-before)
+	}
+
+	var items []Object
+	if err := c.Get("/objects").Expect(t, http.StatusOK).JSON(&items); err != nil || len(items) != 1 {
+		t.Fatalf("listed %v, %v", items, err)
+	}
+	c.Delete("/objects/"+items[0].Id).Expect(t, http.StatusOK)
+	if n := relationships(); n != before {
+		t.Fatalf("%d relationships are left of the deleted document", n-before)
+	}
+}
+
+func TestConcurrentCreatePut(t *testing.T) {
+	_, c := newServer(t, nil)
+	const writers = 8
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			c.Put("/objects/new", Object{Name: fmt.Sprint("w", i)})
+		}(i)
+	}
+	wg.Wait()
+
+	// the create check and the increment share the transaction, so one PUT counts
+	res := c.Get("/objects?count=estimate").Expect(t, http.StatusOK)
+	if total := res.Header.Get("X-Total-Count"); total != "1" {
+		t.Fatalf("X-Total-Count is %s after concurrent PUTs of one document", total)
+	}
+}
+
+func TestCounterEndpoint(t *testing.T) {
+	_, c := newServer(t, nil)
+	for i := 0; i < 3; i++ {
+		create(t, c, "/objects", Object{Name: fmt.Sprint(i)})
+	}
+	o := create(t, c, "/objects", Object{Name: "d"})
+	c.Delete("/objects/"+o.Id).Expect(t, http.StatusOK)
+
+	var status kind.CounterStatus
+	c.Get("/objects/_counter").Expect(t, http.StatusOK).JSON(&status)
+	if status.Count != 3 || status.Documents != 3 || status.Drift != 0 {
+		t.Fatalf("counter is %+v", status)
+	}
+	c.Post("/objects/_counter", map[string]int{"shards": 8}).Expect(t, http.StatusOK).JSON(&status)
+	if status.Count != 3 || status.Shards != 8 {
+		t.Fatalf("reconciled counter is %+v", status)
+	}
+	c.Post("/objects/_counter", map[string]int{"shards": -1}).Expect(t, http.StatusBadRequest)
+}
+
+func TestFilteredCount(t *testing.T) {
+	_, c := newServer(t, nil)
+	for i := 0; i < 3; i++ {
+		create(t, c, "/objects", Object{Name: "a", N: i})
+	}
+	create(t, c, "/objects", Object{Name: "b"})
+
+	// a page that isn't the last doesn't know the filtered total
+	res := c.Get("/objects?where=name=a&limit=2").Expect(t, http.StatusOK)
+	if total, estimated := res.Header.Get("X-Total-Count"), res.Header.Get(apis.TotalEstimatedHeader); total != "4" || estimated != "true" {
+		t.Fatalf("filtered listing without count has total %s, estimated %s", total, estimated)
+	}
+	res = c.Get("/objects?where=name=a&limit=2&count=exact").Expect(t, http.StatusOK)
+	if total, estimated := res.Header.Get("X-Total-Count"), res.Header.Get(apis.TotalEstimatedHeader); total != "3" || len(estimated) > 0 {
+		t.Fatalf("exact count is %s, estimated %s", total, estimated)
+	}
+}
+
+func TestFields(t *testing.T) {
+	s, c := newServer(t, nil)
+	o := create(t, c, "/objects", Object{Name: "a", N: 1})
+
+	var got map[string]interface{}
+	c.Get("/objects/"+o.Id+"?fields=name").Expect(t, http.StatusOK).JSON(&got)
+	if len(got) != 1 || got["name"] != "a" {
+		t.Fatalf("document with fields=name is %v", got)
+	}
+	c.Get("/objects/"+o.Id+"?fields=color").Expect(t, http.StatusBadRequest)
+
+	// document stored before name was a field
+	key, err := datastore.DecodeKey(o.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := storage.NewContext(appengine.NewContext(httptest.NewRequest("GET", "/", nil)), s.Store)
+	if ctx, err = appengine.Namespace(ctx, key.Namespace()); err != nil {
+		t.Fatal(err)
+	}
+	legacy := datastore.NewKey(ctx, "objects", "legacy", 0, nil)
+	if _, err := storage.Put(ctx, legacy, &datastore.PropertyList{{Name: "N", Value: int64(2)}}); err != nil {
+		t.Fatal(err)
+	}
+
+	var items []map[string]interface{}
+	c.Get("/objects?fields=name,n&count=none").Expect(t, http.StatusOK).JSON(&items)
+	if len(items) != 2 {
+		t.Fatalf("listing with fields is %v", items)
+	}
+	for _, item := range items {
+		if _, ok := item["name"]; len(item) != 2 || !ok {
+			t.Errorf("item with fields=name,n is %v", item)
+		}
+	}
+	c.Get("/objects?fields=id").Expect(t, http.StatusOK).JSON(&items)
+	if len(items) != 2 || items[0]["id"] == nil {
+		t.Fatalf("listing with fields=id is %v", items)
+	}
+}
+
+func TestProjectedFields(t *testing.T) {
+	projected := collection.New("projected", Object{})
+	projected.ProjectFields = true
+	_, c := newServer(t, nil, projected)
+	create(t, c, "/projected", Object{Name: "a", N: 1})
+	create(t, c, "/projected", Object{Name: "b", N: 2})
+
+	var items []map[string]interface{}
+	c.Get("/projected?fields=name&order=name").Expect(t, http.StatusOK).JSON(&items)
+	if len(items) != 2 || items[0]["name"] != "a" || items[1]["name"] != "b" || len(items[0]) != 1 {
+		t.Fatalf("projected listing is %v", items)
+	}
+}
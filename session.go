@@ -1,7 +1,7 @@
 package apis
 
 import (
-	"errors"
+	"github.com/ales6164/apis/storage"
 	"github.com/dgrijalva/jwt-go"
 	"golang.org/x/net/context"
 	"google.golang.org/appengine/datastore"
@@ -47,7 +47,7 @@ func newSession(a *Auth, ctx context.Context, provider string, providerIdentity
 	}
 
 	var err error
-	s.Key, err = datastore.Put(ctx, s.Key, s)
+	s.Key, err = storage.Put(ctx, s.Key, s)
 	if err != nil {
 		return s, err
 	}
@@ -79,12 +79,12 @@ func StartSession(ctx Context, token *jwt.Token) (*Session, error) {
 	var s = new(Session)
 	if token != nil {
 		if claims, ok := token.Claims.(*Claims); ok && token.Valid {
-			err = datastore.Get(ctx, claims.Id, s)
+			err = storage.Get(ctx, claims.Id, s)
 			if err != nil {
 				return s, err
 			}
 			if s.IsBlocked {
-				return s, errors.New("session is blocked")
+				return s, ErrSessionBlocked
 			}
 
 			s.Claims = claims
@@ -93,10 +93,10 @@ func StartSession(ctx Context, token *jwt.Token) (*Session, error) {
 			s.Token = token
 			s.IsValid = true
 		} else {
-			return s, errors.New("token is invalid")
+			return s, ErrInvalidToken
 		}
 	} else {
-		return s, errors.New("token is not present")
+		return s, ErrTokenNotPresent
 	}
 
 	if !s.IsAuthenticated {
@@ -123,6 +123,6 @@ var (
 // extend by seconds from now
 func (s *Session) Extend(ctx context.Context, seconds int64) error {
 	s.ExpiresAt = time.Now().Add(time.Second * time.Duration(seconds))
-	_, err := datastore.Put(ctx, s.Key, s)
+	_, err := storage.Put(ctx, s.Key, s)
 	return err
 }
@@ -0,0 +1,125 @@
+package storage
+
+import (
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+// AppEngine is the App Engine datastore backend.
+type AppEngine struct{}
+
+func (AppEngine) Get(ctx context.Context, key *datastore.Key, dst interface{}) error {
+	return datastore.Get(ctx, key, dst)
+}
+
+func (AppEngine) GetMulti(ctx context.Context, keys []*datastore.Key, dst interface{}) error {
+	return datastore.GetMulti(ctx, keys, dst)
+}
+
+func (AppEngine) Put(ctx context.Context, key *datastore.Key, src interface{}) (*datastore.Key, error) {
+	return datastore.Put(ctx, key, src)
+}
+
+func (AppEngine) PutMulti(ctx context.Context, keys []*datastore.Key, src interface{}) ([]*datastore.Key, error) {
+	return datastore.PutMulti(ctx, keys, src)
+}
+
+func (AppEngine) Delete(ctx context.Context, key *datastore.Key) error {
+	return datastore.Delete(ctx, key)
+}
+
+func (AppEngine) DeleteMulti(ctx context.Context, keys []*datastore.Key) error {
+	return datastore.DeleteMulti(ctx, keys)
+}
+
+func (AppEngine) RunInTransaction(ctx context.Context, f func(tc context.Context) error, opts *datastore.TransactionOptions) error {
+	return datastore.RunInTransaction(ctx, f, opts)
+}
+
+func (AppEngine) Run(ctx context.Context, q *Query) Iterator {
+	dq, err := q.datastoreQuery()
+	if err != nil {
+		return &appEngineIterator{err: err}
+	}
+	return &appEngineIterator{t: dq.Run(ctx)}
+}
+
+func (AppEngine) Count(ctx context.Context, q *Query) (int, error) {
+	dq, err := q.datastoreQuery()
+	if err != nil {
+		return 0, err
+	}
+	return dq.Count(ctx)
+}
+
+// translates the query to its datastore counterpart
+func (q *Query) datastoreQuery() (*datastore.Query, error) {
+	if q.err != nil {
+		return nil, q.err
+	}
+	dq := datastore.NewQuery(q.kind)
+	if q.ancestor != nil {
+		dq = dq.Ancestor(q.ancestor)
+	}
+	for _, f := range q.filter {
+		dq = dq.Filter(f.FieldName+" "+string(f.Op), f.Value)
+	}
+	for _, o := range q.order {
+		if o.Desc {
+			dq = dq.Order("-" + o.FieldName)
+		} else {
+			dq = dq.Order(o.FieldName)
+		}
+	}
+	if len(q.projection) > 0 {
+		dq = dq.Project(q.projection...)
+	}
+	if q.distinct {
+		dq = dq.Distinct()
+	}
+	if q.keysOnly {
+		dq = dq.KeysOnly()
+	}
+	if q.eventual {
+		dq = dq.EventualConsistency()
+	}
+	dq = dq.Limit(int(q.limit)).Offset(int(q.offset))
+	if len(q.start) > 0 {
+		c, err := datastore.DecodeCursor(q.start)
+		if err != nil {
+			return nil, err
+		}
+		dq = dq.Start(c)
+	}
+	if len(q.end) > 0 {
+		c, err := datastore.DecodeCursor(q.end)
+		if err != nil {
+			return nil, err
+		}
+		dq = dq.End(c)
+	}
+	return dq, nil
+}
+
+type appEngineIterator struct {
+	t   *datastore.Iterator
+	err error
+}
+
+func (it *appEngineIterator) Next(dst interface{}) (*datastore.Key, error) {
+	if it.err != nil {
+		return nil, it.err
+	}
+	return it.t.Next(dst)
+}
+
+func (it *appEngineIterator) Cursor() (string, error) {
+	if it.err != nil {
+		return "", it.err
+	}
+	c, err := it.t.Cursor()
+	if err != nil {
+		return "", err
+	}
+	return c.String(), nil
+}
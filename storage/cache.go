@@ -0,0 +1,61 @@
+package storage
+
+import (
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/memcache"
+	"time"
+)
+
+// Cache is a memcache backend. Values are JSON encoded and misses are
+// reported with memcache.ErrCacheMiss.
+type Cache interface {
+	Get(ctx context.Context, key string, dst interface{}) error
+	Set(ctx context.Context, key string, src interface{}, expiration time.Duration) error
+	Delete(ctx context.Context, key string) error
+	IncrementExisting(ctx context.Context, key string, delta int64) (uint64, error)
+}
+
+type cacheKey struct{}
+
+// DefaultCache is used when no cache is attached to the context.
+var DefaultCache Cache = Memcache{}
+
+// WithCache returns a copy of ctx that uses c for caching.
+func WithCache(ctx context.Context, c Cache) context.Context {
+	if c == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, cacheKey{}, c)
+}
+
+// CacheFromContext returns the cache attached to ctx or DefaultCache.
+func CacheFromContext(ctx context.Context) Cache {
+	if c, ok := ctx.Value(cacheKey{}).(Cache); ok {
+		return c
+	}
+	return DefaultCache
+}
+
+// Memcache is the App Engine memcache backend.
+type Memcache struct{}
+
+func (Memcache) Get(ctx context.Context, key string, dst interface{}) error {
+	_, err := memcache.JSON.Get(ctx, key, dst)
+	return err
+}
+
+func (Memcache) Set(ctx context.Context, key string, src interface{}, expiration time.Duration) error {
+	return memcache.JSON.Set(ctx, &memcache.Item{
+		Key:        key,
+		Object:     src,
+		Expiration: expiration,
+	})
+}
+
+func (Memcache) Delete(ctx context.Context, key string) error {
+	return memcache.Delete(ctx, key)
+}
+
+func (Memcache) IncrementExisting(ctx context.Context, key string, delta int64) (uint64, error) {
+	return memcache.IncrementExisting(ctx, key, delta)
+}
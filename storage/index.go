@@ -0,0 +1,91 @@
+package storage
+
+import (
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/search"
+)
+
+// Index is a search backend. Documents are structs or search.FieldLoadSavers.
+type Index interface {
+	Put(ctx context.Context, index, id string, src interface{}) (string, error)
+	Get(ctx context.Context, index, id string, dst interface{}) error
+	Delete(ctx context.Context, index, id string) error
+	DeleteMulti(ctx context.Context, index string, ids []string) error
+	// List returns IDs of all documents in the index.
+	List(ctx context.Context, index string) ([]string, error)
+}
+
+type indexKey struct{}
+
+// DefaultIndex is used when no index is attached to the context.
+var DefaultIndex Index = Search{}
+
+// WithIndex returns a copy of ctx that uses i for search.
+func WithIndex(ctx context.Context, i Index) context.Context {
+	if i == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, indexKey{}, i)
+}
+
+// IndexFromContext returns the index attached to ctx or DefaultIndex.
+func IndexFromContext(ctx context.Context) Index {
+	if i, ok := ctx.Value(indexKey{}).(Index); ok {
+		return i
+	}
+	return DefaultIndex
+}
+
+// Search is the App Engine search backend.
+type Search struct{}
+
+func (Search) Put(ctx context.Context, index, id string, src interface{}) (string, error) {
+	x, err := search.Open(index)
+	if err != nil {
+		return "", err
+	}
+	return x.Put(ctx, id, src)
+}
+
+func (Search) Get(ctx context.Context, index, id string, dst interface{}) error {
+	x, err := search.Open(index)
+	if err != nil {
+		return err
+	}
+	return x.Get(ctx, id, dst)
+}
+
+func (Search) Delete(ctx context.Context, index, id string) error {
+	x, err := search.Open(index)
+	if err != nil {
+		return err
+	}
+	return x.Delete(ctx, id)
+}
+
+func (Search) DeleteMulti(ctx context.Context, index string, ids []string) error {
+	x, err := search.Open(index)
+	if err != nil {
+		return err
+	}
+	return x.DeleteMulti(ctx, ids)
+}
+
+func (Search) List(ctx context.Context, index string) ([]string, error) {
+	x, err := search.Open(index)
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for t := x.List(ctx, &search.ListOptions{IDsOnly: true}); ; {
+		id, err := t.Next(nil)
+		if err == search.Done {
+			break
+		}
+		if err != nil {
+			return ids, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
@@ -0,0 +1,479 @@
+package storage
+
+import (
+	"encoding/base64"
+	"errors"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const maxEntityGroups = 25
+
+var (
+	ErrTooManyEntityGroups = errors.New("datastore: operating on too many entity groups in a single transaction")
+	ErrCrossGroup          = errors.New("datastore: cross-group transaction need to be explicitly specified (XG: true)")
+	ErrQueryInTransaction  = errors.New("datastore: only ancestor queries are allowed inside transactions")
+	ErrInvalidCursor       = errors.New("datastore: invalid cursor")
+)
+
+// Memory is an in-process datastore. It keeps entities per key (including
+// ancestors and namespace), runs queries and provides optimistic transactions
+// with entity group conflict detection. It is meant for tests and local runs.
+type Memory struct {
+	mu       sync.Mutex
+	entities map[string]*memEntity
+	versions map[string]int64 // entity group versions
+	lastID   int64
+}
+
+type memEntity struct {
+	key   *datastore.Key
+	props []datastore.Property
+}
+
+type memTx struct {
+	m      *Memory
+	xg     bool
+	groups map[string]int64
+	writes map[string]*memWrite
+	order  []string
+}
+
+type memWrite struct {
+	key     *datastore.Key
+	props   []datastore.Property
+	deleted bool
+}
+
+type memTxKey struct{}
+
+// NewMemory creates an empty in-memory store.
+// Keys can only be created with an application ID, so outside App Engine
+// GAE_APPLICATION is set to "dev~memory" unless it is already defined.
+func NewMemory() *Memory {
+	if len(os.Getenv("GAE_APPLICATION")) == 0 {
+		_ = os.Setenv("GAE_APPLICATION", "dev~memory")
+	}
+	return &Memory{
+		entities: map[string]*memEntity{},
+		versions: map[string]int64{},
+	}
+}
+
+// Reset removes all entities.
+func (m *Memory) Reset() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.entities = map[string]*memEntity{}
+	m.versions = map[string]int64{}
+}
+
+func (m *Memory) tx(ctx context.Context) *memTx {
+	if tx, ok := ctx.Value(memTxKey{}).(*memTx); ok && tx.m == m {
+		return tx
+	}
+	return nil
+}
+
+func (m *Memory) Get(ctx context.Context, key *datastore.Key, dst interface{}) error {
+	if key == nil || key.Incomplete() {
+		return datastore.ErrInvalidKey
+	}
+	if tx := m.tx(ctx); tx != nil {
+		if err := tx.touch(key); err != nil {
+			return err
+		}
+	}
+	m.mu.Lock()
+	e, ok := m.entities[key.Encode()]
+	var ps []datastore.Property
+	if ok {
+		ps = copyProperties(e.props)
+	}
+	m.mu.Unlock()
+	if !ok {
+		return datastore.ErrNoSuchEntity
+	}
+	return loadEntity(dst, ps)
+}
+
+func (m *Memory) GetMulti(ctx context.Context, keys []*datastore.Key, dst interface{}) error {
+	v := reflect.ValueOf(dst)
+	if v.Kind() != reflect.Slice {
+		return datastore.ErrInvalidEntityType
+	}
+	if v.Len() != len(keys) {
+		return errors.New("datastore: keys and dst slices have different length")
+	}
+	multiErr, hasErr := make(appengine.MultiError, len(keys)), false
+	for i, key := range keys {
+		if err := m.Get(ctx, key, multiElem(v.Index(i))); err != nil {
+			multiErr[i], hasErr = err, true
+		}
+	}
+	if hasErr {
+		return multiErr
+	}
+	return nil
+}
+
+func (m *Memory) Put(ctx context.Context, key *datastore.Key, src interface{}) (*datastore.Key, error) {
+	keys, err := m.put(ctx, []*datastore.Key{key}, []interface{}{src})
+	if err != nil {
+		return nil, err
+	}
+	return keys[0], nil
+}
+
+func (m *Memory) PutMulti(ctx context.Context, keys []*datastore.Key, src interface{}) ([]*datastore.Key, error) {
+	v := reflect.ValueOf(src)
+	if v.Kind() != reflect.Slice {
+		return nil, datastore.ErrInvalidEntityType
+	}
+	if v.Len() != len(keys) {
+		return nil, errors.New("datastore: keys and src slices have different length")
+	}
+	var srcs []interface{}
+	for i := 0; i < v.Len(); i++ {
+		srcs = append(srcs, multiElem(v.Index(i)))
+	}
+	return m.put(ctx, keys, srcs)
+}
+
+func (m *Memory) put(ctx context.Context, keys []*datastore.Key, srcs []interface{}) ([]*datastore.Key, error) {
+	var writes []*memWrite
+	for i, key := range keys {
+		if key == nil {
+			return nil, datastore.ErrInvalidKey
+		}
+		ps, err := saveEntity(srcs[i])
+		if err != nil {
+			return nil, err
+		}
+		if key.Incomplete() {
+			if key, err = m.allocate(ctx, key); err != nil {
+				return nil, err
+			}
+		}
+		writes = append(writes, &memWrite{key: key, props: copyProperties(ps)})
+	}
+	if err := m.write(ctx, writes); err != nil {
+		return nil, err
+	}
+	var out []*datastore.Key
+	for _, w := range writes {
+		out = append(out, w.key)
+	}
+	return out, nil
+}
+
+func (m *Memory) Delete(ctx context.Context, key *datastore.Key) error {
+	return m.DeleteMulti(ctx, []*datastore.Key{key})
+}
+
+func (m *Memory) DeleteMulti(ctx context.Context, keys []*datastore.Key) error {
+	var writes []*memWrite
+	for _, key := range keys {
+		if key == nil || key.Incomplete() {
+			return datastore.ErrInvalidKey
+		}
+		writes = append(writes, &memWrite{key: key, deleted: true})
+	}
+	return m.write(ctx, writes)
+}
+
+// writes are buffered inside transactions and applied right away otherwise
+func (m *Memory) write(ctx context.Context, writes []*memWrite) error {
+	if tx := m.tx(ctx); tx != nil {
+		for _, w := range writes {
+			if err := tx.touch(w.key); err != nil {
+				return err
+			}
+			enc := w.key.Encode()
+			if _, ok := tx.writes[enc]; !ok {
+				tx.order = append(tx.order, enc)
+			}
+			tx.writes[enc] = w
+		}
+		return nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, w := range writes {
+		m.apply(w)
+	}
+	return nil
+}
+
+// must be called with m.mu held
+func (m *Memory) apply(w *memWrite) {
+	enc := w.key.Encode()
+	if w.deleted {
+		delete(m.entities, enc)
+	} else {
+		m.entities[enc] = &memEntity{key: w.key, props: w.props}
+		// explicit ids are never allocated again
+		if w.key.IntID() > m.lastID {
+			m.lastID = w.key.IntID()
+		}
+	}
+	m.versions[groupOf(w.key)]++
+}
+
+func (m *Memory) allocate(ctx context.Context, key *datastore.Key) (*datastore.Key, error) {
+	nsCtx, err := appengine.Namespace(ctx, key.Namespace())
+	if err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	m.lastID++
+	id := m.lastID
+	m.mu.Unlock()
+	return datastore.NewKey(nsCtx, key.Kind(), "", id, key.Parent()), nil
+}
+
+func (m *Memory) RunInTransaction(ctx context.Context, f func(tc context.Context) error, opts *datastore.TransactionOptions) error {
+	if _, ok := ctx.Value(memTxKey{}).(*memTx); ok {
+		return ErrNestedTransaction
+	}
+	attempts := 3
+	var xg bool
+	if opts != nil {
+		xg = opts.XG
+		if opts.Attempts > 0 {
+			attempts = opts.Attempts
+		}
+	}
+	for i := 0; i < attempts; i++ {
+		tx := &memTx{
+			m:      m,
+			xg:     xg,
+			groups: map[string]int64{},
+			writes: map[string]*memWrite{},
+		}
+		if err := f(context.WithValue(ctx, memTxKey{}, tx)); err != nil {
+			return err
+		}
+		if tx.commit() {
+			return nil
+		}
+	}
+	return datastore.ErrConcurrentTransaction
+}
+
+// records the entity group version the first time a group is used
+func (tx *memTx) touch(key *datastore.Key) error {
+	group := groupOf(key)
+	if _, ok := tx.groups[group]; ok {
+		return nil
+	}
+	if len(tx.groups) > 0 && !tx.xg {
+		return ErrCrossGroup
+	}
+	if len(tx.groups) >= maxEntityGroups {
+		return ErrTooManyEntityGroups
+	}
+	tx.m.mu.Lock()
+	tx.groups[group] = tx.m.versions[group]
+	tx.m.mu.Unlock()
+	return nil
+}
+
+// applies buffered writes unless one of the used entity groups has changed
+func (tx *memTx) commit() bool {
+	tx.m.mu.Lock()
+	defer tx.m.mu.Unlock()
+	for group, version := range tx.groups {
+		if tx.m.versions[group] != version {
+			return false
+		}
+	}
+	for _, enc := range tx.order {
+		tx.m.apply(tx.writes[enc])
+	}
+	return true
+}
+
+func (m *Memory) Run(ctx context.Context, q *Query) Iterator {
+	it := &memIterator{}
+	it.keys, it.props, it.positions, it.start, it.err = m.run(ctx, q)
+	return it
+}
+
+func (m *Memory) Count(ctx context.Context, q *Query) (int, error) {
+	keys, _, _, _, err := m.run(ctx, q.KeysOnly())
+	return len(keys), err
+}
+
+func (m *Memory) run(ctx context.Context, q *Query) (keys []*datastore.Key, props [][]datastore.Property, positions []int, start int, err error) {
+	if q.err != nil {
+		return nil, nil, nil, 0, q.err
+	}
+	if tx := m.tx(ctx); tx != nil {
+		if q.ancestor == nil {
+			return nil, nil, nil, 0, ErrQueryInTransaction
+		}
+		if err := tx.touch(q.ancestor); err != nil {
+			return nil, nil, nil, 0, err
+		}
+	}
+
+	// the namespace of a query comes from the context
+	namespace := namespaceOf(ctx)
+
+	m.mu.Lock()
+	var matches []*memEntity
+	for _, e := range m.entities {
+		if len(q.kind) > 0 && e.key.Kind() != q.kind {
+			continue
+		}
+		if e.key.Namespace() != namespace {
+			continue
+		}
+		if q.ancestor != nil && !hasAncestor(e.key, q.ancestor) {
+			continue
+		}
+		if !matchesFilters(e, q.filter) || !hasOrderedProperties(e, q.order) {
+			continue
+		}
+		matches = append(matches, &memEntity{key: e.key, props: copyProperties(e.props)})
+	}
+	m.mu.Unlock()
+
+	sort.SliceStable(matches, func(i, j int) bool {
+		for _, o := range q.order {
+			c := compareValues(orderValue(matches[i], o), orderValue(matches[j], o))
+			if o.Desc {
+				c = -c
+			}
+			if c != 0 {
+				return c < 0
+			}
+		}
+		return compareKeys(matches[i].key, matches[j].key) < 0
+	})
+
+	if len(q.projection) > 0 {
+		matches = project(matches, q.projection, q.distinct)
+	}
+
+	end := len(matches)
+	if len(q.start) > 0 {
+		if start, err = decodeMemCursor(q.start); err != nil {
+			return nil, nil, nil, 0, err
+		}
+	}
+	if len(q.end) > 0 {
+		e, err := decodeMemCursor(q.end)
+		if err != nil {
+			return nil, nil, nil, 0, err
+		}
+		if e < end {
+			end = e
+		}
+	}
+	start += int(q.offset)
+	if q.limit >= 0 && start+int(q.limit) < end {
+		end = start + int(q.limit)
+	}
+	for i := start; i < end; i++ {
+		keys = append(keys, matches[i].key)
+		positions = append(positions, i)
+		if !q.keysOnly {
+			props = append(props, matches[i].props)
+		}
+	}
+	return keys, props, positions, start, nil
+}
+
+type memIterator struct {
+	keys      []*datastore.Key
+	props     [][]datastore.Property
+	positions []int
+	start     int
+	i         int
+	err       error
+}
+
+func (it *memIterator) Next(dst interface{}) (*datastore.Key, error) {
+	if it.err != nil {
+		return nil, it.err
+	}
+	if it.i >= len(it.keys) {
+		return nil, datastore.Done
+	}
+	i := it.i
+	it.i++
+	if it.props != nil && dst != nil {
+		if err := loadEntity(dst, it.props[i]); err != nil {
+			return it.keys[i], err
+		}
+	}
+	return it.keys[i], nil
+}
+
+func (it *memIterator) Cursor() (string, error) {
+	if it.err != nil {
+		return "", it.err
+	}
+	pos := it.start
+	if it.i > 0 {
+		pos = it.positions[it.i-1] + 1
+	}
+	return encodeMemCursor(pos), nil
+}
+
+func encodeMemCursor(pos int) string {
+	return base64.RawURLEncoding.EncodeToString([]byte("mem:" + strconv.Itoa(pos)))
+}
+
+func decodeMemCursor(s string) (int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || !strings.HasPrefix(string(b), "mem:") {
+		return 0, ErrInvalidCursor
+	}
+	pos, err := strconv.Atoi(string(b[4:]))
+	if err != nil || pos < 0 {
+		return 0, ErrInvalidCursor
+	}
+	return pos, nil
+}
+
+// returns the namespace set on ctx with appengine.Namespace
+func namespaceOf(ctx context.Context) string {
+	return datastore.NewIncompleteKey(ctx, "_", nil).Namespace()
+}
+
+func groupOf(key *datastore.Key) string {
+	for key.Parent() != nil {
+		key = key.Parent()
+	}
+	return key.Encode()
+}
+
+func hasAncestor(key, ancestor *datastore.Key) bool {
+	for ; key != nil; key = key.Parent() {
+		if key.Equal(ancestor) {
+			return true
+		}
+	}
+	return false
+}
+
+func copyProperties(ps []datastore.Property) []datastore.Property {
+	out := make([]datastore.Property, len(ps))
+	copy(out, ps)
+	for i, p := range out {
+		if b, ok := p.Value.([]byte); ok {
+			out[i].Value = append([]byte(nil), b...)
+		}
+	}
+	return out
+}
@@ -0,0 +1,104 @@
+package storage
+
+import (
+	"encoding/json"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/memcache"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// MemoryCache is an in-process Cache with memcache semantics.
+type MemoryCache struct {
+	mu    sync.Mutex
+	items map[string]*memItem
+}
+
+type memItem struct {
+	value     []byte
+	expiresAt time.Time
+}
+
+func NewMemoryCache() *MemoryCache {
+	return &MemoryCache{items: map[string]*memItem{}}
+}
+
+// Reset removes all items.
+func (c *MemoryCache) Reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.items = map[string]*memItem{}
+}
+
+// memcache keys are namespaced like datastore keys
+func (c *MemoryCache) key(ctx context.Context, key string) string {
+	return namespaceOf(ctx) + "\x00" + key
+}
+
+// must be called with c.mu held
+func (c *MemoryCache) item(key string) (*memItem, bool) {
+	it, ok := c.items[key]
+	if ok && !it.expiresAt.IsZero() && time.Now().After(it.expiresAt) {
+		delete(c.items, key)
+		return nil, false
+	}
+	return it, ok
+}
+
+func (c *MemoryCache) Get(ctx context.Context, key string, dst interface{}) error {
+	c.mu.Lock()
+	it, ok := c.item(c.key(ctx, key))
+	c.mu.Unlock()
+	if !ok {
+		return memcache.ErrCacheMiss
+	}
+	return json.Unmarshal(it.value, dst)
+}
+
+func (c *MemoryCache) Set(ctx context.Context, key string, src interface{}, expiration time.Duration) error {
+	b, err := json.Marshal(src)
+	if err != nil {
+		return err
+	}
+	it := &memItem{value: b}
+	if expiration > 0 {
+		it.expiresAt = time.Now().Add(expiration)
+	}
+	c.mu.Lock()
+	c.items[c.key(ctx, key)] = it
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *MemoryCache) Delete(ctx context.Context, key string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	k := c.key(ctx, key)
+	if _, ok := c.item(k); !ok {
+		return memcache.ErrCacheMiss
+	}
+	delete(c.items, k)
+	return nil
+}
+
+// IncrementExisting works on decimal values and stops at zero like memcache.
+func (c *MemoryCache) IncrementExisting(ctx context.Context, key string, delta int64) (uint64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	it, ok := c.item(c.key(ctx, key))
+	if !ok {
+		return 0, memcache.ErrCacheMiss
+	}
+	v, err := strconv.ParseUint(string(it.value), 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	if delta < 0 && uint64(-delta) > v {
+		v = 0
+	} else {
+		v = uint64(int64(v) + delta)
+	}
+	it.value = []byte(strconv.FormatUint(v, 10))
+	return v, nil
+}
@@ -0,0 +1,99 @@
+package storage
+
+import (
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/search"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// MemoryIndex is an in-process Index.
+type MemoryIndex struct {
+	mu      sync.Mutex
+	indexes map[string]map[string]*memDocument
+	lastID  int64
+}
+
+type memDocument struct {
+	fields []search.Field
+	meta   *search.DocumentMetadata
+}
+
+func NewMemoryIndex() *MemoryIndex {
+	return &MemoryIndex{indexes: map[string]map[string]*memDocument{}}
+}
+
+// Reset removes all documents.
+func (x *MemoryIndex) Reset() {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.indexes = map[string]map[string]*memDocument{}
+}
+
+func (x *MemoryIndex) name(ctx context.Context, index string) string {
+	return namespaceOf(ctx) + "\x00" + index
+}
+
+func (x *MemoryIndex) Put(ctx context.Context, index, id string, src interface{}) (string, error) {
+	doc := new(memDocument)
+	var err error
+	if fls, ok := src.(search.FieldLoadSaver); ok {
+		doc.fields, doc.meta, err = fls.Save()
+	} else {
+		doc.fields, err = search.SaveStruct(src)
+	}
+	if err != nil {
+		return "", err
+	}
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if len(id) == 0 {
+		x.lastID++
+		id = strconv.FormatInt(x.lastID, 10)
+	}
+	name := x.name(ctx, index)
+	if x.indexes[name] == nil {
+		x.indexes[name] = map[string]*memDocument{}
+	}
+	x.indexes[name][id] = doc
+	return id, nil
+}
+
+func (x *MemoryIndex) Get(ctx context.Context, index, id string, dst interface{}) error {
+	x.mu.Lock()
+	doc, ok := x.indexes[x.name(ctx, index)][id]
+	x.mu.Unlock()
+	if !ok {
+		return search.ErrNoSuchDocument
+	}
+	fields := append([]search.Field(nil), doc.fields...)
+	if fls, ok := dst.(search.FieldLoadSaver); ok {
+		return fls.Load(fields, doc.meta)
+	}
+	return search.LoadStruct(dst, fields)
+}
+
+func (x *MemoryIndex) Delete(ctx context.Context, index, id string) error {
+	return x.DeleteMulti(ctx, index, []string{id})
+}
+
+func (x *MemoryIndex) DeleteMulti(ctx context.Context, index string, ids []string) error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	for _, id := range ids {
+		delete(x.indexes[x.name(ctx, index)], id)
+	}
+	return nil
+}
+
+func (x *MemoryIndex) List(ctx context.Context, index string) ([]string, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	var ids []string
+	for id := range x.indexes[x.name(ctx, index)] {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
@@ -0,0 +1,250 @@
+package storage
+
+import (
+	"fmt"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"reflect"
+	"strings"
+	"time"
+)
+
+const keyFieldName = "__key__"
+
+// values of an indexed property; multi-valued properties have many
+func indexedValues(e *memEntity, name string) []interface{} {
+	if name == keyFieldName {
+		return []interface{}{e.key}
+	}
+	var values []interface{}
+	for _, p := range e.props {
+		if p.Name == name && !p.NoIndex {
+			values = append(values, normalize(p.Value))
+		}
+	}
+	return values
+}
+
+func matchesFilters(e *memEntity, filters []filter) bool {
+	for _, f := range filters {
+		value := normalize(f.Value)
+		var ok bool
+		for _, v := range indexedValues(e, f.FieldName) {
+			if rank(v) != rank(value) {
+				continue
+			}
+			c := compareValues(v, value)
+			switch f.Op {
+			case lessThan:
+				ok = c < 0
+			case lessEq:
+				ok = c <= 0
+			case equal:
+				ok = c == 0
+			case greaterEq:
+				ok = c >= 0
+			case greaterThan:
+				ok = c > 0
+			}
+			if ok {
+				break
+			}
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// entities without an ordered property are not part of the index
+func hasOrderedProperties(e *memEntity, orders []order) bool {
+	for _, o := range orders {
+		if len(indexedValues(e, o.FieldName)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// ascending orders use the smallest and descending orders the largest value
+func orderValue(e *memEntity, o order) interface{} {
+	values := indexedValues(e, o.FieldName)
+	var out interface{}
+	for i, v := range values {
+		if i == 0 {
+			out = v
+			continue
+		}
+		c := compareValues(v, out)
+		if (o.Desc && c > 0) || (!o.Desc && c < 0) {
+			out = v
+		}
+	}
+	return out
+}
+
+// keeps only projected properties; entities missing one of them are dropped
+func project(entities []*memEntity, fieldNames []string, distinct bool) []*memEntity {
+	var out []*memEntity
+	seen := map[string]bool{}
+	for _, e := range entities {
+		var ps []datastore.Property
+		var sig []string
+		for _, name := range fieldNames {
+			for _, p := range e.props {
+				if p.Name == name && !p.NoIndex {
+					p.Multiple = false
+					ps = append(ps, p)
+					sig = append(sig, fmt.Sprintf("%T:%v", normalize(p.Value), normalize(p.Value)))
+					break
+				}
+			}
+		}
+		if len(ps) != len(fieldNames) {
+			continue
+		}
+		if distinct {
+			s := strings.Join(sig, "\x00")
+			if seen[s] {
+				continue
+			}
+			seen[s] = true
+		}
+		out = append(out, &memEntity{key: e.key, props: ps})
+	}
+	return out
+}
+
+// converts values to the types datastore stores them as
+func normalize(v interface{}) interface{} {
+	switch x := v.(type) {
+	case nil, int64, bool, string, float64, *datastore.Key, appengine.GeoPoint:
+		return x
+	case time.Time:
+		// datastore keeps time values as microseconds and sorts them with integers
+		return x.UnixNano() / 1000
+	case []byte:
+		return string(x)
+	case datastore.ByteString:
+		return string(x)
+	case appengine.BlobKey:
+		return string(x)
+	}
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return rv.Int()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return int64(rv.Uint())
+	case reflect.Float32, reflect.Float64:
+		return rv.Float()
+	case reflect.Bool:
+		return rv.Bool()
+	case reflect.String:
+		return rv.String()
+	}
+	return v
+}
+
+// datastore orders values of different types by type first
+func rank(v interface{}) int {
+	switch v.(type) {
+	case nil:
+		return 0
+	case int64:
+		return 1
+	case bool:
+		return 2
+	case string:
+		return 3
+	case float64:
+		return 4
+	case appengine.GeoPoint:
+		return 5
+	case *datastore.Key:
+		return 6
+	}
+	return 7
+}
+
+func compareValues(a, b interface{}) int {
+	a, b = normalize(a), normalize(b)
+	if ra, rb := rank(a), rank(b); ra != rb {
+		return compareInts(int64(ra), int64(rb))
+	}
+	switch x := a.(type) {
+	case int64:
+		return compareInts(x, b.(int64))
+	case bool:
+		y := b.(bool)
+		if x == y {
+			return 0
+		} else if !x {
+			return -1
+		}
+		return 1
+	case string:
+		return strings.Compare(x, b.(string))
+	case float64:
+		y := b.(float64)
+		if x < y {
+			return -1
+		} else if x > y {
+			return 1
+		}
+		return 0
+	case appengine.GeoPoint:
+		y := b.(appengine.GeoPoint)
+		if x.Lat != y.Lat {
+			return compareValues(x.Lat, y.Lat)
+		}
+		return compareValues(x.Lng, y.Lng)
+	case *datastore.Key:
+		return compareKeys(x, b.(*datastore.Key))
+	}
+	return 0
+}
+
+func compareInts(a, b int64) int {
+	if a < b {
+		return -1
+	} else if a > b {
+		return 1
+	}
+	return 0
+}
+
+func keyPath(k *datastore.Key) []*datastore.Key {
+	var path []*datastore.Key
+	for ; k != nil; k = k.Parent() {
+		path = append([]*datastore.Key{k}, path...)
+	}
+	return path
+}
+
+// compares keys element by element from the root; numeric IDs sort before names
+func compareKeys(a, b *datastore.Key) int {
+	pa, pb := keyPath(a), keyPath(b)
+	for i := 0; i < len(pa) && i < len(pb); i++ {
+		x, y := pa[i], pb[i]
+		if c := strings.Compare(x.Kind(), y.Kind()); c != 0 {
+			return c
+		}
+		if x.IntID() != 0 || y.IntID() != 0 {
+			if x.IntID() == 0 {
+				return 1
+			} else if y.IntID() == 0 {
+				return -1
+			}
+			if c := compareInts(x.IntID(), y.IntID()); c != 0 {
+				return c
+			}
+			continue
+		}
+		if c := strings.Compare(x.StringID(), y.StringID()); c != 0 {
+			return c
+		}
+	}
+	return compareInts(int64(len(pa)), int64(len(pb)))
+}
@@ -0,0 +1,160 @@
+package storage
+
+import (
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"reflect"
+	"testing"
+)
+
+type item struct {
+	Name string
+	N    int
+}
+
+// Puts items with keys named like them, children of parent when it isn't nil.
+func putItems(t *testing.T, ctx context.Context, parent *datastore.Key, items ...item) []*datastore.Key {
+	t.Helper()
+	var keys []*datastore.Key
+	for _, it := range items {
+		key, err := Put(ctx, datastore.NewKey(ctx, "Item", it.Name, 0, parent), &it)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+func names(items []item) []string {
+	var out []string
+	for _, it := range items {
+		out = append(out, it.Name)
+	}
+	return out
+}
+
+func TestMemoryQuery(t *testing.T) {
+	ctx := newContext()
+	parent := datastore.NewKey(ctx, "Parent", "p", 0, nil)
+	putItems(t, ctx, nil, item{"a", 3}, item{"b", 1}, item{"c", 2}, item{"d", 5})
+	putItems(t, ctx, parent, item{"e", 4}, item{"f", 0})
+	otherCtx, err := appengine.Namespace(ctx, "other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	putItems(t, otherCtx, nil, item{"g", 1})
+
+	for name, test := range map[string]struct {
+		ctx   context.Context
+		query *Query
+		want  []string
+	}{
+		"kind in key order":    {ctx, NewQuery("Item"), []string{"a", "b", "c", "d", "e", "f"}},
+		"ancestor":             {ctx, NewQuery("Item").Ancestor(parent), []string{"e", "f"}},
+		"namespace":            {otherCtx, NewQuery("Item"), []string{"g"}},
+		"equality":             {ctx, NewQuery("Item").Filter("N =", 2), []string{"c"}},
+		"inequality and order": {ctx, NewQuery("Item").Filter("N >=", 2).Order("-N"), []string{"d", "e", "a", "c"}},
+		"range":                {ctx, NewQuery("Item").Filter("N >", 0).Filter("N <", 4).Order("N"), []string{"b", "c", "a"}},
+		"limit and offset":     {ctx, NewQuery("Item").Order("N").Offset(1).Limit(2), []string{"b", "c"}},
+	} {
+		var items []item
+		if _, err := test.query.GetAll(test.ctx, &items); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if got := names(items); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %v, want %v", name, got, test.want)
+		}
+	}
+
+	n, err := NewQuery("Item").Filter("N <", 3).Count(ctx)
+	if err != nil || n != 3 {
+		t.Fatalf("count is %d, %v", n, err)
+	}
+}
+
+func TestMemoryQueryCursors(t *testing.T) {
+	ctx := newContext()
+	putItems(t, ctx, nil, item{"a", 1}, item{"b", 2}, item{"c", 3}, item{"d", 4}, item{"e", 5})
+
+	q := NewQuery("Item").Order("N").Limit(2)
+	var pages [][]string
+	var cursor string
+	for {
+		it := q.Start(cursor).Run(ctx)
+		var page []string
+		for {
+			var e item
+			if _, err := it.Next(&e); err == datastore.Done {
+				break
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			page = append(page, e.Name)
+		}
+		if len(page) == 0 {
+			break
+		}
+		pages = append(pages, page)
+		var err error
+		if cursor, err = it.Cursor(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if want := [][]string{{"a", "b"}, {"c", "d"}, {"e"}}; !reflect.DeepEqual(pages, want) {
+		t.Fatalf("pages are %v, want %v", pages, want)
+	}
+
+	// end cursor of the first page
+	it := NewQuery("Item").Order("N").Limit(2).Run(ctx)
+	for {
+		if _, err := it.Next(nil); err == datastore.Done {
+			break
+		}
+	}
+	end, err := it.Cursor()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var items []item
+	if _, err := NewQuery("Item").Order("N").End(end).GetAll(ctx, &items); err != nil {
+		t.Fatal(err)
+	}
+	if got := names(items); !reflect.DeepEqual(got, []string{"a", "b"}) {
+		t.Fatalf("items before end cursor are %v", got)
+	}
+
+	if _, err := NewQuery("Item").Start("not a cursor").GetAll(ctx, &items); err != ErrInvalidCursor {
+		t.Fatalf("invalid cursor gives %v", err)
+	}
+}
+
+func TestMemoryQueryKeysOnlyAndProjection(t *testing.T) {
+	ctx := newContext()
+	keys := putItems(t, ctx, nil, item{"a", 1}, item{"b", 2}, item{"c", 2})
+
+	got, err := NewQuery("Item").Filter("N =", 2).KeysOnly().GetAll(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, keys[1:]) {
+		t.Fatalf("keys are %v, want %v", got, keys[1:])
+	}
+
+	var items []item
+	if _, err := NewQuery("Item").Project("N").Order("N").GetAll(ctx, &items); err != nil {
+		t.Fatal(err)
+	}
+	if want := []item{{N: 1}, {N: 2}, {N: 2}}; !reflect.DeepEqual(items, want) {
+		t.Fatalf("projected items are %+v, want %+v", items, want)
+	}
+
+	items = nil
+	if _, err := NewQuery("Item").Project("N").Distinct().Order("N").GetAll(ctx, &items); err != nil {
+		t.Fatal(err)
+	}
+	if want := []item{{N: 1}, {N: 2}}; !reflect.DeepEqual(items, want) {
+		t.Fatalf("distinct items are %+v, want %+v", items, want)
+	}
+}
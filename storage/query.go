@@ -0,0 +1,271 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+	"reflect"
+	"strings"
+)
+
+type operator string
+
+const (
+	lessThan    operator = "<"
+	lessEq      operator = "<="
+	equal       operator = "="
+	greaterEq   operator = ">="
+	greaterThan operator = ">"
+	in          operator = "in"
+)
+
+type filter struct {
+	FieldName string
+	Op        operator
+	Value     interface{}
+}
+
+type order struct {
+	FieldName string
+	Desc      bool
+}
+
+// Query mirrors datastore.Query but keeps its state readable so that
+// every Store implementation can execute it.
+type Query struct {
+	kind       string
+	ancestor   *datastore.Key
+	filter     []filter
+	order      []order
+	projection []string
+	distinct   bool
+	keysOnly   bool
+	eventual   bool
+	limit      int32
+	offset     int32
+	start      string
+	end        string
+	err        error
+}
+
+func NewQuery(kind string) *Query {
+	return &Query{
+		kind:  kind,
+		limit: -1,
+	}
+}
+
+func (q *Query) clone() *Query {
+	x := *q
+	// Copy the contents of the slice-typed fields to a new backing store.
+	if len(q.filter) > 0 {
+		x.filter = make([]filter, len(q.filter))
+		copy(x.filter, q.filter)
+	}
+	if len(q.order) > 0 {
+		x.order = make([]order, len(q.order))
+		copy(x.order, q.order)
+	}
+	if len(q.projection) > 0 {
+		x.projection = make([]string, len(q.projection))
+		copy(x.projection, q.projection)
+	}
+	return &x
+}
+
+// Ancestor returns a derivative query with an ancestor filter.
+func (q *Query) Ancestor(ancestor *datastore.Key) *Query {
+	q = q.clone()
+	if ancestor == nil {
+		q.err = errors.New("datastore: nil query ancestor")
+		return q
+	}
+	q.ancestor = ancestor
+	return q
+}
+
+func (q *Query) EventualConsistency() *Query {
+	q = q.clone()
+	q.eventual = true
+	return q
+}
+
+// Filter returns a derivative query with a field-based filter.
+// The filterStr argument must be a field name followed by optional space,
+// followed by an operator, one of ">", "<", ">=", "<=", "=" or " in".
+// Value of an "in" filter is a slice of up to MaxInValues values.
+func (q *Query) Filter(filterStr string, value interface{}) *Query {
+	q = q.clone()
+	filterStr = strings.TrimSpace(filterStr)
+	if len(filterStr) < 1 {
+		q.err = errors.New("datastore: invalid filter: " + filterStr)
+		return q
+	}
+	if strings.HasSuffix(filterStr, " in") {
+		v := reflect.ValueOf(value)
+		if v.Kind() != reflect.Slice || v.Len() == 0 || v.Len() > MaxInValues {
+			q.err = fmt.Errorf("datastore: in filter %q needs 1 to %d values", filterStr, MaxInValues)
+			return q
+		}
+		q.filter = append(q.filter, filter{
+			FieldName: strings.TrimSpace(strings.TrimSuffix(filterStr, " in")),
+			Op:        in,
+			Value:     value,
+		})
+		return q
+	}
+	f := filter{
+		FieldName: strings.TrimRight(filterStr, " ><=!"),
+		Value:     value,
+	}
+	switch op := operator(strings.TrimSpace(filterStr[len(f.FieldName):])); op {
+	case lessThan, lessEq, equal, greaterEq, greaterThan:
+		f.Op = op
+	default:
+		q.err = fmt.Errorf("datastore: invalid operator %q in filter %q", op, filterStr)
+		return q
+	}
+	q.filter = append(q.filter, f)
+	return q
+}
+
+// Order returns a derivative query with a field-based sort order.
+// To sort in descending order prefix the fieldName with a minus sign (-).
+func (q *Query) Order(fieldName string) *Query {
+	q = q.clone()
+	fieldName = strings.TrimSpace(fieldName)
+	o := order{FieldName: fieldName}
+	if strings.HasPrefix(fieldName, "-") {
+		o.Desc = true
+		o.FieldName = strings.TrimSpace(fieldName[1:])
+	}
+	if len(o.FieldName) == 0 {
+		q.err = errors.New("datastore: empty order")
+		return q
+	}
+	q.order = append(q.order, o)
+	return q
+}
+
+func (q *Query) Project(fieldNames ...string) *Query {
+	q = q.clone()
+	q.projection = append([]string(nil), fieldNames...)
+	return q
+}
+
+func (q *Query) Distinct() *Query {
+	q = q.clone()
+	q.distinct = true
+	return q
+}
+
+func (q *Query) KeysOnly() *Query {
+	q = q.clone()
+	q.keysOnly = true
+	return q
+}
+
+// Limit returns a derivative query that has a limit on the number of results
+// returned. A negative value means unlimited.
+func (q *Query) Limit(limit int) *Query {
+	q = q.clone()
+	if limit < -1 || limit > 1<<31-1 {
+		q.err = errors.New("datastore: query limit overflow")
+		return q
+	}
+	q.limit = int32(limit)
+	return q
+}
+
+func (q *Query) Offset(offset int) *Query {
+	q = q.clone()
+	if offset < 0 || offset > 1<<31-1 {
+		q.err = errors.New("datastore: query offset overflow")
+		return q
+	}
+	q.offset = int32(offset)
+	return q
+}
+
+// Start returns a derivative query with the given start point.
+func (q *Query) Start(cursor string) *Query {
+	q = q.clone()
+	q.start = cursor
+	return q
+}
+
+// End returns a derivative query with the given end point.
+func (q *Query) End(cursor string) *Query {
+	q = q.clone()
+	q.end = cursor
+	return q
+}
+
+func (q *Query) Kind() string {
+	return q.kind
+}
+
+func (q *Query) IsKeysOnly() bool {
+	return q.keysOnly
+}
+
+// Run runs the query with the store attached to ctx.
+func (q *Query) Run(ctx context.Context) Iterator {
+	if q.hasIn() {
+		return runIn(ctx, FromContext(ctx), q)
+	}
+	return FromContext(ctx).Run(ctx, q)
+}
+
+// Count returns the number of results for the query.
+func (q *Query) Count(ctx context.Context) (int, error) {
+	if q.hasIn() {
+		return countIn(ctx, FromContext(ctx), q)
+	}
+	return FromContext(ctx).Count(ctx, q)
+}
+
+// GetAll runs the query and appends results to dst, which must be a pointer
+// to a slice of structs, struct pointers or PropertyLoadSavers. For keys-only
+// queries dst may be nil.
+func (q *Query) GetAll(ctx context.Context, dst interface{}) ([]*datastore.Key, error) {
+	var dv reflect.Value
+	if !q.keysOnly {
+		dv = reflect.ValueOf(dst)
+		if dv.Kind() != reflect.Ptr || dv.IsNil() || dv.Elem().Kind() != reflect.Slice {
+			return nil, datastore.ErrInvalidEntityType
+		}
+		dv = dv.Elem()
+	}
+
+	var keys []*datastore.Key
+	var errFieldMismatch error
+	for t := q.Run(ctx); ; {
+		var elem reflect.Value
+		var x interface{}
+		if !q.keysOnly {
+			elem = reflect.New(dv.Type().Elem()).Elem()
+			x = multiElem(elem)
+		}
+		k, err := t.Next(x)
+		if err == datastore.Done {
+			break
+		}
+		if err != nil {
+			if _, ok := err.(*datastore.ErrFieldMismatch); ok {
+				// keep loading like datastore.GetAll does
+				if errFieldMismatch == nil {
+					errFieldMismatch = err
+				}
+			} else {
+				return keys, err
+			}
+		}
+		if !q.keysOnly {
+			dv.Set(reflect.Append(dv, elem))
+		}
+		keys = append(keys, k)
+	}
+	return keys, errFieldMismatch
+}
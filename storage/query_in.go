@@ -0,0 +1,162 @@
+package storage
+
+import (
+	"errors"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+	"reflect"
+	"sort"
+)
+
+// MaxInValues limits the number of sub-queries an "in" filter expands to.
+const MaxInValues = 30
+
+var ErrInCursor = errors.New("datastore: cursors aren't supported with in filters")
+
+// Datastore has no "in" operator. Such queries run once for every combination of
+// values with "=" filters and results are merged in query order without duplicates.
+func (q *Query) hasIn() bool {
+	for _, f := range q.filter {
+		if f.Op == in {
+			return true
+		}
+	}
+	return false
+}
+
+// expands "in" filters into equality sub-queries
+func (q *Query) expandIn() ([]*Query, error) {
+	queries := []*Query{q.clone()}
+	for i, f := range q.filter {
+		if f.Op != in {
+			continue
+		}
+		values := reflect.ValueOf(f.Value)
+		var next []*Query
+		for _, sub := range queries {
+			for j := 0; j < values.Len(); j++ {
+				x := sub.clone()
+				x.filter[i] = filter{FieldName: f.FieldName, Op: equal, Value: values.Index(j).Interface()}
+				next = append(next, x)
+			}
+		}
+		if len(next) > MaxInValues {
+			return nil, errors.New("datastore: too many values in in filters")
+		}
+		queries = next
+	}
+	return queries, nil
+}
+
+func runIn(ctx context.Context, s Store, q *Query) Iterator {
+	it := &inIterator{keysOnly: q.keysOnly}
+	if q.err != nil {
+		it.err = q.err
+		return it
+	}
+	if len(q.start) > 0 || len(q.end) > 0 {
+		it.err = ErrInCursor
+		return it
+	}
+	queries, err := q.expandIn()
+	if err != nil {
+		it.err = err
+		return it
+	}
+
+	var merged []*memEntity
+	var seen = map[string]bool{}
+	for _, sub := range queries {
+		// every sub-query could hold the whole page
+		sub.offset = 0
+		if q.limit >= 0 {
+			sub.limit = q.offset + q.limit
+		}
+		// properties are needed for ordering
+		sub.keysOnly = q.keysOnly && len(q.order) == 0
+		t := s.Run(ctx, sub)
+		for {
+			var ps datastore.PropertyList
+			var dst interface{} = &ps
+			if sub.keysOnly {
+				dst = nil
+			}
+			key, err := t.Next(dst)
+			if err == datastore.Done {
+				break
+			}
+			if err != nil {
+				it.err = err
+				return it
+			}
+			if seen[key.Encode()] {
+				continue
+			}
+			seen[key.Encode()] = true
+			merged = append(merged, &memEntity{key: key, props: ps})
+		}
+	}
+
+	sort.SliceStable(merged, func(i, j int) bool {
+		for _, o := range q.order {
+			c := compareValues(orderValue(merged[i], o), orderValue(merged[j], o))
+			if o.Desc {
+				c = -c
+			}
+			if c != 0 {
+				return c < 0
+			}
+		}
+		return compareKeys(merged[i].key, merged[j].key) < 0
+	})
+
+	start, end := int(q.offset), len(merged)
+	if start > end {
+		start = end
+	}
+	if q.limit >= 0 && start+int(q.limit) < end {
+		end = start + int(q.limit)
+	}
+	it.entities = merged[start:end]
+	return it
+}
+
+func countIn(ctx context.Context, s Store, q *Query) (int, error) {
+	q = q.KeysOnly()
+	var n int
+	for t := runIn(ctx, s, q); ; n++ {
+		if _, err := t.Next(nil); err == datastore.Done {
+			return n, nil
+		} else if err != nil {
+			return n, err
+		}
+	}
+}
+
+type inIterator struct {
+	entities []*memEntity
+	keysOnly bool
+	i        int
+	err      error
+}
+
+func (it *inIterator) Next(dst interface{}) (*datastore.Key, error) {
+	if it.err != nil {
+		return nil, it.err
+	}
+	if it.i >= len(it.entities) {
+		return nil, datastore.Done
+	}
+	e := it.entities[it.i]
+	it.i++
+	if !it.keysOnly && dst != nil {
+		if err := loadEntity(dst, e.props); err != nil {
+			return e.key, err
+		}
+	}
+	return e.key, nil
+}
+
+func (it *inIterator) Cursor() (string, error) {
+	return "", ErrInCursor
+}
@@ -0,0 +1,192 @@
+package storage
+
+import (
+	"errors"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+	"reflect"
+	"time"
+)
+
+// Store is a datastore backend. Keys, properties, errors and transaction options
+// are the ones from google.golang.org/appengine/datastore so existing entities
+// and PropertyLoadSaver implementations work with every backend.
+type Store interface {
+	Get(ctx context.Context, key *datastore.Key, dst interface{}) error
+	GetMulti(ctx context.Context, keys []*datastore.Key, dst interface{}) error
+	Put(ctx context.Context, key *datastore.Key, src interface{}) (*datastore.Key, error)
+	PutMulti(ctx context.Context, keys []*datastore.Key, src interface{}) ([]*datastore.Key, error)
+	Delete(ctx context.Context, key *datastore.Key) error
+	DeleteMulti(ctx context.Context, keys []*datastore.Key) error
+	Run(ctx context.Context, q *Query) Iterator
+	Count(ctx context.Context, q *Query) (int, error)
+	RunInTransaction(ctx context.Context, f func(tc context.Context) error, opts *datastore.TransactionOptions) error
+}
+
+// Iterator is the result of running a query.
+type Iterator interface {
+	// Next returns the key of the next result. When there are no more results,
+	// datastore.Done is returned as the error.
+	Next(dst interface{}) (*datastore.Key, error)
+	// Cursor returns an opaque cursor for the iterator's current location.
+	Cursor() (string, error)
+}
+
+var (
+	ErrNestedTransaction = errors.New("nested transactions are not supported")
+)
+
+type storeKey struct{}
+
+// Default is used when no store is attached to the context.
+var Default Store = AppEngine{}
+
+// NewContext returns a copy of ctx that uses s for all storage operations.
+func NewContext(ctx context.Context, s Store) context.Context {
+	if s == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, storeKey{}, s)
+}
+
+// FromContext returns the store attached to ctx or Default.
+func FromContext(ctx context.Context) Store {
+	if s, ok := ctx.Value(storeKey{}).(Store); ok {
+		return s
+	}
+	return Default
+}
+
+func Get(ctx context.Context, key *datastore.Key, dst interface{}) error {
+	return FromContext(ctx).Get(ctx, key, dst)
+}
+
+func GetMulti(ctx context.Context, keys []*datastore.Key, dst interface{}) error {
+	return FromContext(ctx).GetMulti(ctx, keys, dst)
+}
+
+func Put(ctx context.Context, key *datastore.Key, src interface{}) (*datastore.Key, error) {
+	return FromContext(ctx).Put(ctx, key, src)
+}
+
+func PutMulti(ctx context.Context, keys []*datastore.Key, src interface{}) ([]*datastore.Key, error) {
+	return FromContext(ctx).PutMulti(ctx, keys, src)
+}
+
+func Delete(ctx context.Context, key *datastore.Key) error {
+	return FromContext(ctx).Delete(ctx, key)
+}
+
+func DeleteMulti(ctx context.Context, keys []*datastore.Key) error {
+	return FromContext(ctx).DeleteMulti(ctx, keys)
+}
+
+// RunInTransaction runs f in a transaction like RunInBatch, so cache writes and functions passed
+// to AfterCommit run once after the commit, not on every attempt. Inside RunInBatch or another
+// transaction f becomes part of the enclosing transaction instead.
+func RunInTransaction(ctx context.Context, f func(tc context.Context) error, opts *datastore.TransactionOptions) error {
+	if _, ok := ctx.Value(batchKey{}).(*batch); ok {
+		return f(ctx)
+	}
+	return RunInBatch(ctx, f, opts)
+}
+
+type batchKey struct{}
+
+// Work deferred until the batch commits.
+type batch struct {
+	after []func(ctx context.Context) error
+}
+
+// RunInBatch runs f in one transaction. RunInTransaction calls made with tc join it, so all
+// writes of f are committed together or not at all. Reads don't see writes of the batch.
+// Cache writes and functions passed to AfterCommit run after the commit.
+func RunInBatch(ctx context.Context, f func(tc context.Context) error, opts *datastore.TransactionOptions) error {
+	var b *batch
+	err := FromContext(ctx).RunInTransaction(ctx, func(tc context.Context) error {
+		b = &batch{}
+		tc = context.WithValue(tc, batchKey{}, b)
+		return f(WithCache(tc, &batchCache{Cache: CacheFromContext(tc), batch: b}))
+	}, opts)
+	if err != nil {
+		return err
+	}
+	for _, f := range b.after {
+		if err := f(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AfterCommit runs f after the batch or transaction of ctx commits or right away outside of them.
+// Work that can't be done in a transaction, like queries, goes here. Errors of deferred functions
+// are returned by RunInBatch and RunInTransaction.
+func AfterCommit(ctx context.Context, f func(ctx context.Context) error) error {
+	if b, ok := ctx.Value(batchKey{}).(*batch); ok {
+		b.after = append(b.after, f)
+		return nil
+	}
+	return f(ctx)
+}
+
+// Holds back cache writes of a batch. Increments report 0.
+type batchCache struct {
+	Cache
+	batch *batch
+}
+
+func (c *batchCache) Set(ctx context.Context, key string, src interface{}, expiration time.Duration) error {
+	return AfterCommit(ctx, func(ctx context.Context) error {
+		_ = c.Cache.Set(ctx, key, src, expiration)
+		return nil
+	})
+}
+
+func (c *batchCache) Delete(ctx context.Context, key string) error {
+	return AfterCommit(ctx, func(ctx context.Context) error {
+		_ = c.Cache.Delete(ctx, key)
+		return nil
+	})
+}
+
+func (c *batchCache) IncrementExisting(ctx context.Context, key string, delta int64) (uint64, error) {
+	return 0, AfterCommit(ctx, func(ctx context.Context) error {
+		_, _ = c.Cache.IncrementExisting(ctx, key, delta)
+		return nil
+	})
+}
+
+// loads properties into dst the same way datastore.Get does
+func loadEntity(dst interface{}, ps []datastore.Property) error {
+	if pls, ok := dst.(datastore.PropertyLoadSaver); ok {
+		return pls.Load(ps)
+	}
+	return datastore.LoadStruct(dst, ps)
+}
+
+// saves src into properties the same way datastore.Put does
+func saveEntity(src interface{}) ([]datastore.Property, error) {
+	if pls, ok := src.(datastore.PropertyLoadSaver); ok {
+		return pls.Save()
+	}
+	return datastore.SaveStruct(src)
+}
+
+// returns a value suitable for loadEntity from a slice element
+func multiElem(v reflect.Value) interface{} {
+	switch v.Kind() {
+	case reflect.Struct:
+		return v.Addr().Interface()
+	case reflect.Ptr:
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return v.Interface()
+	default:
+		if v.Type() == reflect.TypeOf(datastore.PropertyList{}) {
+			return v.Addr().Interface()
+		}
+		return v.Interface()
+	}
+}
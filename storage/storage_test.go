@@ -0,0 +1,120 @@
+package storage
+
+import (
+	"errors"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"net/http/httptest"
+	"testing"
+)
+
+type entity struct {
+	N int
+}
+
+func newContext() context.Context {
+	return NewContext(appengine.NewContext(httptest.NewRequest("GET", "/", nil)), NewMemory())
+}
+
+func TestRunInTransactionJoins(t *testing.T) {
+	ctx := newContext()
+	a := datastore.NewKey(ctx, "E", "a", 0, nil)
+	b := datastore.NewKey(ctx, "E", "b", 0, nil)
+	xg := &datastore.TransactionOptions{XG: true}
+
+	err := RunInTransaction(ctx, func(tc context.Context) error {
+		if _, err := Put(tc, a, &entity{N: 1}); err != nil {
+			return err
+		}
+		return RunInTransaction(tc, func(tc context.Context) error {
+			_, err := Put(tc, b, &entity{N: 2})
+			return err
+		}, xg)
+	}, xg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var e entity
+	if err := Get(ctx, b, &e); err != nil || e.N != 2 {
+		t.Fatalf("inner write: %v, %v", e, err)
+	}
+
+	// inner writes roll back with the enclosing transaction
+	rollback := errors.New("rollback")
+	err = RunInTransaction(ctx, func(tc context.Context) error {
+		if err := RunInTransaction(tc, func(tc context.Context) error {
+			_, err := Put(tc, b, &entity{N: 3})
+			return err
+		}, xg); err != nil {
+			return err
+		}
+		return rollback
+	}, xg)
+	if err != rollback {
+		t.Fatalf("got %v", err)
+	}
+	if err := Get(ctx, b, &e); err != nil || e.N != 2 {
+		t.Fatalf("inner write of failed transaction was kept: %v, %v", e, err)
+	}
+}
+
+// Cache writes and AfterCommit of a retried transaction run once, after it commits.
+func TestRunInTransactionAfterCommit(t *testing.T) {
+	ctx := WithCache(newContext(), NewMemoryCache())
+	key := datastore.NewKey(ctx, "E", "a", 0, nil)
+	if err := CacheFromContext(ctx).Set(ctx, "n", 0, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	attempts, after := 0, 0
+	err := RunInTransaction(ctx, func(tc context.Context) error {
+		attempts++
+		var e entity
+		if err := Get(tc, key, &e); err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		if attempts == 1 {
+			// concurrent write makes the first attempt fail to commit
+			if _, err := Put(ctx, key, &entity{N: 10}); err != nil {
+				return err
+			}
+		}
+		if _, err := Put(tc, key, &entity{N: e.N + 1}); err != nil {
+			return err
+		}
+		if _, err := CacheFromContext(tc).IncrementExisting(tc, "n", 1); err != nil {
+			return err
+		}
+		return AfterCommit(tc, func(ctx context.Context) error {
+			after++
+			return nil
+		})
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attempts != 2 || after != 1 {
+		t.Fatalf("%d attempts ran AfterCommit %d times", attempts, after)
+	}
+	var n int
+	if err := CacheFromContext(ctx).Get(ctx, "n", &n); err != nil || n != 1 {
+		t.Fatalf("cached value is %d, %v", n, err)
+	}
+
+	// nothing runs when the transaction fails
+	err = RunInTransaction(ctx, func(tc context.Context) error {
+		_, _ = CacheFromContext(tc).IncrementExisting(tc, "n", 1)
+		_ = AfterCommit(tc, func(ctx context.Context) error {
+			after++
+			return nil
+		})
+		return errors.New("rollback")
+	}, nil)
+	if err == nil || after != 1 {
+		t.Fatalf("failed transaction returned %v and ran AfterCommit", err)
+	}
+	if err := CacheFromContext(ctx).Get(ctx, "n", &n); err != nil || n != 1 {
+		t.Fatalf("cached value is %d after rollback, %v", n, err)
+	}
+}
@@ -0,0 +1,62 @@
+package apis
+
+import (
+	"github.com/ales6164/apis/kind"
+	"net/http"
+)
+
+// Actions on collections like /objects/_export. Action is the last path segment.
+var collectionActions = map[string]func(ctx Context, rules Rules, document kind.Doc){
+	"_export":  serveExport,
+	"_import":  serveImport,
+	"_trash":   serveTrash,
+	"_purge":   servePurge,
+	"_events":  serveEvents,
+	"_counter": serveCounter,
+}
+
+// GET /{kind}/_export streams documents as NDJSON, see kind.Record.
+func serveExport(ctx Context, rules Rules, document kind.Doc) {
+	if ctx.r.Method != http.MethodGet {
+		ctx.PrintError(http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	if ok := checkAccess(ctx, rules, document, ReadOnly, ReadWrite, FullControl); !ok {
+		return
+	}
+	ctx.w.Header().Set("Content-Type", "application/x-ndjson")
+	ctx.w.Header().Set("Cache-Control", "no-store")
+	ctx.w.WriteHeader(http.StatusOK)
+	if err := document.Kind().Export(document, ctx.w); err != nil {
+		// response is already started
+		ctx.logf("export error: %v", err)
+	}
+}
+
+// POST /{kind}/_import?mode=upsert|insert|replace reads NDJSON written by export.
+// Large imports should be split into several requests.
+func serveImport(ctx Context, rules Rules, document kind.Doc) {
+	if ctx.r.Method != http.MethodPost {
+		ctx.PrintError(http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	if ok := checkAccess(ctx, rules, document, ReadWrite, FullControl); !ok {
+		return
+	}
+	mode := kind.ImportMode(ctx.r.URL.Query().Get("mode"))
+	if len(mode) == 0 {
+		mode = kind.ImportUpsert
+	}
+	switch mode {
+	case kind.ImportUpsert, kind.ImportInsert, kind.ImportReplace:
+	default:
+		ctx.PrintError("mode must be upsert, insert or replace", http.StatusBadRequest)
+		return
+	}
+	result, err := document.Kind().Import(document, ctx.r.Body, mode)
+	if err != nil {
+		ctx.PrintProblem(err, http.StatusInternalServerError)
+		return
+	}
+	ctx.PrintJSON(result, http.StatusOK)
+}
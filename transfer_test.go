@@ -0,0 +1,76 @@
+package apis_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/ales6164/apis/apistest"
+	"github.com/ales6164/apis/kind"
+	"net/http"
+	"testing"
+)
+
+func exportRecords(t *testing.T, c *apistest.Client, path string) []kind.Record {
+	t.Helper()
+	res := c.Get(path).Expect(t, http.StatusOK)
+	var records []kind.Record
+	for _, line := range bytes.Split(bytes.TrimSpace(res.Body), []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		var r kind.Record
+		if err := json.Unmarshal(line, &r); err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, r)
+	}
+	return records
+}
+
+func importRecords(t *testing.T, c *apistest.Client, path string, records ...interface{}) kind.ImportResult {
+	t.Helper()
+	var body bytes.Buffer
+	for _, r := range records {
+		if err := json.NewEncoder(&body).Encode(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var result kind.ImportResult
+	if err := c.Post(path, body.String(), "Content-Type", "application/x-ndjson").Expect(t, http.StatusOK).JSON(&result); err != nil {
+		t.Fatal(err)
+	}
+	return result
+}
+
+func TestImportKeepsMeta(t *testing.T) {
+	_, c := newServer(t, nil)
+	create(t, c, "/objects", Object{Name: "a"})
+	before := exportRecords(t, c, "/objects/_export")
+	if len(before) != 1 || len(before[0].MetaID) == 0 {
+		t.Fatalf("exported %+v", before)
+	}
+
+	// record without meta updates the value only
+	result := importRecords(t, c, "/objects/_import", map[string]interface{}{
+		"name":  before[0].Name,
+		"intId": before[0].IntID,
+		"value": Object{Name: "b"},
+	})
+	if result.Updated != 1 {
+		t.Fatalf("import result is %+v", result)
+	}
+	after := exportRecords(t, c, "/objects/_export")
+	if len(after) != 1 || after[0].MetaID != before[0].MetaID || !after[0].CreatedAt.Equal(before[0].CreatedAt) {
+		t.Fatalf("import changed meta from %+v to %+v", before[0], after[0])
+	}
+	if after[0].UpdatedAt.Before(before[0].UpdatedAt) {
+		t.Errorf("updatedAt went from %v to %v", before[0].UpdatedAt, after[0].UpdatedAt)
+	}
+
+	// given meta replaces the stored one
+	rec := after[0]
+	rec.MetaID = "m1"
+	importRecords(t, c, "/objects/_import", rec)
+	if after = exportRecords(t, c, "/objects/_export"); after[0].MetaID != "m1" {
+		t.Fatalf("imported meta id is %s", after[0].MetaID)
+	}
+}
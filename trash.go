@@ -0,0 +1,124 @@
+package apis
+
+import (
+	"github.com/ales6164/apis/kind"
+	"net/http"
+	"strconv"
+)
+
+// Actions on documents like /objects/{id}/_restore. Segments after the action are passed as path.
+var documentActions = map[string]func(ctx Context, rules Rules, document kind.Doc, path []string){
+	"_restore":   serveRestore,
+	"_revisions": serveRevisions,
+}
+
+// GET /{kind}/_trash lists soft deleted documents with meta, most recently deleted first.
+// Pages are limit long and linked with cursor.
+func serveTrash(ctx Context, rules Rules, document kind.Doc) {
+	if ctx.r.Method != http.MethodGet {
+		ctx.PrintError(http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	if !document.Kind().SoftDeletes() {
+		ctx.PrintError(http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	if ok := checkAccess(ctx, rules, document, ReadOnly, ReadWrite, FullControl); !ok {
+		return
+	}
+
+	limit, ok := pageLimit(ctx)
+	if !ok {
+		return
+	}
+	docs, next, err := document.Kind().Trash(document, ctx.r.URL.Query().Get("cursor"), limit)
+	if err != nil {
+		ctx.PrintProblem(err, http.StatusBadRequest)
+		return
+	}
+
+	var items = []interface{}{}
+	for _, doc := range docs {
+		meta, err := doc.Meta()
+		if err != nil {
+			ctx.PrintProblem(err, http.StatusInternalServerError)
+			return
+		}
+		items = append(items, meta.Print(doc, doc.Kind().Data(doc, false)))
+	}
+
+	ctx.w.Header().Set("Cache-Control", "no-store")
+	ctx.PrintJSON(items, http.StatusOK, "Link", nextLink(ctx.r, next))
+}
+
+// Parses limit param of cursor paged lists. Responds with 400 if it's invalid.
+func pageLimit(ctx Context) (int, bool) {
+	limit := 25
+	if v := ctx.r.URL.Query().Get("limit"); len(v) > 0 {
+		var err error
+		if limit, err = strconv.Atoi(v); err != nil || limit < 1 {
+			ctx.PrintError("limit must be positive", http.StatusBadRequest)
+			return 0, false
+		}
+	}
+	return limit, true
+}
+
+// Link header value pointing to the page starting at cursor. Empty if there is no next page.
+func nextLink(r *http.Request, cursor string) string {
+	if len(cursor) == 0 {
+		return ""
+	}
+	q := r.URL.Query()
+	q.Set("cursor", cursor)
+	return "<" + getSchemeAndHost(r) + r.URL.Path + "?" + q.Encode() + `>; rel="next"`
+}
+
+// POST /{kind}/{id}/_restore moves a soft deleted document back from trash.
+func serveRestore(ctx Context, rules Rules, document kind.Doc, path []string) {
+	if len(path) > 0 {
+		ctx.PrintError(http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	if ctx.r.Method != http.MethodPost {
+		ctx.PrintError(http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	if !document.Kind().SoftDeletes() {
+		ctx.PrintError(http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	if ok := checkAccess(ctx, rules, document, Delete, FullControl); !ok {
+		return
+	}
+	document, err := document.Restore()
+	if err != nil {
+		ctx.PrintProblem(err, http.StatusInternalServerError)
+		return
+	}
+	ctx.PrintJSON(document.Kind().Data(document, ctx.hasIncludeMetaHeader), http.StatusOK, "ETag", representationETag(ctx, document, nil))
+}
+
+/*
+POST /{kind}/_purge removes documents that were in trash longer than retention of the
+collection, in every group. Meant for cron jobs; needs full control of the top level collection.
+*/
+func servePurge(ctx Context, rules Rules, document kind.Doc) {
+	if ctx.r.Method != http.MethodPost {
+		ctx.PrintError(http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	if document.HasAncestor() || !document.Kind().SoftDeletes() {
+		ctx.PrintError(http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	if ok := checkAccess(ctx, rules, document, FullControl); !ok {
+		return
+	}
+	purged, err := document.Kind().Purge(ctx)
+	if err != nil {
+		ctx.PrintProblem(err, http.StatusInternalServerError)
+		return
+	}
+	ctx.PrintJSON(map[string]int{"purged": purged}, http.StatusOK)
+}
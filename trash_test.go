@@ -0,0 +1,115 @@
+package apis_test
+
+import (
+	"github.com/ales6164/apis/collection"
+	"github.com/ales6164/apis/storage"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func newArchive(retention time.Duration) *collection.Collection {
+	archive := collection.New("archive", Object{})
+	archive.SoftDelete = true
+	archive.TrashRetention = retention
+	return archive
+}
+
+func TestTrash(t *testing.T) {
+	archive := newArchive(0)
+	_, c := newServer(t, nil, archive)
+	a := create(t, c, "/archive", Object{Name: "a"})
+	create(t, c, "/archive", Object{Name: "b"})
+	records := exportRecords(t, c, "/archive/_export")
+
+	c.Delete("/archive/"+a.Id).Expect(t, http.StatusOK)
+	c.Get("/archive/"+a.Id).Expect(t, http.StatusNotFound)
+	c.Put("/archive/"+a.Id, Object{Name: "c"}).Expect(t, http.StatusConflict)
+
+	var trash []struct {
+		Id        string     `json:"id"`
+		DeletedAt *time.Time `json:"deletedAt"`
+		Value     Object     `json:"value"`
+	}
+	if err := c.Get("/archive/_trash").Expect(t, http.StatusOK).JSON(&trash); err != nil {
+		t.Fatal(err)
+	}
+	if len(trash) != 1 || trash[0].Value.Name != "a" || trash[0].DeletedAt == nil {
+		t.Fatalf("trash is %+v", trash)
+	}
+
+	// import reports documents in trash instead of bringing them back
+	result := importRecords(t, c, "/archive/_import", records[0], records[1])
+	if result.Updated != 1 || len(result.Errors) != 1 {
+		t.Fatalf("import result is %+v", result)
+	}
+	c.Get("/archive/"+a.Id).Expect(t, http.StatusNotFound)
+
+	var restored Object
+	c.Post("/archive/"+a.Id+"/_restore", nil).Expect(t, http.StatusOK).JSON(&restored)
+	if restored.Name != "a" {
+		t.Fatalf("restored %+v", restored)
+	}
+	c.Get("/archive/"+a.Id).Expect(t, http.StatusOK)
+	c.Post("/archive/"+a.Id+"/_restore", nil).Expect(t, http.StatusNotFound)
+	if err := c.Get("/archive/_trash").Expect(t, http.StatusOK).JSON(&trash); err != nil || len(trash) != 0 {
+		t.Fatalf("trash after restore is %+v, %v", trash, err)
+	}
+	res := c.Get("/archive?count=exact").Expect(t, http.StatusOK)
+	if total := res.Header.Get("X-Total-Count"); total != "2" {
+		t.Fatalf("X-Total-Count is %s after restore", total)
+	}
+}
+
+func TestRestoreExisting(t *testing.T) {
+	archive := newArchive(0)
+	s, c := newServer(t, nil, archive)
+	a := create(t, c, "/archive", Object{Name: "a"})
+	records := exportRecords(t, c, "/archive/_export")
+	c.Delete("/archive/"+a.Id).Expect(t, http.StatusOK)
+
+	// document written under the key while the deleted one is in trash
+	ctx := storage.NewContext(appengine.NewContext(httptest.NewRequest("GET", "/", nil)), s.Store)
+	nsCtx, err := appengine.Namespace(ctx, records[0].GroupID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := datastore.NewKey(nsCtx, "archive", records[0].Name, records[0].IntID, nil)
+	if _, err := storage.Put(nsCtx, key, &Object{Name: "b"}); err != nil {
+		t.Fatal(err)
+	}
+
+	c.Post("/archive/"+a.Id+"/_restore", nil).Expect(t, http.StatusConflict)
+	var o Object
+	if err := storage.Get(nsCtx, key, &o); err != nil || o.Name != "b" {
+		t.Fatalf("document after failed restore is %+v, %v", o, err)
+	}
+	res := c.Get("/archive?count=estimate").Expect(t, http.StatusOK)
+	if total := res.Header.Get("X-Total-Count"); total != "0" {
+		t.Fatalf("X-Total-Count is %s after failed restore", total)
+	}
+}
+
+func TestPurge(t *testing.T) {
+	archive := newArchive(time.Nanosecond)
+	_, c := newServer(t, nil, archive)
+	a := create(t, c, "/archive", Object{Name: "a"})
+	create(t, c, "/archive", Object{Name: "b"})
+	c.Delete("/archive/"+a.Id).Expect(t, http.StatusOK)
+	time.Sleep(time.Millisecond)
+
+	var purged map[string]int
+	c.Post("/archive/_purge", nil).Expect(t, http.StatusOK).JSON(&purged)
+	if purged["purged"] != 1 {
+		t.Fatalf("purge result is %v", purged)
+	}
+	var trash []interface{}
+	if err := c.Get("/archive/_trash").Expect(t, http.StatusOK).JSON(&trash); err != nil || len(trash) != 0 {
+		t.Fatalf("trash after purge is %v, %v", trash, err)
+	}
+	c.Post("/archive/"+a.Id+"/_restore", nil).Expect(t, http.StatusNotFound)
+	c.Get("/archive/_purge").Expect(t, http.StatusMethodNotAllowed)
+}
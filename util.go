@@ -1,9 +1,9 @@
 package apis
 
 import (
+	"github.com/ales6164/apis/storage"
 	"golang.org/x/net/context"
 	"google.golang.org/appengine"
-	"google.golang.org/appengine/search"
 	"math/rand"
 	"net/http"
 	"regexp"
@@ -42,25 +42,12 @@ func RandStringBytesMaskImprSrc(letterBytes string, n int) string {
 
 // clears search index
 func ClearIndex(ctx context.Context, indexName string) error {
-	index, err := search.Open(indexName)
+	index := storage.IndexFromContext(ctx)
+	ids, err := index.List(ctx, indexName)
 	if err != nil {
 		return err
 	}
-
-	var ids []string
-	for t := index.List(ctx, &search.ListOptions{IDsOnly: true}); ; {
-		var doc interface{}
-		id, err := t.Next(&doc)
-		if err == search.Done {
-			break
-		}
-		if err != nil {
-			return err
-		}
-		ids = append(ids, id)
-	}
-
-	return index.DeleteMulti(ctx, ids)
+	return index.DeleteMulti(ctx, indexName, ids)
 }
 
 func ContainsScope(arr []string, scopes ...string) bool {
@@ -94,15 +81,12 @@ func getParams(url string) (paramsMap map[string]string) {
 	return
 }
 
-// getHost tries its best to return the request host.
+// getHost tries its best to return the request host, with port if the request has one.
 func getHost(r *http.Request) string {
-	var host = r.URL.Host
-	if r.URL.IsAbs() {
-		host = r.Host
-		// Slice off any port information.
-		if i := strings.Index(host, ":"); i != -1 {
-			host = host[:i]
-		}
+	// URL of server requests has only the path; the host is in Host header
+	var host = r.Host
+	if len(host) == 0 {
+		host = r.URL.Host
 	}
 	if len(host) == 0 {
 		if appengine.IsDevAppServer() {
@@ -0,0 +1,108 @@
+package apis_test
+
+import (
+	"github.com/ales6164/apis/apistest"
+	"github.com/ales6164/apis/collection"
+	"github.com/ales6164/apis/kind"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+type Contact struct {
+	Id      string         `datastore:"-" auto:"id" json:"id,omitempty"`
+	Name    string         `json:"name" valid:"required,length(3|16)"`
+	Email   string         `json:"email" valid:"email"`
+	Slug    string         `json:"slug" valid:"slug"`
+	Code    string         `json:"code" valid:"upper"`
+	Address ContactAddress `json:"address"`
+	Phones  []ContactPhone `json:"phones"`
+}
+
+type ContactAddress struct {
+	City string `json:"city" valid:"required"`
+}
+
+type ContactPhone struct {
+	Number string `json:"number" valid:"numeric"`
+}
+
+func newContacts() *collection.Collection {
+	return collection.New("contacts", Contact{}).RegisterValidator("upper", func(value interface{}, parent interface{}) bool {
+		s, ok := value.(string)
+		return ok && s == strings.ToUpper(s)
+	})
+}
+
+// Checks that res is a validation problem with errors, in any order.
+func expectFieldErrors(t *testing.T, res *apistest.Response, want ...kind.FieldError) {
+	t.Helper()
+	expectProblem(t, res, http.StatusUnprocessableEntity, "validation_failed")
+	var p struct {
+		Errors []kind.FieldError `json:"errors"`
+	}
+	if err := res.JSON(&p); err != nil {
+		t.Fatal(err)
+	}
+	sortErrors := func(errs []kind.FieldError) {
+		sort.Slice(errs, func(i, j int) bool { return errs[i].Path < errs[j].Path })
+	}
+	sortErrors(p.Errors)
+	sortErrors(want)
+	if !reflect.DeepEqual(p.Errors, want) {
+		t.Fatalf("errors are %+v, want %+v", p.Errors, want)
+	}
+}
+
+func TestValidation(t *testing.T) {
+	_, c := newServer(t, nil, newContacts())
+
+	expectFieldErrors(t, c.Post("/contacts", Contact{
+		Email:  "nobody",
+		Slug:   "-a",
+		Code:   "abc",
+		Phones: []ContactPhone{{Number: "123"}, {Number: "12a"}},
+	}),
+		kind.FieldError{Path: "/name", Rule: "required"},
+		kind.FieldError{Path: "/email", Rule: "email"},
+		kind.FieldError{Path: "/slug", Rule: "slug"},
+		kind.FieldError{Path: "/code", Rule: "upper"},
+		kind.FieldError{Path: "/address/city", Rule: "required"},
+		kind.FieldError{Path: "/phones/1/number", Rule: "numeric"},
+	)
+
+	var contact Contact
+	c.Post("/contacts", Contact{
+		Name:    "Ann",
+		Email:   "ann@example.com",
+		Slug:    "ann-1",
+		Code:    "ABC",
+		Address: ContactAddress{City: "Ljubljana"},
+		Phones:  []ContactPhone{{Number: "123"}},
+	}).Expect(t, http.StatusOK).JSON(&contact)
+
+	path := "/contacts/" + contact.Id
+	expectFieldErrors(t, c.Patch(path, `{"name":"An","phones":[{"number":"1"},{"number":"x"}]}`, "Content-Type", "application/merge-patch+json"),
+		kind.FieldError{Path: "/name", Rule: "length(3|16)"},
+		kind.FieldError{Path: "/phones/1/number", Rule: "numeric"},
+	)
+	expectFieldErrors(t, c.Patch(path, `[{"op":"remove","path":"/address/city"}]`, "Content-Type", "application/json-patch+json"),
+		kind.FieldError{Path: "/address/city", Rule: "required"},
+	)
+	var stored Contact
+	c.Get(path).Expect(t, http.StatusOK).JSON(&stored)
+	if stored.Name != "Ann" || stored.Address.City != "Ljubljana" || len(stored.Phones) != 1 {
+		t.Fatalf("invalid patches changed the contact to %+v", stored)
+	}
+}
+
+func TestUnknownValidator(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Fatal("collection with an unknown validator is served")
+		}
+	}()
+	apistest.New(nil, collection.New("contacts", Contact{}))
+}
@@ -0,0 +1,86 @@
+package apis
+
+import (
+	"github.com/ales6164/apis/kind"
+	"net/http"
+	"time"
+)
+
+/*
+Serves a value inside a document, like /objects/{id}/stuff/3 or /objects/{id}/address/city.
+Path segments are JSON field names, slice indexes and map keys. Segments that match a nested
+collection in Rules are never treated as value paths.
+
+GET returns the value, PUT replaces it and DELETE removes it. Paths that don't exist are 404.
+*/
+func serveValue(ctx Context, rules Rules, document kind.Doc, path []string) {
+	var scopes []string
+	switch ctx.r.Method {
+	case http.MethodGet:
+		scopes = []string{ReadOnly, ReadWrite, FullControl}
+	case http.MethodPut, http.MethodDelete:
+		scopes = []string{ReadWrite, FullControl}
+	default:
+		ctx.PrintError(http.StatusText(http.StatusNotImplemented), http.StatusNotImplemented)
+		return
+	}
+
+	if ok := checkAccess(ctx, rules, document, scopes...); !ok {
+		return
+	}
+
+	var err error
+	switch ctx.r.Method {
+	case http.MethodGet:
+		document, err = document.Get()
+		if err != nil {
+			ctx.PrintProblem(err, http.StatusInternalServerError)
+			return
+		}
+		var lastModified time.Time
+		if meta, err := document.Meta(); err == nil && meta.Exists() {
+			lastModified = meta.UpdatedAt()
+		}
+		ctx.w.Header().Set("Cache-Control", rules.cacheControl(document, nil))
+		if notModified(ctx.w, ctx.r, representationETag(ctx, document, nil), lastModified) {
+			ctx.w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		printValue(ctx, document, path)
+	case http.MethodPut:
+		if ok := checkPrecondition(ctx, document); !ok {
+			return
+		}
+		document, err = document.SetAt(path, ctx.Body())
+		if err != nil {
+			ctx.PrintProblem(err, http.StatusInternalServerError)
+			return
+		}
+		printValue(ctx, document, path, "ETag", document.ETag())
+	case http.MethodDelete:
+		if ok := checkPrecondition(ctx, document); !ok {
+			return
+		}
+		document, err = document.DeleteAt(path)
+		if err != nil {
+			ctx.PrintProblem(err, http.StatusInternalServerError)
+			return
+		}
+		ctx.w.Header().Set("ETag", document.ETag())
+		ctx.PrintStatus(http.StatusText(http.StatusOK), http.StatusOK)
+	}
+}
+
+func printValue(ctx Context, document kind.Doc, path []string, headerPair ...string) {
+	// fills auto fields
+	document.Kind().Data(document, false)
+	v, err := document.Kind().ValueAt(document.Value(), path)
+	if err == nil && !v.IsValid() {
+		err = kind.ErrPathNotFound
+	}
+	if err != nil {
+		ctx.PrintProblem(err, http.StatusInternalServerError)
+		return
+	}
+	ctx.PrintJSON(v.Interface(), http.StatusOK, headerPair...)
+}
@@ -0,0 +1,70 @@
+package apis_test
+
+import (
+	"github.com/ales6164/apis"
+	"github.com/ales6164/apis/collection"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+type Bag struct {
+	Id    string   `datastore:"-" auto:"id" json:"id,omitempty"`
+	Name  string   `json:"name"`
+	Stuff []string `json:"stuff"`
+}
+
+func TestValues(t *testing.T) {
+	bags := collection.New("bags", Bag{})
+	// boxes have a nested collection named like their stuff field
+	boxes := collection.New("boxes", Bag{})
+	stuff := collection.New("stuff", Object{})
+	full := apis.Permissions{apis.AllAuthenticatedUsers: {apis.FullControl}}
+	s, c := newServer(t, &apis.Options{Rules: apis.Rules{Match: apis.Match{
+		boxes: {Permissions: full, Match: apis.Match{stuff: {Permissions: full}}},
+	}}}, bags)
+	s.HandleKind(boxes)
+	s.HandleKind(stuff)
+
+	var bag Bag
+	c.Post("/bags", Bag{Name: "a", Stuff: []string{"s0", "s1", "s2", "s3"}}).Expect(t, http.StatusOK).JSON(&bag)
+	path := "/bags/" + bag.Id
+
+	var v string
+	if err := c.Get(path+"/stuff/3").Expect(t, http.StatusOK).JSON(&v); err != nil || v != "s3" {
+		t.Fatalf("value is %q, %v", v, err)
+	}
+	if err := c.Get(path+"/name").Expect(t, http.StatusOK).JSON(&v); err != nil || v != "a" {
+		t.Fatalf("name is %q, %v", v, err)
+	}
+
+	if err := c.Put(path+"/stuff/3", `"new"`).Expect(t, http.StatusOK).JSON(&v); err != nil || v != "new" {
+		t.Fatalf("PUT responds with %q, %v", v, err)
+	}
+	c.Delete(path+"/stuff/0").Expect(t, http.StatusOK)
+	var got Bag
+	c.Get(path).Expect(t, http.StatusOK).JSON(&got)
+	if want := []string{"s1", "s2", "new"}; !reflect.DeepEqual(got.Stuff, want) || got.Name != "a" {
+		t.Fatalf("bag is %+v, want stuff %v", got, want)
+	}
+
+	expectProblem(t, c.Get(path+"/stuff/99"), http.StatusNotFound, "path_not_found")
+	expectProblem(t, c.Get(path+"/missing"), http.StatusNotFound, "path_not_found")
+	c.Do(http.MethodPost, path+"/stuff/1", `"x"`).Expect(t, http.StatusNotImplemented)
+
+	// the nested collection wins over the stuff field
+	var box Bag
+	c.Post("/boxes", Bag{Name: "b", Stuff: []string{"s0"}}).Expect(t, http.StatusOK).JSON(&box)
+	path = "/boxes/" + box.Id
+	o := create(t, c, path+"/stuff", Object{Name: "child"})
+	var list []Object
+	c.Get(path+"/stuff").Expect(t, http.StatusOK).JSON(&list)
+	if len(list) != 1 || list[0].Id != o.Id {
+		t.Fatalf("listing of nested collection is %+v", list)
+	}
+	var child Object
+	c.Get(path+"/stuff/"+o.Id).Expect(t, http.StatusOK).JSON(&child)
+	if child.Name != "child" {
+		t.Fatalf("nested document is %+v", child)
+	}
+}
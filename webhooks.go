@@ -0,0 +1,567 @@
+package apis
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/ales6164/apis/storage"
+	"github.com/gorilla/mux"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/urlfetch"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	WebhookKind         = "_webhook"
+	WebhookDeliveryKind = "_webhookDelivery" // child of the webhook
+)
+
+// Webhook event types.
+const (
+	WebhookCreated = "created"
+	WebhookUpdated = "updated"
+	WebhookDeleted = "deleted"
+)
+
+// Delivery statuses.
+const (
+	DeliveryPending   = "pending"
+	DeliverySucceeded = "succeeded"
+	DeliveryFailed    = "failed"
+)
+
+const (
+	// WebhookMaxAttempts is the number of attempts before a delivery fails.
+	WebhookMaxAttempts = 8
+	// WebhookRetryDelay is the delay after the first failed attempt; it doubles on every next one.
+	WebhookRetryDelay = 30 * time.Second
+	// Deliveries that take longer fail.
+	webhookTimeout = 10 * time.Second
+)
+
+// Request headers of deliveries. Signature is hex encoded HMAC-SHA256 of the body with the
+// webhook secret, prefixed with "sha256=".
+const (
+	WebhookSignatureHeader = "X-Apis-Signature-256"
+	WebhookEventHeader     = "X-Apis-Event"
+	WebhookDeliveryHeader  = "X-Apis-Delivery"
+)
+
+var webhookEvents = map[string]string{
+	EventCreate: WebhookCreated,
+	EventUpdate: WebhookUpdated,
+	EventDelete: WebhookDeleted,
+}
+
+// Webhook subscribes URL to events of documents in a collection, at every level.
+type Webhook struct {
+	Id        string    `datastore:"-" json:"id"`
+	URL       string    `json:"url"`
+	Kind      string    `json:"kind"`
+	Events    []string  `json:"events"`                                // created, updated, deleted
+	Secret    string    `datastore:",noindex" json:"secret,omitempty"` // only returned on create
+	Active    bool      `json:"active"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// WebhookDelivery is a delivery of one event to a webhook, kept as the delivery log.
+type WebhookDelivery struct {
+	Id             string          `datastore:"-" json:"id"`
+	Event          string          `json:"event"` // like objects.created
+	Payload        json.RawMessage `datastore:",noindex" json:"payload"`
+	Status         string          `json:"status"`
+	Attempts       int             `json:"attempts"`
+	ResponseStatus int             `json:"responseStatus,omitempty"`
+	Error          string          `datastore:",noindex" json:"error,omitempty"`
+	CreatedAt      time.Time       `json:"createdAt"`
+	NextAttemptAt  time.Time       `json:"nextAttemptAt"`
+	DeliveredAt    time.Time       `json:"deliveredAt"`
+}
+
+// WebhookPayload is the body of deliveries. Data is the document as returned by the API.
+type WebhookPayload struct {
+	Event string          `json:"event"`
+	Kind  string          `json:"kind"`
+	Key   *datastore.Key  `json:"key"`
+	Time  time.Time       `json:"time"`
+	Data  json.RawMessage `json:"data,omitempty"`
+}
+
+// Webhooks can't reach hosts that aren't public, like the metadata server, unless
+// Options.AllowPrivateWebhooks is set.
+var errPrivateHost = errors.New("webhook host isn't public")
+
+// Networks of loopback, link-local, private and other addresses that aren't public.
+var privateNetworks = func() []*net.IPNet {
+	var nets []*net.IPNet
+	for _, cidr := range []string{
+		"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "127.0.0.0/8", "169.254.0.0/16",
+		"172.16.0.0/12", "192.168.0.0/16", "::/128", "::1/128", "fc00::/7", "fe80::/10",
+	} {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		nets = append(nets, n)
+	}
+	return nets
+}()
+
+func privateIP(ip net.IP) bool {
+	for _, n := range privateNetworks {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Reports if host is an address that isn't public or a name of one. Other names are checked
+// when they're resolved, see webhookClient.
+func privateHost(host string) bool {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	if ip := net.ParseIP(host); ip != nil {
+		return privateIP(ip)
+	}
+	return host == "localhost" || strings.HasSuffix(host, ".localhost") ||
+		host == "metadata" || strings.HasSuffix(host, ".internal")
+}
+
+func (h *Webhook) validate(allowPrivate bool) error {
+	u, err := url.Parse(h.URL)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || len(u.Host) == 0 {
+		return fmt.Errorf("invalid url %q", h.URL)
+	}
+	if !allowPrivate && privateHost(u.Hostname()) {
+		return fmt.Errorf("%w: %s", errPrivateHost, u.Hostname())
+	}
+	if len(h.Kind) == 0 {
+		return fmt.Errorf("kind is required")
+	}
+	if len(h.Events) == 0 {
+		return fmt.Errorf("events are required")
+	}
+	for _, e := range h.Events {
+		if e != WebhookCreated && e != WebhookUpdated && e != WebhookDeleted {
+			return fmt.Errorf("unknown event %q", e)
+		}
+	}
+	return nil
+}
+
+func (h *Webhook) sign(body []byte) string {
+	mac := hmac.New(sha256.New, []byte(h.Secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func newWebhookSecret() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Transport that refuses to connect to addresses that aren't public, once names are resolved.
+// It doesn't use proxies, which would hide the address.
+var publicTransport = &http.Transport{
+	DialContext: (&net.Dialer{
+		Timeout: webhookTimeout,
+		Control: func(network, address string, c syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || privateIP(ip) {
+				return fmt.Errorf("%w: %s", errPrivateHost, host)
+			}
+			return nil
+		},
+	}).DialContext,
+	TLSHandshakeTimeout: webhookTimeout,
+}
+
+// HTTP client for deliveries. App Engine needs URL Fetch, which doesn't reach private
+// addresses; elsewhere they're refused when dialing. Redirects are checked like URLs.
+func (a *Apis) webhookClient(ctx context.Context) *http.Client {
+	var c *http.Client
+	if appengine.IsAppEngine() {
+		c = urlfetch.Client(ctx)
+		c.Timeout = webhookTimeout
+	} else if a.AllowPrivateWebhooks {
+		c = &http.Client{Timeout: webhookTimeout}
+	} else {
+		c = &http.Client{Timeout: webhookTimeout, Transport: publicTransport}
+	}
+	c.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if len(via) >= 10 {
+			return errors.New("stopped after 10 redirects")
+		}
+		if !a.AllowPrivateWebhooks && privateHost(req.URL.Hostname()) {
+			return fmt.Errorf("%w: %s", errPrivateHost, req.URL.Hostname())
+		}
+		return nil
+	}
+	return c
+}
+
+// Stores pending deliveries of e for active webhooks of its kind. Called after the change is
+// committed; POST /_webhooks/_dispatch sends them, so requests don't wait for webhook URLs.
+func (a *Apis) queueWebhooks(ctx context.Context, e Event) error {
+	event, ok := webhookEvents[e.Type]
+	if !ok {
+		return nil
+	}
+	var hooks []*Webhook
+	keys, err := storage.NewQuery(WebhookKind).Filter("Kind =", e.Kind).Filter("Active =", true).GetAll(ctx, &hooks)
+	if err != nil {
+		return err
+	}
+	payload, err := json.Marshal(WebhookPayload{
+		Event: e.Kind + "." + event,
+		Kind:  e.Kind,
+		Key:   e.Key,
+		Time:  e.Time,
+		Data:  e.Data,
+	})
+	if err != nil {
+		return err
+	}
+	var deliveryKeys []*datastore.Key
+	var deliveries []*WebhookDelivery
+	for i, hook := range hooks {
+		if !ContainsScope(hook.Events, event) {
+			continue
+		}
+		deliveryKeys = append(deliveryKeys, datastore.NewIncompleteKey(ctx, WebhookDeliveryKind, keys[i]))
+		deliveries = append(deliveries, &WebhookDelivery{
+			Event:         e.Kind + "." + event,
+			Payload:       payload,
+			Status:        DeliveryPending,
+			CreatedAt:     e.Time,
+			NextAttemptAt: e.Time,
+		})
+	}
+	if len(deliveries) == 0 {
+		return nil
+	}
+	_, err = storage.PutMulti(ctx, deliveryKeys, deliveries)
+	return err
+}
+
+// Sends delivery and stores the outcome. Failed attempts are retried with exponential backoff
+// by dispatchWebhooks until WebhookMaxAttempts.
+func (a *Apis) deliver(ctx context.Context, hook *Webhook, key *datastore.Key, d *WebhookDelivery) error {
+	d.Attempts++
+	d.ResponseStatus, d.Error = 0, ""
+	req, err := http.NewRequest(http.MethodPost, hook.URL, bytes.NewReader(d.Payload))
+	if err == nil {
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set(WebhookSignatureHeader, hook.sign(d.Payload))
+		req.Header.Set(WebhookEventHeader, d.Event)
+		req.Header.Set(WebhookDeliveryHeader, key.Encode())
+		var res *http.Response
+		if res, err = a.webhookClient(ctx).Do(req); err == nil {
+			res.Body.Close()
+			d.ResponseStatus = res.StatusCode
+			if res.StatusCode < 200 || res.StatusCode > 299 {
+				err = fmt.Errorf("responded with %d", res.StatusCode)
+			}
+		}
+	}
+
+	now := time.Now()
+	switch {
+	case err == nil:
+		d.Status = DeliverySucceeded
+		d.DeliveredAt = now
+		d.NextAttemptAt = time.Time{}
+	case d.Attempts >= WebhookMaxAttempts:
+		d.Status = DeliveryFailed
+		d.Error = err.Error()
+		d.NextAttemptAt = time.Time{}
+	default:
+		d.Status = DeliveryPending
+		d.Error = err.Error()
+		d.NextAttemptAt = now.Add(WebhookRetryDelay << uint(d.Attempts-1))
+	}
+	_, err = storage.Put(ctx, key, d)
+	return err
+}
+
+// Sends pending deliveries that are due, new ones and retries. Returns the number of attempts.
+func (a *Apis) dispatchWebhooks(ctx context.Context) (int, error) {
+	var deliveries []*WebhookDelivery
+	keys, err := storage.NewQuery(WebhookDeliveryKind).
+		Filter("Status =", DeliveryPending).
+		Filter("NextAttemptAt <=", time.Now()).
+		GetAll(ctx, &deliveries)
+	if err != nil {
+		return 0, err
+	}
+	var hooks = map[string]*Webhook{}
+	var attempts int
+	for i, d := range deliveries {
+		hookKey := keys[i].Parent()
+		hook, ok := hooks[hookKey.Encode()]
+		if !ok {
+			hook = new(Webhook)
+			if err := storage.Get(ctx, hookKey, hook); err != nil {
+				if err != datastore.ErrNoSuchEntity {
+					return attempts, err
+				}
+				hook = nil
+			}
+			hooks[hookKey.Encode()] = hook
+		}
+		if hook == nil || !hook.Active {
+			continue
+		}
+		if err := a.deliver(ctx, hook, keys[i], d); err != nil {
+			return attempts, err
+		}
+		attempts++
+	}
+	return attempts, nil
+}
+
+/*
+Manages webhooks. Needs a role with a scope in Options.WebhookPermissions.
+
+	GET    /_webhooks                                       lists webhooks
+	POST   /_webhooks                                       creates one, {"url","kind","events","secret"}
+	GET    /_webhooks/{id}                                  gets one
+	PUT    /_webhooks/{id}                                  replaces url, events and active, and secret if given
+	PUT    /_webhooks/{id}?rotateSecret=true                same with a newly generated secret
+	DELETE /_webhooks/{id}                                  deletes it with its deliveries
+	GET    /_webhooks/{id}/deliveries                       delivery log, most recent first
+	POST   /_webhooks/{id}/deliveries/{delivery}/_redeliver sends a delivery again now
+	POST   /_webhooks/_dispatch                             sends due deliveries
+
+Secret is generated when it's not given and is only returned when it's set. URLs must be on
+public hosts unless Options.AllowPrivateWebhooks is set.
+
+Requests only queue deliveries; nothing is sent until _dispatch runs. Schedule it in cron.yaml;
+cron requests may dispatch with GET and without a token:
+
+	cron:
+	- description: send webhook deliveries
+	  url: /_webhooks/_dispatch
+	  schedule: every 1 minutes
+*/
+func (a *Apis) serveWebhooks(w http.ResponseWriter, r *http.Request) {
+	ctx := a.NewContext(w, r)
+	var path []string
+	if p := strings.Trim(mux.Vars(r)["path"], "/"); len(p) > 0 {
+		path = strings.Split(p, "/")
+	}
+	// App Engine removes X-Appengine-Cron from outside requests
+	cronDispatch := appengine.IsAppEngine() && r.Header.Get("X-Appengine-Cron") == "true" &&
+		len(path) == 1 && path[0] == "_dispatch"
+	if ok := ctx.HasAccess(Rules{Permissions: a.WebhookPermissions}, FullControl); !ok && !cronDispatch {
+		ctx.PrintForbidden()
+		return
+	}
+
+	switch {
+	case len(path) == 0 && r.Method == http.MethodGet:
+		var hooks = []*Webhook{}
+		keys, err := storage.NewQuery(WebhookKind).Order("CreatedAt").GetAll(ctx, &hooks)
+		if err != nil {
+			ctx.PrintProblem(err, http.StatusInternalServerError)
+			return
+		}
+		for i, hook := range hooks {
+			hook.Id, hook.Secret = keys[i].Encode(), ""
+		}
+		ctx.PrintJSON(hooks, http.StatusOK)
+	case len(path) == 0 && r.Method == http.MethodPost:
+		hook := &Webhook{Active: true}
+		body, err := ctx.ReadBody()
+		if err == nil {
+			err = json.Unmarshal(body, hook)
+		}
+		if err != nil {
+			ctx.PrintProblem(err, http.StatusBadRequest)
+			return
+		}
+		if _, ok := a.kinds[hook.Kind]; !ok && len(hook.Kind) > 0 {
+			ctx.PrintError(fmt.Sprintf("unknown kind %q", hook.Kind), http.StatusBadRequest)
+			return
+		}
+		if err := hook.validate(a.AllowPrivateWebhooks); err != nil {
+			ctx.PrintProblem(err, http.StatusBadRequest)
+			return
+		}
+		if len(hook.Secret) == 0 {
+			if hook.Secret, err = newWebhookSecret(); err != nil {
+				ctx.PrintProblem(err, http.StatusInternalServerError)
+				return
+			}
+		}
+		hook.CreatedAt = time.Now()
+		key, err := storage.Put(ctx, datastore.NewIncompleteKey(ctx, WebhookKind, nil), hook)
+		if err != nil {
+			ctx.PrintProblem(err, http.StatusInternalServerError)
+			return
+		}
+		hook.Id = key.Encode()
+		ctx.PrintJSON(hook, http.StatusCreated)
+	case len(path) == 1 && path[0] == "_dispatch" && (r.Method == http.MethodPost || cronDispatch && r.Method == http.MethodGet):
+		attempts, err := a.dispatchWebhooks(ctx)
+		if err != nil {
+			ctx.PrintProblem(err, http.StatusInternalServerError)
+			return
+		}
+		ctx.PrintJSON(map[string]int{"attempts": attempts}, http.StatusOK)
+	case len(path) == 1:
+		key, hook, ok := getWebhook(ctx, path[0])
+		if !ok {
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			hook.Secret = ""
+			ctx.PrintJSON(hook, http.StatusOK)
+		case http.MethodPut:
+			var in Webhook
+			body, err := ctx.ReadBody()
+			if err == nil {
+				err = json.Unmarshal(body, &in)
+			}
+			if err != nil {
+				ctx.PrintProblem(err, http.StatusBadRequest)
+				return
+			}
+			hook.URL, hook.Events, hook.Active = in.URL, in.Events, in.Active
+			if err := hook.validate(a.AllowPrivateWebhooks); err != nil {
+				ctx.PrintProblem(err, http.StatusBadRequest)
+				return
+			}
+			rotated := len(in.Secret) > 0
+			if rotated {
+				hook.Secret = in.Secret
+			} else if r.URL.Query().Get("rotateSecret") == "true" {
+				var err error
+				if hook.Secret, err = newWebhookSecret(); err != nil {
+					ctx.PrintProblem(err, http.StatusInternalServerError)
+					return
+				}
+				rotated = true
+			}
+			if _, err := storage.Put(ctx, key, hook); err != nil {
+				ctx.PrintProblem(err, http.StatusInternalServerError)
+				return
+			}
+			if !rotated {
+				hook.Secret = ""
+			}
+			ctx.PrintJSON(hook, http.StatusOK)
+		case http.MethodDelete:
+			keys, err := storage.NewQuery(WebhookDeliveryKind).Ancestor(key).KeysOnly().GetAll(ctx, nil)
+			if err == nil {
+				err = storage.DeleteMulti(ctx, append(keys, key))
+			}
+			if err != nil {
+				ctx.PrintProblem(err, http.StatusInternalServerError)
+				return
+			}
+			ctx.PrintStatus(http.StatusText(http.StatusOK), http.StatusOK)
+		default:
+			ctx.PrintError(http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		}
+	case len(path) == 2 && path[1] == "deliveries" && r.Method == http.MethodGet:
+		key, _, ok := getWebhook(ctx, path[0])
+		if !ok {
+			return
+		}
+		limit, ok := pageLimit(ctx)
+		if !ok {
+			return
+		}
+		q := storage.NewQuery(WebhookDeliveryKind).Ancestor(key).Order("-CreatedAt").Limit(limit + 1)
+		if v := r.URL.Query().Get("cursor"); len(v) > 0 {
+			q = q.Start(v)
+		}
+		var deliveries = []*WebhookDelivery{}
+		var next string
+		t := q.Run(ctx)
+		for {
+			d := new(WebhookDelivery)
+			if len(deliveries) == limit {
+				// next page starts after the last returned delivery, if there's one more
+				cursor, err := t.Cursor()
+				if err != nil {
+					ctx.PrintProblem(err, http.StatusInternalServerError)
+					return
+				}
+				if _, err = t.Next(d); err == nil {
+					next = cursor
+				}
+				break
+			}
+			k, err := t.Next(d)
+			if err == datastore.Done {
+				break
+			} else if err != nil {
+				ctx.PrintProblem(err, http.StatusBadRequest)
+				return
+			}
+			d.Id = k.Encode()
+			deliveries = append(deliveries, d)
+		}
+		ctx.PrintJSON(deliveries, http.StatusOK, "Link", nextLink(r, next))
+	case len(path) == 4 && path[1] == "deliveries" && path[3] == "_redeliver" && r.Method == http.MethodPost:
+		hookKey, hook, ok := getWebhook(ctx, path[0])
+		if !ok {
+			return
+		}
+		key, err := datastore.DecodeKey(path[2])
+		if err != nil || key.Kind() != WebhookDeliveryKind || !hookKey.Equal(key.Parent()) {
+			ctx.PrintError(http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+		d := new(WebhookDelivery)
+		if err := storage.Get(ctx, key, d); err != nil {
+			ctx.PrintProblem(err, http.StatusInternalServerError)
+			return
+		}
+		if err := a.deliver(ctx, hook, key, d); err != nil {
+			ctx.PrintProblem(err, http.StatusInternalServerError)
+			return
+		}
+		d.Id = key.Encode()
+		ctx.PrintJSON(d, http.StatusOK)
+	default:
+		ctx.PrintError(http.StatusText(http.StatusNotFound), http.StatusNotFound)
+	}
+}
+
+// Gets webhook by encoded key. Responds with 404 if there is no such webhook.
+func getWebhook(ctx Context, id string) (*datastore.Key, *Webhook, bool) {
+	key, err := datastore.DecodeKey(id)
+	if err != nil || key.Kind() != WebhookKind {
+		ctx.PrintError(http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return nil, nil, false
+	}
+	hook := new(Webhook)
+	if err := storage.Get(ctx, key, hook); err != nil {
+		ctx.PrintProblem(err, http.StatusInternalServerError)
+		return nil, nil, false
+	}
+	hook.Id = key.Encode()
+	return key, hook, true
+}
@@ -0,0 +1,166 @@
+package apis_test
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/ales6164/apis"
+	"github.com/ales6164/apis/storage"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestWebhookDispatch(t *testing.T) {
+	var mu sync.Mutex
+	var received []string
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		received = append(received, r.Header.Get(apis.WebhookEventHeader))
+	}))
+	defer target.Close()
+
+	_, c := newServer(t, &apis.Options{
+		WebhookPermissions:   apis.Permissions{apis.AllAuthenticatedUsers: {apis.FullControl}},
+		AllowPrivateWebhooks: true,
+	})
+	var hook apis.Webhook
+	c.Post("/_webhooks", apis.Webhook{URL: target.URL, Kind: "objects", Events: []string{apis.WebhookCreated}, Active: true}).
+		Expect(t, http.StatusCreated).JSON(&hook)
+	create(t, c, "/objects", Object{Name: "a"})
+
+	// requests only store the delivery
+	mu.Lock()
+	if len(received) > 0 {
+		t.Errorf("delivery was sent while serving the request")
+	}
+	mu.Unlock()
+	var deliveries []apis.WebhookDelivery
+	c.Get("/_webhooks/"+hook.Id+"/deliveries").Expect(t, http.StatusOK).JSON(&deliveries)
+	if len(deliveries) != 1 || deliveries[0].Status != apis.DeliveryPending || deliveries[0].Attempts != 0 {
+		t.Fatalf("deliveries are %+v", deliveries)
+	}
+
+	c.Post("/_webhooks/_dispatch", nil).Expect(t, http.StatusOK)
+	mu.Lock()
+	if len(received) != 1 || received[0] != "objects.created" {
+		t.Errorf("received %v", received)
+	}
+	mu.Unlock()
+	c.Get("/_webhooks/"+hook.Id+"/deliveries").Expect(t, http.StatusOK).JSON(&deliveries)
+	if len(deliveries) != 1 || deliveries[0].Status != apis.DeliverySucceeded {
+		t.Fatalf("deliveries after dispatch are %+v", deliveries)
+	}
+}
+
+func TestWebhookPrivateHosts(t *testing.T) {
+	var received int
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received++
+	}))
+	defer target.Close()
+
+	s, c := newServer(t, &apis.Options{
+		WebhookPermissions: apis.Permissions{apis.AllAuthenticatedUsers: {apis.FullControl}},
+	})
+	for _, u := range []string{
+		target.URL,
+		"http://localhost/hook",
+		"http://169.254.169.254/computeMetadata/v1/",
+		"http://metadata.google.internal/computeMetadata/v1/",
+		"http://10.0.0.1/hook",
+		"http://[::1]/hook",
+	} {
+		c.Post("/_webhooks", apis.Webhook{URL: u, Kind: "objects", Events: []string{apis.WebhookCreated}}).
+			Expect(t, http.StatusBadRequest)
+	}
+	var hook apis.Webhook
+	c.Post("/_webhooks", apis.Webhook{URL: "https://example.com/hook", Kind: "objects", Events: []string{apis.WebhookCreated}, Active: true}).
+		Expect(t, http.StatusCreated).JSON(&hook)
+	c.Put("/_webhooks/"+hook.Id, apis.Webhook{URL: "http://127.0.0.1/hook", Events: []string{apis.WebhookCreated}, Active: true}).
+		Expect(t, http.StatusBadRequest)
+
+	// name that resolves to a private address is refused when dialing
+	ctx := storage.NewContext(appengine.NewContext(httptest.NewRequest("GET", "/", nil)), s.Store)
+	key, err := datastore.DecodeKey(hook.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stored apis.Webhook
+	if err := storage.Get(ctx, key, &stored); err != nil {
+		t.Fatal(err)
+	}
+	stored.URL = strings.Replace(target.URL, "127.0.0.1", "localhost", 1)
+	if _, err := storage.Put(ctx, key, &stored); err != nil {
+		t.Fatal(err)
+	}
+	create(t, c, "/objects", Object{Name: "a"})
+	c.Post("/_webhooks/_dispatch", nil).Expect(t, http.StatusOK)
+	if received > 0 {
+		t.Fatal("delivery was sent to a private address")
+	}
+	var deliveries []apis.WebhookDelivery
+	c.Get("/_webhooks/"+hook.Id+"/deliveries").Expect(t, http.StatusOK).JSON(&deliveries)
+	if len(deliveries) != 1 || deliveries[0].Status != apis.DeliveryPending || !strings.Contains(deliveries[0].Error, "isn't public") {
+		t.Fatalf("deliveries are %+v", deliveries)
+	}
+}
+
+func TestWebhookSecretRotation(t *testing.T) {
+	var mu sync.Mutex
+	var signatures []string
+	var bodies [][]byte
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		mu.Lock()
+		defer mu.Unlock()
+		signatures = append(signatures, r.Header.Get(apis.WebhookSignatureHeader))
+		bodies = append(bodies, b)
+	}))
+	defer target.Close()
+
+	_, c := newServer(t, &apis.Options{
+		WebhookPermissions:   apis.Permissions{apis.AllAuthenticatedUsers: {apis.FullControl}},
+		AllowPrivateWebhooks: true,
+	})
+	update := apis.Webhook{URL: target.URL, Kind: "objects", Events: []string{apis.WebhookCreated}, Active: true}
+	var hook apis.Webhook
+	c.Post("/_webhooks", update).Expect(t, http.StatusCreated).JSON(&hook)
+	if len(hook.Secret) == 0 {
+		t.Fatal("secret isn't returned on create")
+	}
+
+	var out apis.Webhook
+	c.Put("/_webhooks/"+hook.Id, update).Expect(t, http.StatusOK).JSON(&out)
+	if len(out.Secret) > 0 {
+		t.Fatal("unchanged secret is returned")
+	}
+	c.Put("/_webhooks/"+hook.Id+"?rotateSecret=true", update).Expect(t, http.StatusOK).JSON(&out)
+	if len(out.Secret) == 0 || out.Secret == hook.Secret {
+		t.Fatalf("rotated secret is %q", out.Secret)
+	}
+	update.Secret = "given secret"
+	c.Put("/_webhooks/"+hook.Id, update).Expect(t, http.StatusOK).JSON(&out)
+	if out.Secret != update.Secret {
+		t.Fatalf("secret is %q after PUT with %q", out.Secret, update.Secret)
+	}
+
+	create(t, c, "/objects", Object{Name: "a"})
+	c.Post("/_webhooks/_dispatch", nil).Expect(t, http.StatusOK)
+	mu.Lock()
+	defer mu.Unlock()
+	if len(signatures) != 1 {
+		t.Fatalf("received %d deliveries", len(signatures))
+	}
+	mac := hmac.New(sha256.New, []byte(update.Secret))
+	mac.Write(bodies[0])
+	if want := "sha256=" + hex.EncodeToString(mac.Sum(nil)); signatures[0] != want {
+		t.Fatalf("signature is %s, want %s", signatures[0], want)
+	}
+}